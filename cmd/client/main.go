@@ -5,8 +5,13 @@ package main
 
 import (
 	"fmt"
-	"io"
+	"math"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/alecthomas/kong"
 	log "github.com/sirupsen/logrus"
@@ -28,11 +33,136 @@ type Context struct {
 // SubmitCmd represents the arguments needed when submitting a new command to the server.
 type SubmitCmd struct {
 	Command string `arg name:"command" help:"Command to run." type:"string"`
+
+	Hostname  string   `help:"Hostname of the job. Defaults to the first segment of the job ID."`
+	AddHost   []string `name:"add-host" help:"Additional /etc/hosts entry (host:ip)."`
+	DNS       []string `name:"dns" help:"Nameserver to add to /etc/resolv.conf."`
+	DNSSearch []string `name:"dns-search" help:"Search domain to add to /etc/resolv.conf."`
+	DNSOption []string `name:"dns-option" help:"Resolver option to add to /etc/resolv.conf."`
+
+	NoFile     string  `name:"nofile" help:"Open file limit (soft[:hard])."`
+	Core       string  `name:"core" help:"Core file size limit in bytes (soft[:hard])."`
+	FileSize   string  `name:"fsize" help:"File size limit in bytes (soft[:hard])."`
+	Stack      string  `name:"stack" help:"Stack size limit in bytes (soft[:hard])."`
+	Nice       int32   `help:"Nice value of the job."`
+	IOClass    string  `name:"io-class" help:"I/O scheduling class (none|realtime|best-effort|idle)." enum:"none,realtime,best-effort,idle" default:"none"`
+	IOPriority int32   `name:"io-priority" help:"I/O scheduling priority within the I/O class."`
+	CPUs       []int32 `name:"cpus" help:"CPUs the job may run on."`
+
+	CPULimit    float64 `name:"cpu-limit" help:"Number of CPUs the job may use, such as 0.5. Reserved from the client's quota."`
+	MemoryLimit int64   `name:"memory-limit" help:"Memory the job may use in bytes. Reserved from the client's quota."`
+
+	OutputLimit       int64 `name:"output-limit" help:"Number of bytes of output to retain. Defaults to the server maximum."`
+	KillOnOutputLimit bool  `name:"kill-on-output-limit" help:"Stop the job if its output exceeds the output limit."`
+
+	Priority string `help:"Priority class of the job (default|interactive|batch)." enum:"default,interactive,batch" default:"default"`
+
+	Label []string `short:"l" sep:"none" help:"Label to attach to the job (key=value). May be repeated."`
+}
+
+// ioClasses maps the I/O class command line values to their protobuf values.
+var ioClasses = map[string]protobuf.Limits_IoClass{
+	"none":        protobuf.Limits_NONE,
+	"realtime":    protobuf.Limits_REALTIME,
+	"best-effort": protobuf.Limits_BEST_EFFORT,
+	"idle":        protobuf.Limits_IDLE,
+}
+
+// priorities maps the priority class command line values to their protobuf
+// values.
+var priorities = map[string]protobuf.Command_Priority{
+	"default":     protobuf.Command_DEFAULT,
+	"interactive": protobuf.Command_INTERACTIVE,
+	"batch":       protobuf.Command_BATCH,
+}
+
+// parseRlimit parses a limit of the form soft[:hard]. If the hard limit is
+// omitted it is set to the soft limit.
+func parseRlimit(s string) (*protobuf.Rlimit, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	soft, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid limit %s: %w", s, err)
+	}
+	hard := soft
+	if len(parts) == 2 {
+		hard, err = strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit %s: %w", s, err)
+		}
+	}
+	return &protobuf.Rlimit{Soft: soft, Hard: hard}, nil
+}
+
+// limits returns the limits specified on the command line.
+func (s *SubmitCmd) limits() (*protobuf.Limits, error) {
+	l := &protobuf.Limits{
+		Nice:        s.Nice,
+		IoClass:     ioClasses[s.IOClass],
+		IoPriority:  s.IOPriority,
+		Cpus:        s.CPUs,
+		CpuMillis:   int64(math.Round(s.CPULimit * 1000)),
+		MemoryBytes: s.MemoryLimit,
+	}
+	var err error
+	if l.Nofile, err = parseRlimit(s.NoFile); err != nil {
+		return nil, err
+	}
+	if l.Core, err = parseRlimit(s.Core); err != nil {
+		return nil, err
+	}
+	if l.Fsize, err = parseRlimit(s.FileSize); err != nil {
+		return nil, err
+	}
+	if l.Stack, err = parseRlimit(s.Stack); err != nil {
+		return nil, err
+	}
+	return l, nil
 }
 
 // Run submits the command to the server.
 func (s *SubmitCmd) Run(ctx *Context) error {
-	jobID, err := ctx.Client.Submit(s.Command)
+	cmd := &protobuf.Command{
+		Command:  s.Command,
+		Hostname: s.Hostname,
+		Dns: &protobuf.DnsConfig{
+			Nameservers: s.DNS,
+			Search:      s.DNSSearch,
+			Options:     s.DNSOption,
+		},
+		OutputLimit:       s.OutputLimit,
+		KillOnOutputLimit: s.KillOnOutputLimit,
+		Priority:          priorities[s.Priority],
+	}
+	limits, err := s.limits()
+	if err != nil {
+		fmt.Printf("Error submitting job: %s\n", err)
+		return err
+	}
+	cmd.Limits = limits
+	cmd.Labels, err = parseLabels(s.Label)
+	if err != nil {
+		fmt.Printf("Error submitting job: %s\n", err)
+		return err
+	}
+
+	for _, h := range s.AddHost {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			err := fmt.Errorf("invalid host entry %s, expected host:ip", h)
+			fmt.Printf("Error submitting job: %s\n", err)
+			return err
+		}
+		cmd.Hosts = append(cmd.Hosts, &protobuf.HostEntry{
+			Ip:        parts[1],
+			Hostnames: []string{parts[0]},
+		})
+	}
+
+	jobID, err := ctx.Client.SubmitCommand(cmd)
 	if err != nil {
 		fmt.Printf("Error submitting job: %s\n", err)
 		return err
@@ -56,26 +186,151 @@ func (s *StopCmd) Run(ctx *Context) error {
 	return nil
 }
 
+// DeleteCmd represents the arguments needed to delete a job.
+type DeleteCmd struct {
+	JobID string `arg name:"jobID" help:"JobID to delete." type:"string"`
+}
+
+// Run deletes the job identified by the given JobID.
+func (d *DeleteCmd) Run(ctx *Context) error {
+	err := ctx.Client.Delete(d.JobID)
+	if err != nil {
+		fmt.Printf("Error deleting job %s: %s\n", d.JobID, err)
+		return err
+	}
+	return nil
+}
+
 // LogsCmd represents the arguments needed to fetch the logs for a job.
 type LogsCmd struct {
-	JobID string `arg name:"jobID" help:"JobID to stop." type:"string"`
+	JobID      string   `arg name:"jobID" help:"JobID to stop." type:"string"`
+	Stream     string   `help:"Output stream to fetch (both|stdout|stderr)." enum:"both,stdout,stderr" default:"both"`
+	Timestamps bool     `short:"t" help:"Prefix each line with the time at which it was written."`
+	Since      string   `help:"Only show output written after this time (a duration such as 5m or an RFC3339 time)."`
+	Until      string   `help:"Only show output written before this time (a duration such as 5m or an RFC3339 time)."`
+	Lines      int      `short:"n" help:"Only show the last N lines of output."`
+	Follow     bool     `short:"f" help:"Keep streaming output until the job finishes."`
+	Raw        bool     `help:"Write the output exactly as written by the job rather than line by line."`
+	Include    []string `short:"e" sep:"none" help:"Only show lines matching this regular expression. May be repeated."`
+	Exclude    []string `short:"v" sep:"none" help:"Hide lines matching this regular expression. May be repeated."`
+	MaxLines   int      `short:"m" name:"max-lines" help:"Stop after showing this many lines."`
+	JSON       bool     `short:"j" name:"json" help:"Parse lines as JSON and pretty-print structured entries."`
+	Field      []string `short:"F" sep:"none" help:"Only show JSON entries with this field (key=value). May be repeated."`
+}
+
+// outputStreams maps the stream command line values to their protobuf values.
+var outputStreams = map[string]protobuf.OutputStream{
+	"both":   protobuf.OutputStream_BOTH,
+	"stdout": protobuf.OutputStream_STDOUT,
+	"stderr": protobuf.OutputStream_STDERR,
 }
 
-// Run fetches the logs identified by the given JobID.
+// Run fetches the logs identified by the given JobID. Output written by the
+// job to stderr is written to stderr and all other output to stdout.
 func (l *LogsCmd) Run(ctx *Context) error {
-	reader, err := ctx.Client.GetLogs(l.JobID)
+	since, err := parseTime(l.Since)
 	if err != nil {
-		fmt.Printf("Error fetching logs for job %s: %s\n", l.JobID, err)
-		return err
+		return fmt.Errorf("invalid --since: %w", err)
+	}
+	until, err := parseTime(l.Until)
+	if err != nil {
+		return fmt.Errorf("invalid --until: %w", err)
 	}
 
-	if _, err := io.Copy(os.Stdout, reader); err != nil {
+	req := &protobuf.LogsRequest{
+		Id:            l.JobID,
+		Stream:        outputStreams[l.Stream],
+		SinceUnixNano: since,
+		UntilUnixNano: until,
+		TailLines:     int64(l.Lines),
+		NoFollow:      !l.Follow,
+		Include:       l.Include,
+		Exclude:       l.Exclude,
+		MaxLines:      int64(l.MaxLines),
+		Structured:    l.JSON,
+	}
+	for _, f := range l.Field {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid field %q, expected key=value", f)
+		}
+		req.Fields = append(req.Fields, &protobuf.Field{Key: parts[0], Value: parts[1]})
+	}
+	if l.Raw {
+		if l.Timestamps || len(l.Include) > 0 || len(l.Exclude) > 0 || l.MaxLines > 0 || l.JSON || len(l.Field) > 0 {
+			return fmt.Errorf("--raw can only be used with --stream, --since, --until, --lines and --follow")
+		}
+		err = ctx.Client.StreamOutput(req, func(chunk *protobuf.OutputChunk) error {
+			out := os.Stdout
+			if chunk.Stream == protobuf.OutputStream_STDERR {
+				out = os.Stderr
+			}
+			_, err := out.Write(chunk.Data)
+			return err
+		})
+		if err != nil {
+			fmt.Printf("Error fetching output for job %s: %s\n", l.JobID, err)
+			return err
+		}
+		return nil
+	}
+
+	err = ctx.Client.StreamLogs(req, func(log *protobuf.Log) error {
+		out := os.Stdout
+		if log.Stream == protobuf.OutputStream_STDERR {
+			out = os.Stderr
+		}
+		text := log.LogLine
+		if log.Structured {
+			text = formatEntry(log)
+		}
+		if l.Timestamps {
+			t := time.Unix(0, log.TimestampUnixNano)
+			_, err := fmt.Fprintf(out, "%s %s\n", t.Format(time.RFC3339Nano), text)
+			return err
+		}
+		_, err := fmt.Fprintln(out, text)
+		return err
+	})
+	if err != nil {
 		fmt.Printf("Error fetching logs for job %s: %s\n", l.JobID, err)
 		return err
 	}
 	return nil
 }
 
+// formatEntry formats a structured log entry as its level and message
+// followed by its remaining fields.
+func formatEntry(log *protobuf.Log) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-5s %s", strings.ToUpper(log.Level), log.Message)
+	for _, f := range log.Fields {
+		value := f.Value
+		if value == "" || strings.ContainsAny(value, " \t\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", f.Key, value)
+	}
+	return b.String()
+}
+
+// parseTime parses either a duration, which is taken to be relative to now,
+// or an RFC3339 time and returns it in nanoseconds since the Unix epoch. An
+// empty string is returned as zero.
+func parseTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d).UnixNano(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is neither a duration nor an RFC3339 time", s)
+	}
+	return t.UnixNano(), nil
+}
+
 // StatusCmd represents the arguments needed to query the status of a job.
 type StatusCmd struct {
 	JobID string `arg name:"jobID" help:"JobID to stop." type:"string"`
@@ -93,6 +348,260 @@ func (s *StatusCmd) Run(ctx *Context) error {
 	if status.Status == protobuf.StatusResponse_COMPLETED {
 		fmt.Printf("Exit code: %d\n", status.ExitCode)
 	}
+	if status.Status == protobuf.StatusResponse_LOST {
+		fmt.Println("The server restarted while the job was running")
+	}
+	if status.Status == protobuf.StatusResponse_QUEUED || status.Status == protobuf.StatusResponse_PAUSED {
+		fmt.Printf("Queue position: %d\n", status.QueuePosition)
+	}
+	if status.OutputTruncated {
+		fmt.Println("Output truncated: the output exceeded the output limit")
+	}
+	if status.Usage != nil {
+		printUsage(status.Usage)
+	}
+	return nil
+}
+
+// StatsCmd represents the arguments needed to query the resource usage of a job.
+type StatsCmd struct {
+	JobID  string `arg name:"jobID" help:"JobID to get the resource usage of." type:"string"`
+	Follow bool   `short:"f" help:"Continue to print the resource usage until the job finishes."`
+}
+
+// Run prints the resource usage of the job identified by the given JobID.
+func (s *StatsCmd) Run(ctx *Context) error {
+	if s.Follow {
+		err := ctx.Client.StreamStats(s.JobID, func(u *protobuf.ResourceUsage) {
+			printUsage(u)
+			fmt.Println()
+		})
+		if err != nil {
+			fmt.Printf("Error fetching stats for job %s: %s\n", s.JobID, err)
+		}
+		return err
+	}
+
+	usage, err := ctx.Client.Stats(s.JobID)
+	if err != nil {
+		fmt.Printf("Error fetching stats for job %s: %s\n", s.JobID, err)
+		return err
+	}
+	printUsage(usage)
+	return nil
+}
+
+// TopCmd represents the arguments needed to list the processes of a job.
+type TopCmd struct {
+	JobID string `arg name:"jobID" help:"JobID to list the processes of." type:"string"`
+}
+
+// Run prints the processes running within the job identified by the given JobID.
+func (t *TopCmd) Run(ctx *Context) error {
+	processes, err := ctx.Client.Top(t.JobID)
+	if err != nil {
+		fmt.Printf("Error fetching processes for job %s: %s\n", t.JobID, err)
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tHOST PID\tSTATE\tCPU\tRSS\tCOMMAND")
+	for _, p := range processes {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%d\t%s\n",
+			p.Pid, p.HostPid, p.State,
+			time.Duration(p.CpuTimeUsec)*time.Microsecond,
+			p.RssBytes, p.Command)
+	}
+	return w.Flush()
+}
+
+// ListCmd represents the arguments needed to list jobs.
+type ListCmd struct {
+	Status    []string `short:"s" help:"Only list jobs with this status (queued|running|paused|completed|stopped|lost). May be repeated." enum:"queued,running,paused,completed,stopped,lost"`
+	Owner     string   `help:"Only list jobs submitted by this client."`
+	Label     []string `short:"l" sep:"none" help:"Only list jobs with this label (key=value). May be repeated."`
+	Since     string   `help:"Only list jobs created after this time (a duration such as 5m or an RFC3339 time)."`
+	Until     string   `help:"Only list jobs created before this time (a duration such as 5m or an RFC3339 time)."`
+	Limit     int32    `short:"n" help:"Maximum number of jobs to list." default:"50"`
+	PageToken string   `name:"page-token" help:"Continue a previous listing from the given token."`
+}
+
+// jobStatuses maps the status command line values to their protobuf values.
+var jobStatuses = map[string]protobuf.StatusResponse_StatusType{
+	"queued":    protobuf.StatusResponse_QUEUED,
+	"running":   protobuf.StatusResponse_RUNNING,
+	"paused":    protobuf.StatusResponse_PAUSED,
+	"completed": protobuf.StatusResponse_COMPLETED,
+	"stopped":   protobuf.StatusResponse_STOPPED,
+	"lost":      protobuf.StatusResponse_LOST,
+}
+
+// Run lists the jobs selected by the given filters.
+func (l *ListCmd) Run(ctx *Context) error {
+	req := &protobuf.ListJobsRequest{
+		Owner:     l.Owner,
+		PageSize:  l.Limit,
+		PageToken: l.PageToken,
+	}
+	for _, s := range l.Status {
+		req.Statuses = append(req.Statuses, jobStatuses[s])
+	}
+	var err error
+	req.Labels, err = parseLabels(l.Label)
+	if err == nil {
+		req.CreatedAfterUnixNano, err = parseTime(l.Since)
+	}
+	if err == nil {
+		req.CreatedBeforeUnixNano, err = parseTime(l.Until)
+	}
+	if err != nil {
+		fmt.Printf("Error listing jobs: %s\n", err)
+		return err
+	}
+
+	resp, err := ctx.Client.ListJobs(req)
+	if err != nil {
+		fmt.Printf("Error listing jobs: %s\n", err)
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tOWNER\tCREATED\tFINISHED\tCOMMAND\tLABELS")
+	for _, j := range resp.Jobs {
+		finished := "-"
+		if j.FinishedUnixNano != 0 {
+			finished = time.Unix(0, j.FinishedUnixNano).Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			j.Id, j.Status, j.Owner,
+			time.Unix(0, j.CreatedUnixNano).Format(time.RFC3339),
+			finished, j.Command, formatLabels(j.Labels))
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	if resp.NextPageToken != "" {
+		fmt.Printf("\nMore jobs are available, continue with --page-token %s\n", resp.NextPageToken)
+	}
+	return nil
+}
+
+// QuotaCmd represents the arguments needed to get a client's quota.
+type QuotaCmd struct {
+	Identity string `arg optional name:"identity" help:"Client to get the quota of. Defaults to this client." type:"string"`
+}
+
+// Run prints the quota of the client, and its usage.
+func (q *QuotaCmd) Run(ctx *Context) error {
+	resp, err := ctx.Client.GetQuota(q.Identity)
+	if err != nil {
+		fmt.Printf("Error fetching quota: %s\n", err)
+		return err
+	}
+	fmt.Printf("Running jobs: %s\n", formatQuota(int64(resp.RunningJobs), int64(resp.MaxRunningJobs), ""))
+	fmt.Printf("Queued jobs: %s\n", formatQuota(int64(resp.QueuedJobs), int64(resp.MaxQueuedJobs), ""))
+	fmt.Printf("CPU reserved: %s\n", formatQuota(resp.CpuMillis, resp.MaxCpuMillis, " thousandths of a CPU"))
+	fmt.Printf("Memory reserved: %s\n", formatQuota(resp.MemoryBytes, resp.MaxMemoryBytes, " bytes"))
+	fmt.Printf("Output retained: %s\n", formatQuota(resp.RetainedBytes, resp.MaxRetainedBytes, " bytes"))
+	return nil
+}
+
+// formatQuota returns the given usage, in the given unit, along with its limit
+// if any.
+func formatQuota(used, max int64, unit string) string {
+	if max == 0 {
+		return fmt.Sprintf("%d%s (no limit)", used, unit)
+	}
+	return fmt.Sprintf("%d of %d%s", used, max, unit)
+}
+
+// NodeCmd represents the arguments needed to get the server's node info.
+type NodeCmd struct{}
+
+// Run prints the capacity of the server's host, the resources reserved by its
+// jobs and its current usage.
+func (n *NodeCmd) Run(ctx *Context) error {
+	resp, err := ctx.Client.NodeInfo()
+	if err != nil {
+		fmt.Printf("Error fetching node info: %s\n", err)
+		return err
+	}
+	fmt.Printf("CPU: %d thousandths of a CPU, overcommit %s\n", resp.CpuMillis, formatOvercommit(resp.CpuOvercommit))
+	fmt.Printf("Memory: %d bytes, overcommit %s\n", resp.MemoryBytes, formatOvercommit(resp.MemoryOvercommit))
+	fmt.Printf("CPU reserved: %d thousandths of a CPU\n", resp.ReservedCpuMillis)
+	fmt.Printf("Memory reserved: %d bytes\n", resp.ReservedMemoryBytes)
+	fmt.Printf("Memory used: %d bytes\n", resp.MemoryUsedBytes)
+	fmt.Printf("Load average: %.2f\n", resp.LoadAverage)
+	fmt.Printf("Running jobs: %d\n", resp.RunningJobs)
+	fmt.Printf("Queued jobs: %d\n", resp.QueuedJobs)
+	return nil
+}
+
+// formatOvercommit returns the given overcommit ratio, zero meaning that jobs
+// are admitted regardless of their limits.
+func formatOvercommit(ratio float64) string {
+	if ratio == 0 {
+		return "not enforced"
+	}
+	return fmt.Sprintf("%gx", ratio)
+}
+
+// parseLabels parses labels of the form key=value.
+func parseLabels(labels []string) (map[string]string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(labels))
+	for _, l := range labels {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid label %s, expected key=value", l)
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m, nil
+}
+
+// formatLabels returns the given labels as a comma separated list of
+// key=value pairs, sorted by key.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// printUsage prints the given resource usage.
+func printUsage(u *protobuf.ResourceUsage) {
+	user := time.Duration(u.UserTimeUsec) * time.Microsecond
+	system := time.Duration(u.SystemTimeUsec) * time.Microsecond
+	fmt.Printf("CPU time: %s (user %s, system %s)\n", user+system, user, system)
+	fmt.Printf("Memory: %d bytes (peak %d bytes)\n", u.MemoryCurrentBytes, u.MemoryPeakBytes)
+	fmt.Printf("IO: %d bytes read, %d bytes written\n", u.IoReadBytes, u.IoWriteBytes)
+	fmt.Printf("PIDs: %d\n", u.Pids)
+	fmt.Printf("Wall time: %s\n", time.Duration(u.WallTimeUsec)*time.Microsecond)
+}
+
+// ExecCmd represents the arguments needed to run a command inside a running job.
+type ExecCmd struct {
+	JobID string   `arg name:"jobID" help:"JobID to run the command in." type:"string"`
+	Argv  []string `arg name:"command" help:"Command and arguments to run."`
+}
+
+// Run runs the command inside the job identified by the given JobID and
+// exits with the command's exit code.
+func (e *ExecCmd) Run(ctx *Context) error {
+	exitCode, err := ctx.Client.Exec(e.JobID, e.Argv, os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Printf("Error running command in job %s: %s\n", e.JobID, err)
+		return err
+	}
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
 	return nil
 }
 
@@ -100,8 +609,15 @@ func (s *StatusCmd) Run(ctx *Context) error {
 var cli struct {
 	Submit SubmitCmd `cmd help:"Submit command."`
 	Stop   StopCmd   `cmd help:"Stop the given JobID."`
+	Delete DeleteCmd `cmd help:"Delete the given finished JobID and its output."`
 	Status StatusCmd `cmd help:"Get the status of the given JobID."`
 	Logs   LogsCmd   `cmd help:"Get the logs for the given JobID."`
+	Exec   ExecCmd   `cmd help:"Run a command inside the given JobID."`
+	Stats  StatsCmd  `cmd help:"Get the resource usage of the given JobID."`
+	Top    TopCmd    `cmd help:"List the processes running in the given JobID."`
+	List   ListCmd   `cmd help:"List jobs."`
+	Quota  QuotaCmd  `cmd help:"Get the quota of this, or the given, client."`
+	Node   NodeCmd   `cmd help:"Get the capacity and usage of the server's host."`
 
 	Profile string `short:"p" help:"TLS profile to connect with (a|b|admin)." default:"a"`
 	Address string `short:"h" help:"Address of the server." default:":8080"`
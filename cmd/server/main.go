@@ -8,19 +8,62 @@ package main
 
 import (
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/thompsy/worker-api-service/lib"
 	"github.com/thompsy/worker-api-service/lib/backend"
 	"github.com/thompsy/worker-api-service/lib/server"
 )
 
-func main() {
-	conf := server.Config{
+// config returns the configuration of the server.
+func config() server.Config {
+	return server.Config{
 		CaCertFile:     "./certs/ca.crt",
 		ServerCertFile: "./certs/server.crt",
 		ServerKeyFile:  "./certs/server.key",
 		Address:        ":8080",
+		Priorities: map[string][]lib.Priority{
+			"*": {lib.PriorityBatch},
+		},
+		QuotaFile: "./quotas.json",
+		SubmitRateLimits: server.RateLimits{
+			Default: server.RateLimit{Rate: 5, Burst: 20},
+			Clients: map[string]server.RateLimit{
+				"admin@example.com": {},
+			},
+		},
+		RequestRateLimits: server.RateLimits{
+			Default: server.RateLimit{Rate: 50, Burst: 100},
+		},
+		Worker: backend.Config{
+			// Core dumps and open files are capped and clients may
+			// only lower the CPU priority of their jobs, e.g. for
+			// batch work, never raise it above that of the server.
+			Limits: backend.LimitPolicy{
+				MaxNoFile: 4096,
+				MaxCore:   64 << 20,
+				MinNice:   0,
+			},
+			CgroupRoot:        "/sys/fs/cgroup/worker-api",
+			OutputMemoryLimit: 1 << 20,
+			MaxOutputBytes:    64 << 20,
+			MaxRunningJobs:    16,
+			CPUOvercommit:     2,
+			MemoryOvercommit:  1,
+			Preemption:        backend.PreemptPause,
+			DataDir:           "/var/lib/worker-api",
+			Retention: backend.RetentionPolicy{
+				MaxAge:           24 * time.Hour,
+				MaxFinishedJobs:  1000,
+				MaxRetainedBytes: 1 << 30,
+			},
+		},
 	}
+}
+
+func main() {
+	conf := config()
 
 	// If run with the "exec" argument just run the passed command in an isolated environment and exit.
 	if len(os.Args) > 1 && os.Args[1] == "exec" {
@@ -28,6 +71,19 @@ func main() {
 		os.Exit(0)
 	}
 
+	// If run with the "enter" argument run the passed command inside the namespaces of a running job and
+	// exit with its exit code.
+	if len(os.Args) > 1 && os.Args[1] == "enter" {
+		os.Exit(backend.Enter(os.Args[2]))
+	}
+
+	// If run with the "shim" argument run the passed command under a shim which supervises it on behalf of
+	// the server and exit once it has finished.
+	if len(os.Args) > 1 && os.Args[1] == "shim" {
+		backend.Shim(os.Args[2], os.Args[3], os.Args[4])
+		os.Exit(0)
+	}
+
 	// If no arguments are supplied simply start the server.
 	log.Infof("Starting server. pid: %d", os.Getpid())
 	s, err := server.NewServer(conf)
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+	"github.com/thompsy/worker-api-service/lib/backend"
+)
+
+// TestLimitPolicy verifies that the configured policy rejects large core dumps
+// and raised CPU priorities before any job is started.
+func TestLimitPolicy(t *testing.T) {
+	c := config().Worker
+	c.DataDir = ""
+	w := backend.NewWorker(c)
+	defer w.Close()
+
+	tests := []struct {
+		name   string
+		limits lib.Limits
+	}{
+		{"core", lib.Limits{Core: &lib.Rlimit{Soft: 1 << 30, Hard: 1 << 30}}},
+		{"nofile", lib.Limits{NoFile: &lib.Rlimit{Soft: 1 << 20, Hard: 1 << 20}}},
+		{"nice", lib.Limits{Nice: -5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := w.Submit(lib.Command{Command: "/bin/true", Limits: test.limits})
+			require.NotNil(t, err)
+			require.Contains(t, err.Error(), "permitted")
+		})
+	}
+}
@@ -4,11 +4,42 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"sort"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/thompsy/worker-api-service/lib"
+	"golang.org/x/sys/unix"
 )
 
+// bufferConfig contains the configuration options of a broadcastBuffer.
+type bufferConfig struct {
+	// memoryLimit is the number of bytes retained in memory after which
+	// the oldest chunks are spilled to disk. Zero means no limit.
+	memoryLimit int
+
+	// spillDir is the directory in which spill files are created. If
+	// empty the default directory for temporary files is used.
+	spillDir string
+
+	// outputLimit is the number of bytes of output retained. Once
+	// exceeded the first half of the limit is kept along with a rolling
+	// tail of the most recent output. Zero means no limit.
+	outputLimit int64
+
+	// onLimit, if set, is called when the output limit is first exceeded
+	// and all further output is discarded rather than kept as a rolling
+	// tail.
+	onLimit func()
+
+	// outputLog, if set, records the output so that it survives a
+	// restart of the server.
+	outputLog OutputLog
+}
+
 // broadcastBuffer is an io.Writer which allows many simultaneous io.Readers
 // to read the data written to it. This is needed to enable multiple clients
 // to stream the output from a single job from the beginning.
@@ -17,11 +48,57 @@ type broadcastBuffer struct {
 	// state of the broadcastBuffer.
 	mtx sync.RWMutex
 
+	config bufferConfig
+
 	// closed represents whether the buffer has been closed.
 	closed bool
 
-	// data contains all the data written to the buffer.
-	data [][]byte
+	// chunks contains the data written to the buffer in the order it was
+	// written. If the output limit has been exceeded chunks may have been
+	// dropped, leaving gaps in their sequence numbers and offsets.
+	chunks []chunk
+
+	// written is the number of chunks written to the buffer and so the
+	// sequence number of the next chunk.
+	written uint64
+
+	// headChunks is the number of chunks within the first half of the
+	// output limit which are never dropped and headBytes is the number
+	// of bytes they contain. tailBytes is the number of bytes retained
+	// in the chunks after them.
+	headChunks int
+	headBytes  int64
+	tailBytes  int
+
+	// truncated is true once output has been dropped or discarded
+	// because the output limit was exceeded.
+	truncated bool
+
+	// memoryBytes is the number of bytes held in memory.
+	memoryBytes int
+
+	// spilled is the number of chunks which have been moved to the
+	// spill file. Since the oldest chunks are spilled first these are
+	// always chunks[:spilled].
+	spilled int
+
+	// spillFile contains the data of spilled chunks. It is unlinked as
+	// soon as it is created so that it is removed once closed.
+	spillFile *os.File
+
+	// outputSize is the total number of bytes written to the buffer,
+	// including any which have been dropped.
+	outputSize int64
+
+	// segments contains the compressed output once the buffer has been
+	// compacted. If the output had been spilled the compressed data is
+	// stored in compactFile.
+	segments    []segment
+	compactFile *os.File
+
+	// released is true once the output has been discarded because the
+	// job was deleted.
+	released bool
 
 	// consumers are channels to which new write notifications are
 	// propagated allowing readers to be alerted when new data is
@@ -29,26 +106,304 @@ type broadcastBuffer struct {
 	consumers []chan<- struct{}
 }
 
+// chunk is the data from a single write to the broadcastBuffer. The data is
+// held in memory until it is spilled to disk. Since chunks are spilled in
+// order the data is stored in the spill file at the chunk's offset within
+// the output.
+type chunk struct {
+	stream lib.OutputStream
+	seq    uint64
+	time   time.Time
+	data   []byte
+	offset int64
+	length int
+
+	// segment and position locate the chunk's data within the compressed
+	// segments once the buffer has been compacted.
+	segment  int
+	position int
+}
+
+// OutputReader reads the output of a job. As well as the raw output returned
+// by Read, the output can be read a chunk at a time along with the stream to
+// which it was written.
+type OutputReader interface {
+	io.Reader
+
+	// ReadChunk returns the next, or the remainder of the current,
+	// chunk of output. It blocks in the same way as Read.
+	ReadChunk() (lib.OutputChunk, error)
+}
+
 // newBroadcastBuffer returns a correctly initialized BroadcastBuffer.
-func newBroadcastBuffer() *broadcastBuffer {
+func newBroadcastBuffer(c bufferConfig) *broadcastBuffer {
 	return &broadcastBuffer{
-		data:      make([][]byte, 0),
+		config:    c,
+		chunks:    make([]chunk, 0),
 		consumers: make([]chan<- struct{}, 0),
 	}
 }
 
-// size returns the number of chunks written to the buffer.
+// size returns the number of chunks retained by the buffer.
 func (b *broadcastBuffer) size() int {
 	b.mtx.RLock()
 	defer b.mtx.RUnlock()
-	return len(b.data)
+	return len(b.chunks)
+}
+
+// nextSeq returns the sequence number of the next chunk to be written.
+func (b *broadcastBuffer) nextSeq() uint64 {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.written
+}
+
+// extent returns the number of chunks and of bytes, including any which have
+// been dropped, written to the buffer so far.
+func (b *broadcastBuffer) extent() (uint64, int64) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.written, b.outputSize
+}
+
+// totalSize returns the number of bytes written to the buffer, including any
+// which have been dropped.
+func (b *broadcastBuffer) totalSize() int64 {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.outputSize
+}
+
+// isTruncated returns true if any output has been dropped because the output
+// limit was exceeded.
+func (b *broadcastBuffer) isTruncated() bool {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.truncated
+}
+
+// isClosed returns true if the buffer has been closed.
+func (b *broadcastBuffer) isClosed() bool {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.closed
+}
+
+// chunkAt returns the chunk at the given index, reading its data from the
+// spill file or decompressing it if necessary. If the buffer has been
+// compacted the given cache, if any, is used to avoid decompressing the same
+// segment repeatedly.
+func (b *broadcastBuffer) chunkAt(index int, cache *segmentCache) (lib.OutputChunk, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.chunkAtLocked(index, cache)
+}
+
+// chunkFrom returns the first retained chunk with a sequence number of at
+// least seq. At least one chunk with such a sequence number must have been
+// written.
+func (b *broadcastBuffer) chunkFrom(seq uint64, cache *segmentCache) (lib.OutputChunk, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	i := sort.Search(len(b.chunks), func(i int) bool {
+		return b.chunks[i].seq >= seq
+	})
+	return b.chunkAtLocked(i, cache)
+}
+
+// chunkAtLocked returns the chunk at the given index. The read lock must be
+// held by the caller.
+func (b *broadcastBuffer) chunkAtLocked(index int, cache *segmentCache) (lib.OutputChunk, error) {
+	if b.released {
+		return lib.OutputChunk{}, lib.ErrExpired
+	}
+	c := b.chunks[index]
+	out := lib.OutputChunk{
+		Stream: c.stream,
+		Seq:    c.seq,
+		Time:   c.time,
+		Offset: c.offset,
+		Data:   c.data,
+	}
+	if b.segments != nil {
+		data, err := b.segmentData(c.segment, cache)
+		if err != nil {
+			return lib.OutputChunk{}, err
+		}
+		out.Data = data[c.position : c.position+c.length]
+		return out, nil
+	}
+	if index >= b.spilled {
+		return out, nil
+	}
+
+	out.Data = make([]byte, c.length)
+	_, err := b.spillFile.ReadAt(out.Data, c.offset)
+	if err != nil {
+		return lib.OutputChunk{}, fmt.Errorf("failed to read spilled output: %w", err)
+	}
+	return out, nil
+}
+
+// seqAt returns the sequence number of the first retained chunk written at or
+// after t.
+func (b *broadcastBuffer) seqAt(t time.Time) uint64 {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	i := sort.Search(len(b.chunks), func(i int) bool {
+		return !b.chunks[i].time.Before(t)
+	})
+	return b.seqOfIndex(i)
+}
+
+// seqOfOffset returns the sequence number of the first retained chunk which
+// contains the given offset within the output or follows it.
+func (b *broadcastBuffer) seqOfOffset(offset int64) uint64 {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	i := sort.Search(len(b.chunks), func(i int) bool {
+		c := b.chunks[i]
+		return c.offset+int64(c.length) > offset
+	})
+	return b.seqOfIndex(i)
+}
+
+// seqOfIndex returns the sequence number of the chunk at the given index, or
+// of the next chunk to be written if the index is past the last chunk. The
+// read lock must be held by the caller.
+func (b *broadcastBuffer) seqOfIndex(i int) uint64 {
+	if i < len(b.chunks) {
+		return b.chunks[i].seq
+	}
+	return b.written
 }
 
-// dataAt returns the slice of data at the given index.
-func (b *broadcastBuffer) dataAt(index int) []byte {
+// tailOffset returns the offset of the first of the last n lines written to
+// the given stream. Only as many chunks as are needed to find the lines are
+// read, starting from the most recent. The read lock is held throughout since
+// the output limit may drop chunks, and so move those which remain, as output
+// is written.
+func (b *broadcastBuffer) tailOffset(stream lib.OutputStream, n int) (int64, error) {
 	b.mtx.RLock()
 	defer b.mtx.RUnlock()
-	return b.data[index]
+	lines := 0
+	last := true
+	cache := &segmentCache{}
+	for i := len(b.chunks) - 1; i >= 0; i-- {
+		c, err := b.chunkAtLocked(i, cache)
+		if err != nil {
+			return 0, err
+		}
+		if stream != lib.BOTH && c.Stream != stream {
+			continue
+		}
+		for j := len(c.Data) - 1; j >= 0; j-- {
+			// A newline terminating the output does not start a
+			// new line.
+			if c.Data[j] == '\n' && !last {
+				lines++
+				if lines == n {
+					return c.Offset + int64(j) + 1, nil
+				}
+			}
+			last = false
+		}
+	}
+	return 0, nil
+}
+
+// spill moves the oldest chunks held in memory to the spill file until the
+// memory used is within the configured limit. The lock must be held by the
+// caller.
+func (b *broadcastBuffer) spill() {
+	if b.config.memoryLimit <= 0 || b.memoryBytes <= b.config.memoryLimit {
+		return
+	}
+
+	if b.spillFile == nil {
+		f, err := ioutil.TempFile(b.config.spillDir, "worker-api-output-*")
+		if err != nil {
+			log.WithError(err).Error("failed to create spill file")
+			return
+		}
+		// Unlink the file so that it is cleaned up once closed, even if
+		// the server exits unexpectedly.
+		_ = os.Remove(f.Name())
+		b.spillFile = f
+	}
+
+	for b.memoryBytes > b.config.memoryLimit && b.spilled < len(b.chunks) {
+		c := &b.chunks[b.spilled]
+		_, err := b.spillFile.WriteAt(c.data, c.offset)
+		if err != nil {
+			// Keep the data in memory rather than losing it.
+			log.WithError(err).Error("failed to spill output to disk")
+			return
+		}
+		b.memoryBytes -= c.length
+		c.data = nil
+		b.spilled++
+	}
+}
+
+// limit enforces the output limit after a chunk has been added. Once the
+// retained output exceeds the limit the oldest chunks after the head of the
+// output are dropped, leaving a rolling tail of the most recent output. To
+// avoid moving the chunks on every write enough are dropped to leave a
+// quarter of the tail free. The lock must be held by the caller.
+func (b *broadcastBuffer) limit() {
+	if b.config.outputLimit <= 0 {
+		return
+	}
+
+	last := len(b.chunks) - 1
+	if b.headChunks == last && b.chunks[last].offset < b.config.outputLimit/2 {
+		b.headChunks++
+		b.headBytes += int64(b.chunks[last].length)
+		return
+	}
+	b.tailBytes += b.chunks[last].length
+
+	tailLimit := int(b.config.outputLimit - b.headBytes)
+	if b.tailBytes <= tailLimit {
+		return
+	}
+
+	// Never drop the most recent chunk so that readers always have a
+	// chunk from which to continue.
+	drop := 0
+	for b.tailBytes > tailLimit*3/4 && b.headChunks+drop < last {
+		c := b.chunks[b.headChunks+drop]
+		b.tailBytes -= c.length
+		if b.headChunks+drop < b.spilled {
+			b.punchHole(c)
+		} else {
+			b.memoryBytes -= c.length
+		}
+		drop++
+	}
+	if drop == 0 {
+		return
+	}
+
+	if b.spilled > b.headChunks {
+		spilledDropped := b.spilled - b.headChunks
+		if spilledDropped > drop {
+			spilledDropped = drop
+		}
+		b.spilled -= spilledDropped
+	}
+	b.chunks = append(b.chunks[:b.headChunks], b.chunks[b.headChunks+drop:]...)
+	b.truncated = true
+}
+
+// punchHole frees the space used in the spill file by the given chunk. The
+// lock must be held by the caller.
+func (b *broadcastBuffer) punchHole(c chunk) {
+	err := unix.Fallocate(int(b.spillFile.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, c.offset, int64(c.length))
+	if err != nil {
+		log.WithError(err).Debug("failed to free dropped output in spill file")
+	}
 }
 
 // notificationChannel returns a channel which will receive notifications
@@ -70,9 +425,33 @@ func (b *broadcastBuffer) notificationChannel() <-chan struct{} {
 	return c
 }
 
-// Write copies the given bytes to the internal buffer and notifies any
-// consumers that new data is available.
+// Write copies the given bytes to the internal buffer as output written to
+// stdout and notifies any consumers that new data is available.
 func (b *broadcastBuffer) Write(p []byte) (int, error) {
+	return b.write(lib.STDOUT, p, time.Now())
+}
+
+// streamWriter is an io.Writer which writes to a broadcastBuffer as the
+// given stream.
+type streamWriter struct {
+	buf    *broadcastBuffer
+	stream lib.OutputStream
+}
+
+// Write copies the given bytes to the broadcastBuffer.
+func (w streamWriter) Write(p []byte) (int, error) {
+	return w.buf.write(w.stream, p, time.Now())
+}
+
+// StreamWriter returns an io.Writer which records all data written to it as
+// output written to the given stream.
+func (b *broadcastBuffer) StreamWriter(stream lib.OutputStream) io.Writer {
+	return streamWriter{buf: b, stream: stream}
+}
+
+// write copies the given bytes, written at the given time, to the internal
+// buffer and notifies any consumers that new data is available.
+func (b *broadcastBuffer) write(stream lib.OutputStream, p []byte, now time.Time) (int, error) {
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
 
@@ -86,10 +465,60 @@ func (b *broadcastBuffer) Write(p []byte) (int, error) {
 
 	// Since implementations of io.Writer must not retain p we need to
 	// make a copy.
-	pCopy := make([]byte, len(p))
-	copy(pCopy, p)
+	data := make([]byte, len(p))
+	copy(data, p)
+	offset := b.outputSize
+	b.outputSize += int64(len(p))
+
+	limit := b.config.outputLimit
+	switch {
+	case limit <= 0:
+
+	// Once the limit has been reached output is discarded if the job's
+	// owner is to be notified rather than keeping a rolling tail.
+	case b.config.onLimit != nil:
+		if offset+int64(len(data)) > limit {
+			keep := limit - offset
+			if keep < 0 {
+				keep = 0
+			}
+			data = data[:keep]
+			if !b.truncated {
+				b.truncated = true
+				b.config.onLimit()
+			}
+		}
 
-	b.data = append(b.data, pCopy)
+	default:
+		// Split a write which crosses the end of the head so that the
+		// head never exceeds half of the limit.
+		headLimit := limit / 2
+		if offset < headLimit && offset+int64(len(data)) > headLimit {
+			n := headLimit - offset
+			b.appendChunk(stream, data[:n], offset, now)
+			data = data[n:]
+			offset += n
+		}
+
+		// Only the end of a write which is larger than the whole tail
+		// can be kept.
+		if offset >= headLimit {
+			tailLimit := int(limit - b.headBytes)
+			if len(data) > tailLimit {
+				drop := len(data) - tailLimit
+				data = data[drop:]
+				offset += int64(drop)
+				b.truncated = true
+			}
+		}
+	}
+	if len(data) > 0 {
+		b.appendChunk(stream, data, offset, now)
+	}
+	b.spill()
+	if b.config.outputLog != nil && b.config.outputLog.Full(limit) {
+		b.rewriteLog()
+	}
 
 	for _, c := range b.consumers {
 		select {
@@ -104,6 +533,66 @@ func (b *broadcastBuffer) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// appendChunk adds a chunk containing the given data, which must not be
+// retained by the caller, and applies the output limit. The lock must be held
+// by the caller.
+func (b *broadcastBuffer) appendChunk(stream lib.OutputStream, data []byte, offset int64, t time.Time) {
+	b.chunks = append(b.chunks, chunk{
+		stream: stream,
+		seq:    b.written,
+		time:   t,
+		data:   data,
+		offset: offset,
+		length: len(data),
+	})
+	b.written++
+	b.memoryBytes += len(data)
+
+	if b.config.outputLog != nil {
+		err := b.config.outputLog.AppendChunk(lib.OutputChunk{
+			Stream: stream,
+			Seq:    b.written - 1,
+			Time:   t,
+			Offset: offset,
+			Data:   data,
+		})
+		if err != nil {
+			log.WithError(err).Error("failed to record output")
+			b.closeLog()
+		}
+	}
+	b.limit()
+}
+
+// rewriteLog rewrites the output log to contain only the retained chunks. The
+// lock must be held by the caller.
+func (b *broadcastBuffer) rewriteLog() {
+	chunks := func(fn func(lib.OutputChunk) error) error {
+		for i := range b.chunks {
+			c, err := b.chunkAtLocked(i, nil)
+			if err != nil {
+				return err
+			}
+			err = fn(c)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := b.config.outputLog.Rewrite(chunks, b.outputSize)
+	if err != nil {
+		log.WithError(err).Error("failed to rewrite output log")
+		b.closeLog()
+	}
+}
+
+// closeLog stops recording the output. The lock must be held by the caller.
+func (b *broadcastBuffer) closeLog() {
+	_ = b.config.outputLog.Close()
+	b.config.outputLog = nil
+}
+
 // Close marks the broadcastBuffer as closed. All existing channels are
 // closed but new channels may still be created to consume the data.
 func (b *broadcastBuffer) Close() error {
@@ -111,6 +600,12 @@ func (b *broadcastBuffer) Close() error {
 	defer b.mtx.Unlock()
 
 	b.closed = true
+	if b.config.outputLog != nil {
+		b.rewriteLog()
+	}
+	if b.config.outputLog != nil {
+		b.closeLog()
+	}
 
 	// Close all the channels
 	for _, c := range b.consumers {
@@ -119,13 +614,84 @@ func (b *broadcastBuffer) Close() error {
 	return nil
 }
 
-// NewReader returns a new io.Reader which reads from the broadcastBuffer.
-func (b *broadcastBuffer) NewReader(ctx context.Context) io.Reader {
-	return &consumer{
+// release discards the output of a closed buffer, freeing the memory and
+// files used to retain it. Any further reads return lib.ErrExpired.
+func (b *broadcastBuffer) release() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.released = true
+	if b.config.outputLog != nil {
+		b.closeLog()
+	}
+	b.chunks = nil
+	b.segments = nil
+	b.memoryBytes = 0
+	if b.spillFile != nil {
+		_ = b.spillFile.Close()
+		b.spillFile = nil
+	}
+	if b.compactFile != nil {
+		_ = b.compactFile.Close()
+		b.compactFile = nil
+	}
+}
+
+// retainedBytes returns the number of bytes used to retain the output, in
+// memory or on disk.
+func (b *broadcastBuffer) retainedBytes() int64 {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	if b.segments != nil {
+		var size int64
+		for _, s := range b.segments {
+			size += int64(len(s.data) + s.fileLength)
+		}
+		return size
+	}
+	var size int64
+	for _, c := range b.chunks {
+		size += int64(c.length)
+	}
+	return size
+}
+
+// NewReader returns a new OutputReader which reads the output selected by
+// opts from the broadcastBuffer.
+func (b *broadcastBuffer) NewReader(ctx context.Context, opts lib.LogOptions) OutputReader {
+	r := &consumer{
 		buf:           b,
 		notifications: b.notificationChannel(),
 		ctx:           ctx,
+		opts:          opts,
+	}
+	r.end, r.endSize = b.extent()
+	if opts.Tail > 0 {
+		offset, err := b.tailOffset(opts.Stream, opts.Tail)
+		if err != nil {
+			log.WithError(err).Error("failed to find the start of the tail of the output")
+		}
+		if offset > r.opts.Offset {
+			r.opts.Offset = offset
+		}
+	}
+	r.expected = r.opts.Offset
+
+	// Since chunks are stored in the order in which they were written we
+	// can skip directly to the first chunk in the requested range.
+	if !opts.Since.IsZero() {
+		r.nextSeq = b.seqAt(opts.Since)
+		r.expected = -1
 	}
+	if r.opts.Offset > 0 {
+		seq := b.seqOfOffset(r.opts.Offset)
+		if seq > r.nextSeq {
+			r.nextSeq = seq
+			r.expected = r.opts.Offset
+		}
+	}
+	return r
 }
 
 // consumer is an io.Reader which reads from the BroadcastBuffer.
@@ -139,11 +705,33 @@ type consumer struct {
 
 	// current is a reference to the most recent data read from the
 	// broadcastBuffer.
-	current []byte
+	current lib.OutputChunk
+
+	// pending is a chunk which has been read but is returned after the
+	// truncation marker which precedes it.
+	pending lib.OutputChunk
 
-	// nextIndex is the next index in the broadcastBuffer that the
-	// reader will consume.
-	nextIndex int
+	// nextSeq is the sequence number of the next chunk in the
+	// broadcastBuffer that the reader will consume.
+	nextSeq uint64
+
+	// expected is the offset at which the next chunk is expected to
+	// start, or -1 if unknown. If a chunk starts after this offset then
+	// output has been dropped and a truncation marker is returned.
+	expected int64
+
+	// opts selects which chunks are returned by the reader.
+	opts lib.LogOptions
+
+	// cache holds the most recently decompressed segment once the
+	// buffer has been compacted.
+	cache segmentCache
+
+	// end and endSize are the number of chunks and bytes which had been
+	// written when the reader was created. If opts.NoFollow is set no
+	// chunks after this are read.
+	end     uint64
+	endSize int64
 
 	ctx context.Context
 }
@@ -154,40 +742,169 @@ type consumer struct {
 // io.ErrNoProgress in the case where the buffer is only updated intermittently.
 func (r *consumer) Read(p []byte) (int, error) {
 	// If we don't have any current data get some from the buffer.
-	if len(r.current) == 0 {
+	if len(r.current.Data) == 0 {
+		c, err := r.ReadChunk()
+		if err != nil {
+			return 0, err
+		}
+		r.current = c
+	}
+
+	n := copy(p, r.current.Data)
+	r.current.Data = r.current.Data[n:]
+	return n, nil
+}
+
+// ReadChunk returns the remainder of the current chunk, if any, or the next
+// chunk selected by the reader's options. If no chunks are available this
+// call will block until either data is available or the broadcastBuffer is
+// closed, in which case io.EOF is returned.
+func (r *consumer) ReadChunk() (lib.OutputChunk, error) {
+	if len(r.current.Data) > 0 {
+		c := r.current
+		r.current = lib.OutputChunk{}
+		return c, nil
+	}
+	if len(r.pending.Data) > 0 {
+		c := r.pending
+		r.pending = lib.OutputChunk{}
+		return c, nil
+	}
+
+	for {
+		if r.opts.NoFollow && r.nextSeq >= r.end {
+			if m, ok := r.endMarker(r.endSize); ok {
+				return m, nil
+			}
+			return lib.OutputChunk{}, io.EOF
+		}
 
 		// In this case we've read all the data available from the
 		// buffer and we want to block by listening on the channel
 		// until more data is available or the channel is closed.
-		if r.nextIndex >= r.buf.size() {
-			select {
-			case <-r.notifications:
-			case <-r.ctx.Done():
-				log.Info("early out of reading")
-				return 0, r.ctx.Err()
+		if r.nextSeq >= r.buf.nextSeq() {
+			err := r.wait()
+			if err != nil {
+				return lib.OutputChunk{}, err
 			}
 		}
 
-		// If the writer's index has advanced then we have more
-		// data to read.
-		if r.nextIndex < r.buf.size() {
-			r.current = r.buf.dataAt(r.nextIndex)
-			r.nextIndex++
+		// If the writer's sequence number has advanced then we have
+		// more data to read.
+		if r.nextSeq < r.buf.nextSeq() {
+			c, err := r.buf.chunkFrom(r.nextSeq, &r.cache)
+			if err != nil {
+				return lib.OutputChunk{}, err
+			}
+			r.nextSeq = c.Seq + 1
 
 			// drain the channel to prevent consuming stale
 			// notifications and mistakenly returning EOF.
 			for len(r.notifications) > 0 {
 				<-r.notifications
 			}
+
+			if !r.opts.Until.IsZero() && c.Time.After(r.opts.Until) {
+				return lib.OutputChunk{}, io.EOF
+			}
+
+			gapStart := r.expected
+			r.expected = c.Offset + int64(len(c.Data))
+
+			// The first chunk may start before the requested offset
+			// in which case the bytes which have already been read
+			// are skipped.
+			if skip := r.opts.Offset - c.Offset; skip > 0 {
+				if skip >= int64(len(c.Data)) {
+					continue
+				}
+				c.Data = c.Data[skip:]
+				c.Offset += skip
+			}
+
+			if gapStart >= 0 && c.Offset > gapStart {
+				m := r.marker(gapStart, c.Offset-gapStart, c.Stream, c.Seq, c.Time)
+				if r.selected(m) {
+					if r.selected(c) {
+						r.pending = c
+					}
+					return m, nil
+				}
+			}
+			if r.selected(c) {
+				return c, nil
+			}
+			continue
+		}
+
+		// If there is still no data and the buffer has been closed
+		// then we must have reached the end of the data. If output
+		// was discarded after the last chunk a marker is returned
+		// first.
+		if r.buf.isClosed() {
+			if m, ok := r.endMarker(r.buf.totalSize()); ok {
+				return m, nil
+			}
+			return lib.OutputChunk{}, io.EOF
 		}
 	}
-	// If we still don't have any data then we must have reached the end
-	// of the data.
-	if len(r.current) == 0 {
-		return 0, io.EOF
+}
+
+// endMarker returns a marker for the output discarded after the last chunk
+// read, given the total size of the output, if any was.
+func (r *consumer) endMarker(total int64) (lib.OutputChunk, bool) {
+	if r.expected < 0 || total <= r.expected {
+		return lib.OutputChunk{}, false
 	}
+	m := r.marker(r.expected, total-r.expected, lib.STDOUT, r.nextSeq, time.Now())
+	r.expected = total
+	return m, true
+}
 
-	n := copy(p, r.current)
-	r.current = r.current[n:]
-	return n, nil
+// wait blocks until a write notification is received. If the end of the
+// requested time range passes while waiting io.EOF is returned since no
+// further chunks can be selected.
+func (r *consumer) wait() error {
+	var until <-chan time.Time
+	if !r.opts.Until.IsZero() {
+		timer := time.NewTimer(time.Until(r.opts.Until))
+		defer timer.Stop()
+		until = timer.C
+	}
+
+	select {
+	case <-r.notifications:
+		return nil
+	case <-until:
+		return io.EOF
+	case <-r.ctx.Done():
+		log.Info("early out of reading")
+		return r.ctx.Err()
+	}
+}
+
+// marker returns a chunk containing a visible marker indicating that the given
+// number of bytes of output were dropped at offset. The marker is returned on
+// the stream selected by the reader, or the given stream if both are selected.
+func (r *consumer) marker(offset, dropped int64, stream lib.OutputStream, seq uint64, t time.Time) lib.OutputChunk {
+	if r.opts.Stream != lib.BOTH {
+		stream = r.opts.Stream
+	}
+	return lib.OutputChunk{
+		Stream:  stream,
+		Seq:     seq,
+		Time:    t,
+		Offset:  offset,
+		Data:    []byte(fmt.Sprintf("[... %d bytes of output truncated ...]\n", dropped)),
+		Dropped: dropped,
+	}
+}
+
+// selected returns true if the given chunk is selected by the reader's
+// options.
+func (r *consumer) selected(c lib.OutputChunk) bool {
+	if r.opts.Stream != lib.BOTH && r.opts.Stream != c.Stream {
+		return false
+	}
+	return r.opts.Since.IsZero() || !c.Time.Before(r.opts.Since)
 }
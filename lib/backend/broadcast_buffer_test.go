@@ -2,8 +2,12 @@ package backend
 
 import (
 	"context"
+	"fmt"
 	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+	"io"
 	"io/ioutil"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -17,12 +21,12 @@ const (
 
 // TestRead verifies that a new reader will correctly read a single write.
 func TestRead(t *testing.T) {
-	b := newBroadcastBuffer()
+	b := newBroadcastBuffer(bufferConfig{})
 
 	_, err := b.Write([]byte(itemOne))
 	require.Nil(t, err)
 
-	r := b.NewReader(context.Background())
+	r := b.NewReader(context.Background(), lib.LogOptions{})
 	p := make([]byte, 15)
 
 	n, err := r.Read(p)
@@ -41,12 +45,12 @@ func TestEOFDetection(t *testing.T) {
 	done := make(chan bool)
 
 	go func() {
-		b := newBroadcastBuffer()
+		b := newBroadcastBuffer(bufferConfig{})
 
 		_, _ = b.Write([]byte(itemOne))
 		_, _ = b.Write([]byte(itemTwo))
 
-		r := b.NewReader(context.Background())
+		r := b.NewReader(context.Background(), lib.LogOptions{})
 		p := make([]byte, 15)
 
 		_, _ = r.Read(p)
@@ -74,7 +78,7 @@ func TestEOFDetection(t *testing.T) {
 // BroadcastBuffer has been closed will still be able to read all the
 // previous data.
 func TestLateReadersGetAllData(t *testing.T) {
-	b := newBroadcastBuffer()
+	b := newBroadcastBuffer(bufferConfig{})
 
 	_, err := b.Write([]byte(itemOne))
 	require.Nil(t, err)
@@ -82,19 +86,19 @@ func TestLateReadersGetAllData(t *testing.T) {
 	require.Nil(t, err)
 	b.Close()
 
-	r := b.NewReader(context.Background())
+	r := b.NewReader(context.Background(), lib.LogOptions{})
 	data, err := ioutil.ReadAll(r)
 	require.Nil(t, err)
 	require.Equal(t, itemOne+itemTwo, string(data))
 }
 
 func TestContext(t *testing.T) {
-	b := newBroadcastBuffer()
+	b := newBroadcastBuffer(bufferConfig{})
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(1*time.Second))
 	defer cancel()
 
-	r := b.NewReader(ctx)
+	r := b.NewReader(ctx, lib.LogOptions{})
 
 	_, err := ioutil.ReadAll(r)
 	require.EqualError(t, err, context.DeadlineExceeded.Error())
@@ -103,14 +107,14 @@ func TestContext(t *testing.T) {
 // TestConcurrentRead verifies that readers can read correctly from a
 // slow writer.
 func TestConcurrentRead(t *testing.T) {
-	b := newBroadcastBuffer()
+	b := newBroadcastBuffer(bufferConfig{})
 
 	var wg sync.WaitGroup
 	for range []int{0, 1, 2} {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			r := b.NewReader(context.Background())
+			r := b.NewReader(context.Background(), lib.LogOptions{})
 			out, err := ioutil.ReadAll(r)
 			require.Nil(t, err)
 			require.Equal(t, itemOne+itemTwo, string(out))
@@ -133,3 +137,286 @@ func TestConcurrentRead(t *testing.T) {
 	}()
 	wg.Wait()
 }
+
+// TestSpillToDisk verifies that once the memory limit is exceeded the oldest
+// chunks are spilled to disk and that readers still see the full output.
+func TestSpillToDisk(t *testing.T) {
+	b := newBroadcastBuffer(bufferConfig{memoryLimit: 15})
+
+	r := b.NewReader(context.Background(), lib.LogOptions{})
+	p := make([]byte, 5)
+	n, err := b.Write([]byte(itemOne))
+	require.Nil(t, err)
+	require.Equal(t, 10, n)
+
+	// Partially read the first chunk before it is spilled.
+	n, err = r.Read(p)
+	require.Nil(t, err)
+	require.Equal(t, "first", string(p[:n]))
+
+	_, err = b.Write([]byte(itemTwo))
+	require.Nil(t, err)
+	_, err = b.Write([]byte(itemThree))
+	require.Nil(t, err)
+	b.Close()
+
+	require.Equal(t, 2, b.spilled)
+	require.Equal(t, len(itemThree), b.memoryBytes)
+
+	rest, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, itemOne[5:]+itemTwo+itemThree, string(rest))
+
+	all, err := ioutil.ReadAll(b.NewReader(context.Background(), lib.LogOptions{}))
+	require.Nil(t, err)
+	require.Equal(t, itemOne+itemTwo+itemThree, string(all))
+}
+
+// TestStreamSelection verifies that readers only receive the output of the
+// selected stream while the order of the output is preserved.
+func TestStreamSelection(t *testing.T) {
+	b := newBroadcastBuffer(bufferConfig{})
+	_, err := b.StreamWriter(lib.STDOUT).Write([]byte(itemOne))
+	require.Nil(t, err)
+	_, err = b.StreamWriter(lib.STDERR).Write([]byte(itemTwo))
+	require.Nil(t, err)
+	_, err = b.StreamWriter(lib.STDOUT).Write([]byte(itemThree))
+	require.Nil(t, err)
+	b.Close()
+
+	tests := []struct {
+		stream   lib.OutputStream
+		expected string
+	}{
+		{lib.BOTH, itemOne + itemTwo + itemThree},
+		{lib.STDOUT, itemOne + itemThree},
+		{lib.STDERR, itemTwo},
+	}
+	for _, tt := range tests {
+		data, err := ioutil.ReadAll(b.NewReader(context.Background(), lib.LogOptions{Stream: tt.stream}))
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, string(data))
+	}
+
+	r := b.NewReader(context.Background(), lib.LogOptions{})
+	c, err := r.ReadChunk()
+	require.Nil(t, err)
+	require.Equal(t, lib.STDOUT, c.Stream)
+	require.Equal(t, itemOne, string(c.Data))
+	c, err = r.ReadChunk()
+	require.Nil(t, err)
+	require.Equal(t, lib.STDERR, c.Stream)
+	require.Equal(t, itemTwo, string(c.Data))
+}
+
+// TestTimeRange verifies that chunks are stamped with sequence numbers and
+// times and that readers only receive chunks within the requested range.
+func TestTimeRange(t *testing.T) {
+	b := newBroadcastBuffer(bufferConfig{})
+	_, err := b.Write([]byte(itemOne))
+	require.Nil(t, err)
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	_, err = b.Write([]byte(itemTwo))
+	require.Nil(t, err)
+	time.Sleep(10 * time.Millisecond)
+	until := time.Now()
+	_, err = b.Write([]byte(itemThree))
+	require.Nil(t, err)
+
+	r := b.NewReader(context.Background(), lib.LogOptions{})
+	for i := uint64(0); i < 3; i++ {
+		c, err := r.ReadChunk()
+		require.Nil(t, err)
+		require.Equal(t, i, c.Seq)
+		require.False(t, c.Time.IsZero())
+	}
+
+	// The buffer is still open but reading must end once the end of the
+	// requested range has been reached.
+	data, err := ioutil.ReadAll(b.NewReader(context.Background(), lib.LogOptions{Since: since, Until: until}))
+	require.Nil(t, err)
+	require.Equal(t, itemTwo, string(data))
+
+	// Following readers stop once the end of the range passes.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	data, err = ioutil.ReadAll(b.NewReader(ctx, lib.LogOptions{Until: time.Now().Add(50 * time.Millisecond)}))
+	require.Nil(t, err)
+	require.Equal(t, itemOne+itemTwo+itemThree, string(data))
+}
+
+// TestReadFromOffset verifies that a reader can resume from any offset within
+// the output, including one part way through a chunk.
+func TestReadFromOffset(t *testing.T) {
+	b := newBroadcastBuffer(bufferConfig{memoryLimit: len(itemOne)})
+	_, err := b.Write([]byte(itemOne))
+	require.Nil(t, err)
+	_, err = b.Write([]byte(itemTwo))
+	require.Nil(t, err)
+	_, err = b.Write([]byte(itemThree))
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+
+	all := itemOne + itemTwo + itemThree
+	for _, offset := range []int{0, 3, len(itemOne), len(itemOne) + 4, len(all)} {
+		r := b.NewReader(context.Background(), lib.LogOptions{Offset: int64(offset)})
+		c, err := r.ReadChunk()
+		if offset == len(all) {
+			require.Equal(t, io.EOF, err)
+			continue
+		}
+		require.Nil(t, err)
+		require.Equal(t, int64(offset), c.Offset)
+
+		rest, err := ioutil.ReadAll(r)
+		require.Nil(t, err)
+		require.Equal(t, all[offset:], string(c.Data)+string(rest))
+	}
+}
+
+// TestTailAndNoFollow verifies that readers can be restricted to the last
+// lines of the output and to the output written so far.
+func TestTailAndNoFollow(t *testing.T) {
+	b := newBroadcastBuffer(bufferConfig{})
+	_, err := b.StreamWriter(lib.STDOUT).Write([]byte("one\ntwo\nthr"))
+	require.Nil(t, err)
+	_, err = b.StreamWriter(lib.STDERR).Write([]byte("error\n"))
+	require.Nil(t, err)
+	_, err = b.StreamWriter(lib.STDOUT).Write([]byte("ee\nfour\n"))
+	require.Nil(t, err)
+
+	tests := []struct {
+		stream   lib.OutputStream
+		tail     int
+		expected string
+	}{
+		{lib.STDOUT, 1, "four\n"},
+		{lib.STDOUT, 2, "three\nfour\n"},
+		{lib.STDOUT, 3, "two\nthree\nfour\n"},
+		{lib.STDOUT, 10, "one\ntwo\nthree\nfour\n"},
+		{lib.STDERR, 1, "error\n"},
+		{lib.BOTH, 3, "threrror\nee\nfour\n"},
+		{lib.BOTH, 0, "one\ntwo\nthrerror\nee\nfour\n"},
+	}
+	for _, test := range tests {
+		// The buffer is still open so without NoFollow these reads
+		// would block.
+		r := b.NewReader(context.Background(), lib.LogOptions{
+			Stream:   test.stream,
+			Tail:     test.tail,
+			NoFollow: true,
+		})
+		data, err := ioutil.ReadAll(r)
+		require.Nil(t, err)
+		require.Equal(t, test.expected, string(data))
+	}
+}
+
+// TestOutputLimit verifies that once the output limit is exceeded the head
+// of the output and a rolling tail are retained with a marker between them.
+func TestOutputLimit(t *testing.T) {
+	for _, memoryLimit := range []int{0, 10} {
+		b := newBroadcastBuffer(bufferConfig{outputLimit: 40, memoryLimit: memoryLimit})
+		for i := 0; i < 100; i++ {
+			_, err := b.Write([]byte(fmt.Sprintf("%02d\n", i)))
+			require.Nil(t, err)
+		}
+		require.True(t, b.isTruncated())
+		require.Less(t, b.size(), 14)
+
+		// A reader which started before the output was dropped must
+		// also see the marker.
+		r := b.NewReader(context.Background(), lib.LogOptions{})
+		first, err := r.ReadChunk()
+		require.Nil(t, err)
+		require.Equal(t, "00\n", string(first.Data))
+
+		require.Nil(t, b.Close())
+		data, err := ioutil.ReadAll(r)
+		require.Nil(t, err)
+		output := string(first.Data) + string(data)
+		require.True(t, strings.HasPrefix(output, "00\n01\n02\n03\n04\n05\n06[... "), output)
+		require.Contains(t, output, " bytes of output truncated ...]\n")
+		require.True(t, strings.HasSuffix(output, "]\n95\n96\n97\n98\n99\n"), output)
+
+		// Resuming from within the dropped output returns the marker
+		// followed by the tail.
+		r = b.NewReader(context.Background(), lib.LogOptions{Offset: 100})
+		c, err := r.ReadChunk()
+		require.Nil(t, err)
+		require.Contains(t, string(c.Data), "bytes of output truncated")
+		require.Equal(t, int64(100), c.Offset)
+		c, err = r.ReadChunk()
+		require.Nil(t, err)
+		require.Greater(t, c.Offset, int64(100))
+
+		require.Nil(t, b.compact())
+		data, err = ioutil.ReadAll(b.NewReader(context.Background(), lib.LogOptions{}))
+		require.Nil(t, err)
+		require.Equal(t, output, string(data))
+	}
+}
+
+// TestOutputLimitTail verifies that the tail of the output can be read while
+// the output limit is dropping chunks as output is written. More lines are
+// requested than are retained so that every chunk is read.
+func TestOutputLimitTail(t *testing.T) {
+	b := newBroadcastBuffer(bufferConfig{outputLimit: 20000})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20000; i++ {
+			_, _ = b.Write([]byte(fmt.Sprintf("%04d\n", i)))
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			require.True(t, b.isTruncated())
+			return
+		default:
+		}
+		offset, err := b.tailOffset(lib.STDOUT, 10000)
+		require.Nil(t, err)
+		require.Zero(t, offset%5)
+	}
+}
+
+// TestOutputLimitDiscard verifies that once the output limit is exceeded
+// further output is discarded if a limit callback is configured.
+func TestOutputLimitDiscard(t *testing.T) {
+	called := 0
+	b := newBroadcastBuffer(bufferConfig{outputLimit: 10, onLimit: func() { called++ }})
+	for i := 0; i < 10; i++ {
+		_, err := b.Write([]byte(fmt.Sprintf("%d\n", i)))
+		require.Nil(t, err)
+	}
+	require.Nil(t, b.Close())
+	require.Equal(t, 1, called)
+	require.True(t, b.isTruncated())
+
+	data, err := ioutil.ReadAll(b.NewReader(context.Background(), lib.LogOptions{}))
+	require.Nil(t, err)
+	require.Equal(t, "0\n1\n2\n3\n4\n[... 10 bytes of output truncated ...]\n", string(data))
+
+	// The marker is also returned without following the output.
+	data, err = ioutil.ReadAll(b.NewReader(context.Background(), lib.LogOptions{NoFollow: true}))
+	require.Nil(t, err)
+	require.Equal(t, "0\n1\n2\n3\n4\n[... 10 bytes of output truncated ...]\n", string(data))
+}
+
+// TestOutputLimitLargeWrite verifies that a single write larger than the
+// output limit is split between the head and the tail.
+func TestOutputLimitLargeWrite(t *testing.T) {
+	b := newBroadcastBuffer(bufferConfig{outputLimit: 10})
+	_, err := b.Write([]byte(strings.Repeat("a", 10) + strings.Repeat("b", 20) + strings.Repeat("c", 5)))
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+	require.True(t, b.isTruncated())
+
+	data, err := ioutil.ReadAll(b.NewReader(context.Background(), lib.LogOptions{}))
+	require.Nil(t, err)
+	require.Equal(t, "aaaaa[... 25 bytes of output truncated ...]\nccccc", string(data))
+}
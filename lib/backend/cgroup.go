@@ -0,0 +1,264 @@
+package backend
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/thompsy/worker-api-service/lib"
+	"golang.org/x/sys/unix"
+)
+
+// cgroupControllers are the cgroup v2 controllers enabled for each job.
+var cgroupControllers = []string{"+cpu", "+memory", "+io", "+pids"}
+
+// cpuPeriod is the period, in microseconds, over which a job's CPU limit is
+// enforced.
+const cpuPeriod = 100000
+
+// cgroup is a cgroup v2 control group containing the processes of a single
+// job.
+type cgroup struct {
+	path string
+}
+
+// newCgroup creates a cgroup for the given job beneath root. Controllers
+// are enabled on a best-effort basis since not every controller is
+// available on every host; any missing statistics are reported as zero.
+func newCgroup(root string, jobID uuid.UUID) (*cgroup, error) {
+	var fs unix.Statfs_t
+	err := unix.Statfs(filepath.Dir(root), &fs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat cgroup root: %w", err)
+	}
+	if fs.Type != unix.CGROUP2_SUPER_MAGIC {
+		return nil, fmt.Errorf("%s is not within a cgroup v2 hierarchy", root)
+	}
+
+	err = os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cgroup root: %w", err)
+	}
+	for _, c := range cgroupControllers {
+		_ = ioutil.WriteFile(filepath.Join(filepath.Dir(root), "cgroup.subtree_control"), []byte(c), 0)
+		_ = ioutil.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte(c), 0)
+	}
+
+	path := filepath.Join(root, jobID.String())
+	err = os.Mkdir(path, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	return &cgroup{path: path}, nil
+}
+
+// openCgroup returns the existing cgroup of the given job beneath root, or nil
+// if the job was not placed in its own cgroup.
+func openCgroup(root string, jobID uuid.UUID) *cgroup {
+	path := filepath.Join(root, jobID.String())
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+	return &cgroup{path: path}
+}
+
+// freeze freezes, or thaws, every process in the cgroup.
+func (c *cgroup) freeze(frozen bool) error {
+	value := "0"
+	if frozen {
+		value = "1"
+	}
+	return ioutil.WriteFile(filepath.Join(c.path, "cgroup.freeze"), []byte(value), 0)
+}
+
+// setLimits applies the CPU and memory limits of a job to the cgroup.
+func (c *cgroup) setLimits(l lib.Limits) error {
+	if l.CPU > 0 {
+		quota := l.CPU * cpuPeriod / 1000
+		err := ioutil.WriteFile(filepath.Join(c.path, "cpu.max"), []byte(fmt.Sprintf("%d %d", quota, cpuPeriod)), 0)
+		if err != nil {
+			return fmt.Errorf("failed to set CPU limit: %w", err)
+		}
+	}
+	if l.Memory > 0 {
+		err := ioutil.WriteFile(filepath.Join(c.path, "memory.max"), []byte(strconv.FormatInt(l.Memory, 10)), 0)
+		if err != nil {
+			return fmt.Errorf("failed to set memory limit: %w", err)
+		}
+	}
+	return nil
+}
+
+// addProcess moves the process identified by pid into the cgroup. Any
+// processes it subsequently starts will also be members of the cgroup.
+func (c *cgroup) addProcess(pid int) error {
+	return ioutil.WriteFile(filepath.Join(c.path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0)
+}
+
+// join moves the calling process into the cgroup. Since the PID is
+// interpreted in the caller's PID namespace a process may join from within a
+// job's namespaces.
+func (c *cgroup) join() error {
+	return c.addProcess(os.Getpid())
+}
+
+// processes returns the host PIDs of all the processes in the cgroup.
+func (c *cgroup) processes() ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.path, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, f := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid in cgroup.procs: %q", f)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// usage returns the resource usage of the processes in the cgroup. Files
+// belonging to controllers which are not enabled are ignored.
+func (c *cgroup) usage() lib.ResourceUsage {
+	var u lib.ResourceUsage
+
+	cpu := c.readKeyedFile("cpu.stat")
+	u.UserTime = time.Duration(cpu["user_usec"]) * time.Microsecond
+	u.SystemTime = time.Duration(cpu["system_usec"]) * time.Microsecond
+
+	u.MemoryCurrent = c.readUint("memory.current")
+	u.MemoryPeak = c.readUint("memory.peak")
+
+	// io.stat contains a line of keyed values for each device.
+	if f, err := os.Open(filepath.Join(c.path, "io.stat")); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 {
+				continue
+			}
+			for _, field := range fields[1:] {
+				kv := strings.SplitN(field, "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				v, _ := strconv.ParseUint(kv[1], 10, 64)
+				switch kv[0] {
+				case "rbytes":
+					u.IOReadBytes += v
+				case "wbytes":
+					u.IOWriteBytes += v
+				}
+			}
+		}
+		_ = f.Close()
+	}
+
+	if _, err := os.Stat(filepath.Join(c.path, "pids.current")); err == nil {
+		u.PIDs = c.readUint("pids.current")
+	} else if pids, err := c.processes(); err == nil {
+		u.PIDs = uint64(len(pids))
+	}
+	return u
+}
+
+// readUint returns the value of a cgroup file containing a single integer
+// or zero if the file cannot be read.
+func (c *cgroup) readUint(name string) uint64 {
+	data, err := ioutil.ReadFile(filepath.Join(c.path, name))
+	if err != nil {
+		return 0
+	}
+	v, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return v
+}
+
+// readKeyedFile returns the values of a cgroup file containing lines of
+// space separated keys and integer values.
+func (c *cgroup) readKeyedFile(name string) map[string]uint64 {
+	values := make(map[string]uint64)
+	data, err := ioutil.ReadFile(filepath.Join(c.path, name))
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(f[1], 10, 64)
+		if err == nil {
+			values[f[0]] = v
+		}
+	}
+	return values
+}
+
+// remove deletes the cgroup. It must only be called once the job has
+// exited. Since the remaining processes in the job's PID namespace are
+// killed asynchronously by the kernel the removal is retried briefly.
+func (c *cgroup) remove() error {
+	var err error
+	for i := 0; i < 50; i++ {
+		err = syscall.Rmdir(c.path)
+		if err != syscall.EBUSY {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+// rusageToUsage converts the resource usage reported by the kernel when a
+// process exits into a lib.ResourceUsage.
+func rusageToUsage(r *syscall.Rusage) lib.ResourceUsage {
+	if r == nil {
+		return lib.ResourceUsage{}
+	}
+	return lib.ResourceUsage{
+		UserTime:   time.Duration(r.Utime.Nano()),
+		SystemTime: time.Duration(r.Stime.Nano()),
+		// ru_maxrss is measured in kilobytes.
+		MemoryPeak: uint64(r.Maxrss) * 1024,
+		// ru_inblock and ru_oublock are measured in 512 byte blocks.
+		IOReadBytes:  uint64(r.Inblock) * 512,
+		IOWriteBytes: uint64(r.Oublock) * 512,
+	}
+}
+
+// mergeUsage combines the final usage reported by the cgroup and by the
+// kernel on exit, preferring the larger of each value since the cgroup may
+// not have all of its controllers enabled.
+func mergeUsage(a, b lib.ResourceUsage) lib.ResourceUsage {
+	return lib.ResourceUsage{
+		UserTime:     maxDuration(a.UserTime, b.UserTime),
+		SystemTime:   maxDuration(a.SystemTime, b.SystemTime),
+		MemoryPeak:   maxUint(a.MemoryPeak, b.MemoryPeak),
+		IOReadBytes:  maxUint(a.IOReadBytes, b.IOReadBytes),
+		IOWriteBytes: maxUint(a.IOWriteBytes, b.IOWriteBytes),
+	}
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func maxUint(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// TestCgroupUsage verifies that the resource usage is correctly parsed from
+// the cgroup's files.
+func TestCgroupUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup-*")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"cpu.stat":       "usage_usec 3000\nuser_usec 2000\nsystem_usec 1000\n",
+		"memory.current": "4096\n",
+		"memory.peak":    "8192\n",
+		"io.stat":        "8:0 rbytes=100 wbytes=200 rios=1 wios=2\n8:16 rbytes=1 wbytes=2 rios=1 wios=1\n",
+		"cgroup.procs":   "10\n11\n12\n",
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		require.Nil(t, err)
+	}
+
+	c := &cgroup{path: dir}
+	require.Equal(t, lib.ResourceUsage{
+		UserTime:      2 * time.Millisecond,
+		SystemTime:    time.Millisecond,
+		MemoryCurrent: 4096,
+		MemoryPeak:    8192,
+		IOReadBytes:   101,
+		IOWriteBytes:  202,
+		PIDs:          3,
+	}, c.usage())
+
+	pids, err := c.processes()
+	require.Nil(t, err)
+	require.Equal(t, []int{10, 11, 12}, pids)
+}
+
+// TestMergeUsage verifies that the larger of the cgroup and kernel reported
+// values are used for the final usage of a job.
+func TestMergeUsage(t *testing.T) {
+	cgroupUsage := lib.ResourceUsage{
+		UserTime:      time.Second,
+		MemoryCurrent: 10,
+		MemoryPeak:    100,
+		PIDs:          1,
+	}
+	exitUsage := lib.ResourceUsage{
+		UserTime:     time.Millisecond,
+		SystemTime:   time.Millisecond,
+		MemoryPeak:   50,
+		IOWriteBytes: 512,
+	}
+	require.Equal(t, lib.ResourceUsage{
+		UserTime:     time.Second,
+		SystemTime:   time.Millisecond,
+		MemoryPeak:   100,
+		IOWriteBytes: 512,
+	}, mergeUsage(cgroupUsage, exitUsage))
+}
+
+// TestJoinCgroup verifies that the exec child is told to join the job's
+// cgroup and that joining writes the caller's PID to cgroup.procs.
+func TestJoinCgroup(t *testing.T) {
+	dir := t.TempDir()
+	c := &cgroup{path: dir}
+	w := NewWorker(Config{})
+	defer w.Close()
+
+	data, err := w.execConfig(uuid.NewV4(), &job{cgroup: c, command: lib.Command{Command: "true"}})
+	require.Nil(t, err)
+	var config execConfig
+	require.Nil(t, json.Unmarshal(data, &config))
+	require.Equal(t, dir, config.Cgroup)
+
+	require.Nil(t, c.join())
+	procs, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	require.Nil(t, err)
+	require.Equal(t, strconv.Itoa(os.Getpid()), string(procs))
+}
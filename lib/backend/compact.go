@@ -0,0 +1,201 @@
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// segmentSize is the number of bytes of output after which a new compressed
+// segment is started. Each segment is compressed separately so that a reader
+// only needs to decompress the segment containing the chunk being read.
+const segmentSize = 256 * 1024
+
+// segment is a compressed run of consecutive chunks. Since segments always
+// start and end on a chunk boundary a chunk is never split between segments.
+type segment struct {
+	// data contains the compressed data if it is held in memory.
+	data []byte
+
+	// fileOffset and fileLength are the position and size of the
+	// compressed data in the buffer's compact file if it is held on disk.
+	fileOffset int64
+	fileLength int
+}
+
+// compact replaces the data of a closed buffer with compressed segments. The
+// chunks themselves are retained, without their data, to act as an index into
+// the segments, recording the segment containing each chunk and the chunk's
+// position within the segment's uncompressed data. If any of the output had
+// been spilled to disk the compressed segments are stored on disk as well,
+// otherwise they are held in memory.
+func (b *broadcastBuffer) compact() (err error) {
+	b.mtx.RLock()
+	if !b.closed || b.released || b.segments != nil {
+		b.mtx.RUnlock()
+		return nil
+	}
+	count := len(b.chunks)
+	toDisk := b.spillFile != nil
+	b.mtx.RUnlock()
+
+	// The buffer is closed so no more chunks will be written and the
+	// data can be compressed without holding the lock, allowing readers
+	// to continue reading in the meantime.
+	var file *os.File
+	if toDisk {
+		f, err := ioutil.TempFile(b.config.spillDir, "worker-api-output-*")
+		if err != nil {
+			return fmt.Errorf("failed to create compacted output file: %w", err)
+		}
+		_ = os.Remove(f.Name())
+		file = f
+		defer func() {
+			if err != nil {
+				_ = file.Close()
+			}
+		}()
+	}
+
+	var segments []segment
+	var fileSize int64
+	var data bytes.Buffer
+	chunkSegments := make([]int, count)
+	positions := make([]int, count)
+	flush := func() error {
+		if data.Len() == 0 {
+			return nil
+		}
+		compressed, err := compress(data.Bytes())
+		if err != nil {
+			return err
+		}
+		var s segment
+		if file != nil {
+			_, err = file.WriteAt(compressed, fileSize)
+			if err != nil {
+				return fmt.Errorf("failed to write compacted output: %w", err)
+			}
+			s.fileOffset = fileSize
+			s.fileLength = len(compressed)
+			fileSize += int64(len(compressed))
+		} else {
+			s.data = compressed
+		}
+		segments = append(segments, s)
+		data.Reset()
+		return nil
+	}
+
+	for i := 0; i < count; i++ {
+		c, err := b.chunkAt(i, nil)
+		if err != nil {
+			return err
+		}
+		chunkSegments[i] = len(segments)
+		positions[i] = data.Len()
+		data.Write(c.Data)
+		if data.Len() >= segmentSize {
+			err := flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = flush()
+	if err != nil {
+		return err
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.released {
+		if file != nil {
+			_ = file.Close()
+		}
+		return nil
+	}
+	b.segments = segments
+	b.compactFile = file
+	for i := range b.chunks {
+		b.chunks[i].data = nil
+		b.chunks[i].segment = chunkSegments[i]
+		b.chunks[i].position = positions[i]
+	}
+	b.memoryBytes = 0
+	if b.spillFile != nil {
+		_ = b.spillFile.Close()
+		b.spillFile = nil
+	}
+	return nil
+}
+
+// compress returns the gzip compressed form of the given data.
+func compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress output: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress output: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// segmentCache holds the uncompressed data of the segment most recently read
+// by a single reader so that reading consecutive chunks does not repeatedly
+// decompress the same segment.
+type segmentCache struct {
+	index int
+	data  []byte
+}
+
+// segmentData returns the uncompressed data of the segment with the given
+// index, using the given cache if it is not nil. The read lock must be held by
+// the caller.
+func (b *broadcastBuffer) segmentData(index int, cache *segmentCache) ([]byte, error) {
+	if cache != nil && cache.data != nil && cache.index == index {
+		return cache.data, nil
+	}
+
+	s := b.segments[index]
+	compressed := s.data
+	if compressed == nil {
+		compressed = make([]byte, s.fileLength)
+		_, err := b.compactFile.ReadAt(compressed, s.fileOffset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read compacted output: %w", err)
+		}
+	}
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress output: %w", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress output: %w", err)
+	}
+
+	if cache != nil {
+		cache.index = index
+		cache.data = data
+	}
+	return data, nil
+}
+
+// compactedBytes returns the number of bytes of compressed output held in
+// memory.
+func (b *broadcastBuffer) compactedBytes() int {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	size := 0
+	for _, s := range b.segments {
+		size += len(s.data)
+	}
+	return size
+}
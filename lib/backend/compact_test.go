@@ -0,0 +1,73 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// TestCompact verifies that the output of a closed buffer is compressed and
+// can still be read in the same way as before.
+func TestCompact(t *testing.T) {
+	tests := []struct {
+		name        string
+		memoryLimit int
+	}{
+		{"in memory", 0},
+		{"spilled", 1024},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBroadcastBuffer(bufferConfig{memoryLimit: test.memoryLimit})
+
+			// Write enough output for several segments, alternating
+			// between the streams.
+			var stdout, all strings.Builder
+			for i := 0; i < 20000; i++ {
+				line := fmt.Sprintf("line %d of the output\n", i)
+				stream := lib.STDOUT
+				if i%10 == 0 {
+					stream = lib.STDERR
+				} else {
+					stdout.WriteString(line)
+				}
+				all.WriteString(line)
+				_, err := b.StreamWriter(stream).Write([]byte(line))
+				require.Nil(t, err)
+			}
+			require.Nil(t, b.Close())
+
+			require.Nil(t, b.compact())
+			require.Greater(t, len(b.segments), 1)
+			require.Equal(t, 0, b.memoryBytes)
+			if test.memoryLimit == 0 {
+				require.Less(t, b.compactedBytes(), all.Len()/2)
+			} else {
+				require.NotNil(t, b.compactFile)
+				require.Equal(t, 0, b.compactedBytes())
+			}
+
+			data, err := ioutil.ReadAll(b.NewReader(context.Background(), lib.LogOptions{}))
+			require.Nil(t, err)
+			require.Equal(t, all.String(), string(data))
+
+			data, err = ioutil.ReadAll(b.NewReader(context.Background(), lib.LogOptions{Stream: lib.STDOUT}))
+			require.Nil(t, err)
+			require.Equal(t, stdout.String(), string(data))
+
+			offset := int64(segmentSize + 5)
+			data, err = ioutil.ReadAll(b.NewReader(context.Background(), lib.LogOptions{Offset: offset}))
+			require.Nil(t, err)
+			require.Equal(t, all.String()[offset:], string(data))
+
+			data, err = ioutil.ReadAll(b.NewReader(context.Background(), lib.LogOptions{Tail: 2}))
+			require.Nil(t, err)
+			require.Equal(t, "line 19998 of the output\nline 19999 of the output\n", string(data))
+		})
+	}
+}
@@ -1,27 +1,67 @@
 package backend
 
 import (
+	"encoding/json"
 	"path/filepath"
 	"os"
 	"os/exec"
+	"os/signal"
+	"runtime"
 	"strings"
 	"syscall" //TODO replace syscall usage with newer x/sys/unix versions
 
 	log "github.com/sirupsen/logrus"
+	"github.com/thompsy/worker-api-service/lib"
 )
 
-// Exec runs the given command in an isolated environment.
+// execConfig is passed, JSON encoded, from the server to the exec child
+// process and describes the command and the environment it is run in.
+type execConfig struct {
+	Command  string
+	Hostname string
+	Hosts    []lib.HostEntry
+	DNS      lib.DNSConfig
+	Limits   lib.Limits
+
+	// Cgroup is the path of the job's cgroup, which the exec child joins
+	// before running anything. If empty the job has no cgroup.
+	Cgroup string
+}
+
+// Exec runs the command described by the given JSON encoded execConfig in an
+// isolated environment.
 // TODO: limit the amount of logging here to prevent leaking implementation
 // details to clients.
-func Exec(command string) {
-	parts := strings.Split(command, " ")
+func Exec(config string) {
+	var c execConfig
+	err := json.Unmarshal([]byte(config), &c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// SIGTERM, which is sent to the job's process group when the job is
+	// preempted, reaches the command directly. It is caught here so that
+	// it does not stop this process, which as the init process of the
+	// job's PID namespace would take the command with it.
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGTERM)
+
+	// Join the job's cgroup before anything else is run so that every
+	// process of the job is accounted for and bound by its limits.
+	if c.Cgroup != "" {
+		err = (&cgroup{path: c.Cgroup}).join()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	parts := strings.Split(c.Command, " ")
 	//TODO validate that there is actually a command
 	cmd := exec.Command(parts[0], parts[1:]...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	err := syscall.Sethostname([]byte("container"))
+	err = syscall.Sethostname([]byte(c.Hostname))
 	if err != nil {
 		//TODO on error all of these calls should exit the process and output the same generic error message
 		log.Fatal(err)
@@ -60,6 +100,18 @@ func Exec(command string) {
 		log.Fatal(err)
 	}
 
+	// Write the job's hosts file and, if requested, its DNS configuration
+	err = os.WriteFile(filepath.Join(tmpDir, "etc", "hosts"), hostsFile(c.Hostname, c.Hosts), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !isEmptyDNS(c.DNS) {
+		err = os.WriteFile(filepath.Join(tmpDir, "etc", "resolv.conf"), resolvConf(c.DNS), 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Chroot into the newly created filesystem
 	err = syscall.Chroot(tmpDir)
 	if err != nil {
@@ -78,7 +130,16 @@ func Exec(command string) {
 		log.Fatal(err)
 	}
 
-	// Now that we've setup our container we can run the actual client submitted command
+	// Apply the job's limits. Some of these are per-thread attributes which
+	// are inherited by the command so the thread must remain locked until
+	// the command has been started.
+	runtime.LockOSThread()
+	err = applyLimits(c.Limits)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Now that we've setup our container we can run the actual client submitted command.
 	err = cmd.Run()
 	if err != nil {
 		log.Fatal(err)
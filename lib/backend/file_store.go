@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+const (
+	// recordFile and outputFile are the names of the files containing a
+	// job's record and output log within the job's directory.
+	recordFile = "job.json"
+	outputFile = "output"
+)
+
+// FileStore is a Store which persists jobs beneath a local directory. Each job
+// has its own directory, named by its ID, containing its record and output
+// log.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a FileStore which persists jobs beneath dir.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+// jobDir returns the directory of the job identified by jobID.
+func (s *FileStore) jobDir(jobID uuid.UUID) string {
+	return filepath.Join(s.dir, jobID.String())
+}
+
+// SaveJob writes the given record, replacing any previous record of the job.
+func (s *FileStore) SaveJob(r JobRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode job record: %w", err)
+	}
+	err = os.MkdirAll(s.jobDir(r.ID), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create job directory: %w", err)
+	}
+	err = writeFileAtomic(filepath.Join(s.jobDir(r.ID), recordFile), data)
+	if err != nil {
+		return fmt.Errorf("failed to write job record: %w", err)
+	}
+	return nil
+}
+
+// LoadJobs returns the records of every persisted job. Jobs whose record
+// cannot be read are skipped.
+func (s *FileStore) LoadJobs() ([]JobRecord, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	var records []JobRecord
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, e.Name(), recordFile))
+		if err != nil {
+			log.WithError(err).WithField("dir", e.Name()).Warn("failed to read job record")
+			continue
+		}
+		var r JobRecord
+		err = json.Unmarshal(data, &r)
+		if err != nil {
+			log.WithError(err).WithField("dir", e.Name()).Warn("failed to decode job record")
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// DeleteJob removes the record of the job identified by jobID, and its
+// directory once empty.
+func (s *FileStore) DeleteJob(jobID uuid.UUID) error {
+	return s.remove(jobID, recordFile)
+}
+
+// OpenLog opens the output log of the job identified by jobID for appending.
+func (s *FileStore) OpenLog(jobID uuid.UUID) (OutputLog, error) {
+	err := os.MkdirAll(s.jobDir(jobID), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job directory: %w", err)
+	}
+	return openOutputLog(filepath.Join(s.jobDir(jobID), outputFile))
+}
+
+// ReadLog reads the output log of the job identified by jobID. A job without
+// an output log has no output.
+func (s *FileStore) ReadLog(jobID uuid.UUID, chunk func(lib.OutputChunk), size func(int64)) error {
+	err := readOutputLog(filepath.Join(s.jobDir(jobID), outputFile), chunk, size)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// DeleteLog removes the output log of the job identified by jobID, and its
+// directory once empty.
+func (s *FileStore) DeleteLog(jobID uuid.UUID) error {
+	return s.remove(jobID, outputFile)
+}
+
+// remove removes the named file from the directory of the job identified by
+// jobID and then the directory itself if it is empty.
+func (s *FileStore) remove(jobID uuid.UUID, name string) error {
+	err := os.Remove(filepath.Join(s.jobDir(jobID), name))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", name, err)
+	}
+	// The directory may still contain other files of the job.
+	_ = os.Remove(s.jobDir(jobID))
+	return nil
+}
+
+// writeFileAtomic writes the given data to a temporary file which is then
+// renamed to the given path so that the file is never seen partially written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// maxHostnameLength is the maximum length of a hostname accepted by
+// sethostname(2).
+const maxHostnameLength = 64
+
+// hostnameLabel matches a single RFC 1123 hostname label.
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// validateHostname returns an error if the given name is not a valid hostname.
+func validateHostname(name string) error {
+	if len(name) == 0 || len(name) > maxHostnameLength {
+		return fmt.Errorf("invalid hostname length: %q", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !hostnameLabel.MatchString(label) {
+			return fmt.Errorf("invalid hostname: %q", name)
+		}
+	}
+	return nil
+}
+
+// validateResolvValue returns an error if the given value cannot be safely
+// written as a single token in resolv.conf.
+func validateResolvValue(value string) error {
+	if len(value) == 0 || strings.ContainsAny(value, " \t\r\n#;") {
+		return fmt.Errorf("invalid resolv.conf value: %q", value)
+	}
+	return nil
+}
+
+// validateNetworkConfig checks the hostname, hosts entries and DNS
+// configuration of the given command before they are written into the
+// job's filesystem.
+func validateNetworkConfig(c lib.Command) error {
+	if c.Hostname != "" {
+		if err := validateHostname(c.Hostname); err != nil {
+			return err
+		}
+	}
+
+	for _, h := range c.Hosts {
+		if net.ParseIP(h.IP) == nil {
+			return fmt.Errorf("invalid hosts entry IP address: %q", h.IP)
+		}
+		if len(h.Hostnames) == 0 {
+			return fmt.Errorf("no hostnames supplied for hosts entry: %s", h.IP)
+		}
+		for _, name := range h.Hostnames {
+			if err := validateHostname(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ns := range c.DNS.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid nameserver IP address: %q", ns)
+		}
+	}
+	for _, s := range c.DNS.Search {
+		if err := validateHostname(s); err != nil {
+			return err
+		}
+	}
+	for _, o := range c.DNS.Options {
+		if err := validateResolvValue(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostsFile returns the contents of /etc/hosts for a job with the given
+// hostname and additional entries.
+func hostsFile(hostname string, entries []lib.HostEntry) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "127.0.0.1\tlocalhost\n")
+	fmt.Fprintf(&b, "::1\tlocalhost ip6-localhost ip6-loopback\n")
+	fmt.Fprintf(&b, "127.0.1.1\t%s\n", hostname)
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%s\t%s\n", e.IP, strings.Join(e.Hostnames, " "))
+	}
+	return b.Bytes()
+}
+
+// resolvConf returns the contents of /etc/resolv.conf for the given DNS
+// configuration.
+func resolvConf(dns lib.DNSConfig) []byte {
+	var b bytes.Buffer
+	for _, ns := range dns.Nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if len(dns.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(dns.Search, " "))
+	}
+	if len(dns.Options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(dns.Options, " "))
+	}
+	return b.Bytes()
+}
+
+// isEmptyDNS returns true if no DNS configuration has been supplied.
+func isEmptyDNS(dns lib.DNSConfig) bool {
+	return len(dns.Nameservers) == 0 && len(dns.Search) == 0 && len(dns.Options) == 0
+}
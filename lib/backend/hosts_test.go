@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// TestValidateNetworkConfig verifies that invalid hostnames, hosts entries
+// and DNS configuration are rejected before being written to the job's
+// filesystem.
+func TestValidateNetworkConfig(t *testing.T) {
+	tests := []struct {
+		desc      string
+		cmd       lib.Command
+		assertErr require.ErrorAssertionFunc
+	}{
+		{
+			desc:      "default configuration",
+			cmd:       lib.Command{Command: "ls"},
+			assertErr: require.NoError,
+		},
+		{
+			desc: "full configuration",
+			cmd: lib.Command{
+				Command:  "ls",
+				Hostname: "worker-1.example.com",
+				Hosts:    []lib.HostEntry{{IP: "10.0.0.2", Hostnames: []string{"db", "db.example.com"}}},
+				DNS: lib.DNSConfig{
+					Nameservers: []string{"10.0.0.1", "::1"},
+					Search:      []string{"example.com"},
+					Options:     []string{"ndots:2"},
+				},
+			},
+			assertErr: require.NoError,
+		},
+		{
+			desc:      "invalid hostname",
+			cmd:       lib.Command{Command: "ls", Hostname: "bad_host"},
+			assertErr: require.Error,
+		},
+		{
+			desc:      "hostname with newline",
+			cmd:       lib.Command{Command: "ls", Hostname: "host\n10.0.0.1 evil"},
+			assertErr: require.Error,
+		},
+		{
+			desc:      "invalid hosts entry IP",
+			cmd:       lib.Command{Command: "ls", Hosts: []lib.HostEntry{{IP: "10.0.0", Hostnames: []string{"db"}}}},
+			assertErr: require.Error,
+		},
+		{
+			desc:      "hosts entry without hostnames",
+			cmd:       lib.Command{Command: "ls", Hosts: []lib.HostEntry{{IP: "10.0.0.2"}}},
+			assertErr: require.Error,
+		},
+		{
+			desc:      "invalid nameserver",
+			cmd:       lib.Command{Command: "ls", DNS: lib.DNSConfig{Nameservers: []string{"dns.example.com"}}},
+			assertErr: require.Error,
+		},
+		{
+			desc:      "invalid resolver option",
+			cmd:       lib.Command{Command: "ls", DNS: lib.DNSConfig{Options: []string{"ndots:2\nnameserver 1.1.1.1"}}},
+			assertErr: require.Error,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tt.assertErr(t, validateNetworkConfig(tt.cmd))
+		})
+	}
+}
+
+// TestHostsFile verifies the generated /etc/hosts and /etc/resolv.conf.
+func TestHostsFile(t *testing.T) {
+	hosts := hostsFile("job-1", []lib.HostEntry{{IP: "10.0.0.2", Hostnames: []string{"db", "db.local"}}})
+	require.Equal(t, "127.0.0.1\tlocalhost\n"+
+		"::1\tlocalhost ip6-localhost ip6-loopback\n"+
+		"127.0.1.1\tjob-1\n"+
+		"10.0.0.2\tdb db.local\n", string(hosts))
+
+	resolv := resolvConf(lib.DNSConfig{
+		Nameservers: []string{"10.0.0.1"},
+		Search:      []string{"a.example.com", "b.example.com"},
+		Options:     []string{"ndots:2"},
+	})
+	require.Equal(t, "nameserver 10.0.0.1\n"+
+		"search a.example.com b.example.com\n"+
+		"options ndots:2\n", string(resolv))
+}
@@ -0,0 +1,191 @@
+package backend
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+
+	"github.com/thompsy/worker-api-service/lib"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	minNice = -20
+	maxNice = 19
+
+	// maxIOPriority is the lowest priority within the realtime and
+	// best-effort I/O scheduling classes.
+	maxIOPriority = 7
+
+	// ioprioWhoProcess and ioprioClassShift are used to construct the
+	// arguments to ioprio_set(2).
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// LimitPolicy constrains the limits and scheduling settings which clients
+// may request for their jobs.
+type LimitPolicy struct {
+	// MaxNoFile, MaxCore, MaxFileSize and MaxStack are the maximum
+	// hard limits which may be requested for the respective rlimit. If a
+	// job does not request a limit the maximum is applied. Zero means
+	// that there is no maximum.
+	MaxNoFile   uint64
+	MaxCore     uint64
+	MaxFileSize uint64
+	MaxStack    uint64
+
+	// MinNice is the lowest nice value, and therefore the highest CPU
+	// priority, a job may request. The zero value prevents clients from
+	// raising the priority of their jobs above that of the server.
+	MinNice int
+
+	// AllowRealtimeIO permits jobs to use the realtime I/O scheduling
+	// class.
+	AllowRealtimeIO bool
+
+	// CPUs is the set of CPUs to which jobs may be pinned. If empty jobs
+	// may be pinned to any CPU.
+	CPUs []int
+}
+
+// applyPolicy validates the requested limits against the policy and returns
+// the limits with any server defaults filled in.
+func (p LimitPolicy) applyPolicy(l lib.Limits) (lib.Limits, error) {
+	var err error
+	if l.NoFile, err = checkRlimit("nofile", l.NoFile, p.MaxNoFile); err != nil {
+		return l, err
+	}
+	if l.Core, err = checkRlimit("core", l.Core, p.MaxCore); err != nil {
+		return l, err
+	}
+	if l.FileSize, err = checkRlimit("fsize", l.FileSize, p.MaxFileSize); err != nil {
+		return l, err
+	}
+	if l.Stack, err = checkRlimit("stack", l.Stack, p.MaxStack); err != nil {
+		return l, err
+	}
+
+	if l.Nice < minNice || l.Nice > maxNice {
+		return l, fmt.Errorf("nice value %d out of range", l.Nice)
+	}
+	if l.Nice < p.MinNice {
+		return l, fmt.Errorf("nice value %d is below the permitted minimum of %d", l.Nice, p.MinNice)
+	}
+
+	switch l.IOClass {
+	case lib.IOClassNone, lib.IOClassIdle:
+		if l.IOPriority != 0 {
+			return l, fmt.Errorf("I/O priority is not supported by the requested I/O class")
+		}
+	case lib.IOClassRealtime:
+		if !p.AllowRealtimeIO {
+			return l, fmt.Errorf("realtime I/O scheduling class is not permitted")
+		}
+		fallthrough
+	case lib.IOClassBestEffort:
+		if l.IOPriority < 0 || l.IOPriority > maxIOPriority {
+			return l, fmt.Errorf("I/O priority %d out of range", l.IOPriority)
+		}
+	default:
+		return l, fmt.Errorf("unknown I/O class: %d", l.IOClass)
+	}
+
+	for _, cpu := range l.CPUs {
+		if cpu < 0 || cpu >= runtime.NumCPU() {
+			return l, fmt.Errorf("unknown CPU: %d", cpu)
+		}
+		if len(p.CPUs) > 0 && !containsInt(p.CPUs, cpu) {
+			return l, fmt.Errorf("CPU %d is not permitted", cpu)
+		}
+	}
+	if len(l.CPUs) == 0 {
+		l.CPUs = p.CPUs
+	}
+	if l.CPU < 0 {
+		return l, fmt.Errorf("CPU limit %d out of range", l.CPU)
+	}
+	if l.Memory < 0 {
+		return l, fmt.Errorf("memory limit %d out of range", l.Memory)
+	}
+	return l, nil
+}
+
+// checkRlimit validates a single requested rlimit against the given maximum.
+func checkRlimit(name string, r *lib.Rlimit, max uint64) (*lib.Rlimit, error) {
+	if r == nil {
+		if max == 0 {
+			return nil, nil
+		}
+		return &lib.Rlimit{Soft: max, Hard: max}, nil
+	}
+	if r.Soft > r.Hard {
+		return nil, fmt.Errorf("%s soft limit %d exceeds hard limit %d", name, r.Soft, r.Hard)
+	}
+	if max != 0 && r.Hard > max {
+		return nil, fmt.Errorf("%s limit %d exceeds the permitted maximum of %d", name, r.Hard, max)
+	}
+	return r, nil
+}
+
+// containsInt returns true if the slice contains the given value.
+func containsInt(s []int, v int) bool {
+	for _, i := range s {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+// applyLimits applies the given limits to the calling thread so that they
+// are inherited by any processes it subsequently starts. The nice value, I/O
+// priority and CPU affinity are per-thread attributes so callers must hold
+// runtime.LockOSThread() until the command has been started.
+func applyLimits(l lib.Limits) error {
+	rlimits := []struct {
+		resource int
+		limit    *lib.Rlimit
+	}{
+		{syscall.RLIMIT_NOFILE, l.NoFile},
+		{syscall.RLIMIT_CORE, l.Core},
+		{syscall.RLIMIT_FSIZE, l.FileSize},
+		{syscall.RLIMIT_STACK, l.Stack},
+	}
+	for _, r := range rlimits {
+		if r.limit == nil {
+			continue
+		}
+		err := syscall.Setrlimit(r.resource, &syscall.Rlimit{Cur: r.limit.Soft, Max: r.limit.Hard})
+		if err != nil {
+			return fmt.Errorf("failed to set rlimit %d: %w", r.resource, err)
+		}
+	}
+
+	if l.Nice != 0 {
+		err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, l.Nice)
+		if err != nil {
+			return fmt.Errorf("failed to set nice value: %w", err)
+		}
+	}
+
+	if l.IOClass != lib.IOClassNone {
+		prio := int(l.IOClass)<<ioprioClassShift | l.IOPriority
+		_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio))
+		if errno != 0 {
+			return fmt.Errorf("failed to set I/O priority: %w", errno)
+		}
+	}
+
+	if len(l.CPUs) > 0 {
+		var set unix.CPUSet
+		for _, cpu := range l.CPUs {
+			set.Set(cpu)
+		}
+		err := unix.SchedSetaffinity(0, &set)
+		if err != nil {
+			return fmt.Errorf("failed to set CPU affinity: %w", err)
+		}
+	}
+	return nil
+}
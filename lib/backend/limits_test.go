@@ -0,0 +1,120 @@
+package backend
+
+import (
+	"encoding/json"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// TestApplyPolicy verifies that requested limits are checked against the
+// server policy and that defaults are filled in.
+func TestApplyPolicy(t *testing.T) {
+	policy := LimitPolicy{
+		MaxCore:  1024,
+		MaxStack: 8 << 20,
+		MinNice:  0,
+	}
+
+	tests := []struct {
+		desc      string
+		limits    lib.Limits
+		expected  lib.Limits
+		assertErr require.ErrorAssertionFunc
+	}{
+		{
+			desc:   "defaults are applied",
+			limits: lib.Limits{},
+			expected: lib.Limits{
+				Core:  &lib.Rlimit{Soft: 1024, Hard: 1024},
+				Stack: &lib.Rlimit{Soft: 8 << 20, Hard: 8 << 20},
+			},
+			assertErr: require.NoError,
+		},
+		{
+			desc: "requested limits within policy",
+			limits: lib.Limits{
+				NoFile:     &lib.Rlimit{Soft: 256, Hard: 512},
+				Core:       &lib.Rlimit{Soft: 0, Hard: 0},
+				Nice:       19,
+				IOClass:    lib.IOClassBestEffort,
+				IOPriority: 7,
+				CPUs:       []int{0},
+			},
+			expected: lib.Limits{
+				NoFile:     &lib.Rlimit{Soft: 256, Hard: 512},
+				Core:       &lib.Rlimit{Soft: 0, Hard: 0},
+				Stack:      &lib.Rlimit{Soft: 8 << 20, Hard: 8 << 20},
+				Nice:       19,
+				IOClass:    lib.IOClassBestEffort,
+				IOPriority: 7,
+				CPUs:       []int{0},
+			},
+			assertErr: require.NoError,
+		},
+		{
+			desc:      "core limit above maximum",
+			limits:    lib.Limits{Core: &lib.Rlimit{Soft: 1024, Hard: 2048}},
+			assertErr: require.Error,
+		},
+		{
+			desc:      "soft limit above hard limit",
+			limits:    lib.Limits{NoFile: &lib.Rlimit{Soft: 512, Hard: 256}},
+			assertErr: require.Error,
+		},
+		{
+			desc:      "nice value below minimum",
+			limits:    lib.Limits{Nice: -5},
+			assertErr: require.Error,
+		},
+		{
+			desc:      "realtime I/O not permitted",
+			limits:    lib.Limits{IOClass: lib.IOClassRealtime},
+			assertErr: require.Error,
+		},
+		{
+			desc:      "I/O priority with idle class",
+			limits:    lib.Limits{IOClass: lib.IOClassIdle, IOPriority: 3},
+			assertErr: require.Error,
+		},
+		{
+			desc:      "unknown CPU",
+			limits:    lib.Limits{CPUs: []int{-1}},
+			assertErr: require.Error,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			limits, err := policy.applyPolicy(tt.limits)
+			tt.assertErr(t, err)
+			if err == nil {
+				require.Equal(t, tt.expected, limits)
+			}
+		})
+	}
+}
+
+// TestSubmitLimitPolicy verifies that the policy is applied to a job's limits
+// once, when it is submitted, so that the limits recorded for the job are
+// those with which it is run.
+func TestSubmitLimitPolicy(t *testing.T) {
+	w := NewWorker(Config{MaxRunningJobs: 1, Limits: LimitPolicy{MaxNoFile: 64}})
+	defer w.Close()
+
+	// The only place is taken so that the job is queued rather than run.
+	w.scheduler.hold(uuid.NewV4(), request{})
+	jobID, err := w.Submit(lib.Command{Command: "true"})
+	require.Nil(t, err)
+	j, err := w.getJob(jobID)
+	require.Nil(t, err)
+	require.Equal(t, &lib.Rlimit{Soft: 64, Hard: 64}, j.command.Limits.NoFile)
+
+	data, err := w.execConfig(jobID, j)
+	require.Nil(t, err)
+	var c execConfig
+	require.Nil(t, json.Unmarshal(data, &c))
+	require.Equal(t, j.command.Limits, c.Limits)
+}
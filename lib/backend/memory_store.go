@@ -0,0 +1,170 @@
+package backend
+
+import (
+	"sync"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// MemoryStore is a Store which keeps jobs in memory. Jobs survive the Worker
+// being replaced within the same process, but not a restart of the server.
+type MemoryStore struct {
+	mtx  sync.Mutex
+	jobs map[uuid.UUID]JobRecord
+	logs map[uuid.UUID]*memoryLog
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		jobs: make(map[uuid.UUID]JobRecord),
+		logs: make(map[uuid.UUID]*memoryLog),
+	}
+}
+
+// SaveJob saves the given record, replacing any previous record of the job.
+func (s *MemoryStore) SaveJob(r JobRecord) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.jobs[r.ID] = r
+	return nil
+}
+
+// LoadJobs returns the records of every saved job.
+func (s *MemoryStore) LoadJobs() ([]JobRecord, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	records := make([]JobRecord, 0, len(s.jobs))
+	for _, r := range s.jobs {
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// DeleteJob deletes the record of the job identified by jobID.
+func (s *MemoryStore) DeleteJob(jobID uuid.UUID) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.jobs, jobID)
+	return nil
+}
+
+// OpenLog returns the log of the job identified by jobID, creating it if
+// necessary.
+func (s *MemoryStore) OpenLog(jobID uuid.UUID) (OutputLog, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	l, ok := s.logs[jobID]
+	if !ok {
+		l = &memoryLog{store: s}
+		s.logs[jobID] = l
+	}
+	return l, nil
+}
+
+// ReadLog calls the given functions with each record in the log of the job
+// identified by jobID.
+func (s *MemoryStore) ReadLog(jobID uuid.UUID, chunk func(lib.OutputChunk), size func(int64)) error {
+	s.mtx.Lock()
+	var records []memoryRecord
+	if l, ok := s.logs[jobID]; ok {
+		records = l.records
+	}
+	s.mtx.Unlock()
+
+	// Records are never modified once appended so they can be read
+	// without holding the lock.
+	for _, r := range records {
+		switch r.kind {
+		case logChunk:
+			chunk(r.chunk)
+		case logSize:
+			size(r.chunk.Offset)
+		}
+	}
+	return nil
+}
+
+// DeleteLog deletes the log of the job identified by jobID.
+func (s *MemoryStore) DeleteLog(jobID uuid.UUID) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.logs, jobID)
+	return nil
+}
+
+// memoryLog is the log of a single job's output held by a MemoryStore. It is
+// guarded by the store's lock.
+type memoryLog struct {
+	store   *MemoryStore
+	records []memoryRecord
+
+	// size is the number of bytes of output in the log and base its size
+	// when it was last rewritten.
+	size int64
+	base int64
+}
+
+// memoryRecord is a single record in a memoryLog.
+type memoryRecord struct {
+	kind  byte
+	chunk lib.OutputChunk
+}
+
+// AppendChunk appends a record of the given chunk to the log.
+func (l *memoryLog) AppendChunk(c lib.OutputChunk) error {
+	l.store.mtx.Lock()
+	defer l.store.mtx.Unlock()
+	l.append(logChunk, c)
+	return nil
+}
+
+// AppendSize appends a record of the total size of the output to the log.
+func (l *memoryLog) AppendSize(size int64) error {
+	l.store.mtx.Lock()
+	defer l.store.mtx.Unlock()
+	l.append(logSize, lib.OutputChunk{Offset: size})
+	return nil
+}
+
+// append adds a record to the log. The store's lock must be held by the
+// caller.
+func (l *memoryLog) append(kind byte, c lib.OutputChunk) {
+	c.Data = append([]byte(nil), c.Data...)
+	l.records = append(l.records, memoryRecord{kind: kind, chunk: c})
+	l.size += int64(len(c.Data))
+}
+
+// Full returns true if the log should be rewritten.
+func (l *memoryLog) Full(outputLimit int64) bool {
+	l.store.mtx.Lock()
+	defer l.store.mtx.Unlock()
+	return logFull(l.size, l.base, outputLimit)
+}
+
+// Rewrite replaces the contents of the log with the given chunks followed by
+// the total size of the output.
+func (l *memoryLog) Rewrite(chunks func(fn func(lib.OutputChunk) error) error, size int64) error {
+	rewritten := &memoryLog{}
+	err := chunks(func(c lib.OutputChunk) error {
+		rewritten.append(logChunk, c)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	rewritten.append(logSize, lib.OutputChunk{Offset: size})
+
+	l.store.mtx.Lock()
+	defer l.store.mtx.Unlock()
+	l.records = rewritten.records
+	l.size = rewritten.size
+	l.base = rewritten.size
+	return nil
+}
+
+// Close does nothing since the log is held in memory.
+func (l *memoryLog) Close() error {
+	return nil
+}
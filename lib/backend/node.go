@@ -0,0 +1,106 @@
+package backend
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// NodeInfo returns the capacity of the host, the resources reserved by the
+// limits of its jobs and its current usage.
+func (w *Worker) NodeInfo() lib.NodeInfo {
+	info := lib.NodeInfo{
+		CPU:              w.hostCPU,
+		Memory:           w.hostMemory,
+		CPUOvercommit:    w.config.CPUOvercommit,
+		MemoryOvercommit: w.config.MemoryOvercommit,
+	}
+	info.ReservedCPU, info.ReservedMemory, info.RunningJobs, info.QueuedJobs = w.scheduler.load()
+
+	total, available, err := readMeminfo("/proc/meminfo")
+	if err != nil {
+		log.WithError(err).Warn("failed to read memory usage")
+	} else {
+		info.MemoryUsed = total - available
+	}
+	info.LoadAverage, err = readLoadAverage("/proc/loadavg")
+	if err != nil {
+		log.WithError(err).Warn("failed to read load average")
+	}
+	return info
+}
+
+// hostCapacity returns the number of CPUs of the host, in thousandths of a
+// CPU, and its total memory in bytes. The memory is zero if it cannot be
+// read.
+func hostCapacity() (cpu, memory int64) {
+	cpu = int64(runtime.NumCPU()) * 1000
+	memory, _, err := readMeminfo("/proc/meminfo")
+	if err != nil {
+		log.WithError(err).Warn("failed to read the host's memory, jobs are admitted regardless of their memory limits")
+	}
+	return cpu, memory
+}
+
+// readMeminfo returns the total and available memory, in bytes, from the given
+// file in the format of /proc/meminfo.
+func readMeminfo(path string) (total, available int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	found := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Lines are of the form "MemTotal:       16318712 kB".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[2] != "kB" {
+			continue
+		}
+		var value *int64
+		switch fields[0] {
+		case "MemTotal:":
+			value = &total
+		case "MemAvailable:":
+			value = &available
+		default:
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s %q", fields[0], fields[1])
+		}
+		*value = kb * 1024
+		found++
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	if found != 2 {
+		return 0, 0, fmt.Errorf("MemTotal or MemAvailable missing from %s", path)
+	}
+	return total, available, nil
+}
+
+// readLoadAverage returns the one minute load average from the given file in
+// the format of /proc/loadavg.
+func readLoadAverage(path string) (float64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty %s", path)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
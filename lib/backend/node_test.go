@@ -0,0 +1,35 @@
+package backend
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestReadHostUsage verifies that the memory and load average of the host are
+// read from files in the format of /proc/meminfo and /proc/loadavg.
+func TestReadHostUsage(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "meminfo")
+	err := ioutil.WriteFile(path, []byte("MemTotal:       16318712 kB\nMemFree:         1034512 kB\nMemAvailable:    8159356 kB\nHugePages_Total:       0\n"), 0600)
+	require.Nil(t, err)
+
+	total, available, err := readMeminfo(path)
+	require.Nil(t, err)
+	require.Equal(t, int64(16318712*1024), total)
+	require.Equal(t, int64(8159356*1024), available)
+
+	err = ioutil.WriteFile(path, []byte("MemTotal:       16318712 kB\n"), 0600)
+	require.Nil(t, err)
+	_, _, err = readMeminfo(path)
+	require.NotNil(t, err)
+
+	path = filepath.Join(dir, "loadavg")
+	err = ioutil.WriteFile(path, []byte("0.52 0.58 0.59 2/1041 12345\n"), 0600)
+	require.Nil(t, err)
+	load, err := readLoadAverage(path)
+	require.Nil(t, err)
+	require.Equal(t, 0.52, load)
+}
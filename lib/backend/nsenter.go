@@ -0,0 +1,228 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/thompsy/worker-api-service/lib"
+	"golang.org/x/sys/unix"
+)
+
+// enterNamespaces are the namespaces of a job which an exec'd process joins,
+// in the order in which they are joined. The mount namespace is joined last
+// since the others are opened through the host's /proc.
+var enterNamespaces = []string{"uts", "net", "pid", "mnt"}
+
+// enterConfig is passed, JSON encoded, from the server to the enter child
+// process and describes the command to run and the job it is run in.
+type enterConfig struct {
+	// PID is the host PID of the job's process whose namespaces and root
+	// directory are joined.
+	PID int
+
+	// Cgroup is the path of the job's cgroup. If empty the process is
+	// not placed in a cgroup.
+	Cgroup string
+
+	Argv   []string
+	Limits lib.Limits
+}
+
+// Exec runs argv inside the PID, mount, UTS and network namespaces, and the
+// cgroup, of the running job identified by jobID. It returns an OutputReader
+// attached to the stdout and stderr of the new process, as separate streams,
+// along with a function which blocks until the process has exited and
+// returns its exit code. The process is killed if the context is cancelled
+// before it exits.
+func (w *Worker) Exec(ctx context.Context, jobID uuid.UUID, argv []string) (OutputReader, func() int, error) {
+	if len(argv) == 0 {
+		return nil, nil, fmt.Errorf("no command supplied")
+	}
+
+	job, err := w.getJob(jobID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	job.statusMtx.RLock()
+	running := job.status.Status == lib.RUNNING
+	job.statusMtx.RUnlock()
+	if !running {
+		return nil, nil, fmt.Errorf("job is not running")
+	}
+
+	config, err := w.enterConfig(job, argv)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.Command("/proc/self/exe", "enter", string(config))
+	buffer := newBroadcastBuffer(w.bufferConfig())
+	cmd.Stdout = buffer.StreamWriter(lib.STDOUT)
+	cmd.Stderr = buffer.StreamWriter(lib.STDERR)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGTERM,
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		log.WithError(err).WithField("jobID", jobID).Errorf("failed to exec: %s", argv)
+		return nil, nil, err
+	}
+	log.WithField("jobID", jobID).Infof("exec command: %s", argv)
+
+	done := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(done)
+		buffer.Close()
+	}()
+
+	// Stop the process if the caller goes away. The enter child kills the
+	// command, which it forks in order to place it in the job's PID
+	// namespace, on receiving SIGTERM.
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		case <-done:
+		}
+	}()
+
+	wait := func() int {
+		<-done
+		return cmd.ProcessState.ExitCode()
+	}
+	return buffer.NewReader(ctx, lib.LogOptions{}), wait, nil
+}
+
+// enterConfig returns the JSON encoded enterConfig with which argv is run
+// inside the given job, under the job's limits.
+func (w *Worker) enterConfig(j *job, argv []string) ([]byte, error) {
+	c := enterConfig{
+		PID:    j.pid,
+		Argv:   argv,
+		Limits: j.command.Limits,
+	}
+	if cg := j.getCgroup(); cg != nil {
+		c.Cgroup = cg.path
+	}
+	return json.Marshal(c)
+}
+
+// Enter runs the command described by the given JSON encoded enterConfig
+// inside the namespaces, root directory and cgroup of a running job and
+// returns its exit code.
+//
+// Since the threads of a Go process share their filesystem attributes a mount
+// namespace cannot normally be joined with setns(2). The thread which starts
+// the command is therefore locked and given its own filesystem attributes
+// before joining the job's namespaces so that the command inherits them. The
+// PID namespace only applies to children, so the command is forked rather than
+// exec'd in place of this process.
+func Enter(config string) int {
+	var c enterConfig
+	err := json.Unmarshal([]byte(config), &c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(c.Argv) == 0 {
+		log.Fatal("no command supplied")
+	}
+
+	// The process joins the job's cgroup before it starts the command so
+	// that the command is bound by the job's limits from the outset.
+	if c.Cgroup != "" {
+		err = (&cgroup{path: c.Cgroup}).join()
+		if err != nil {
+			log.Fatalf("failed to join cgroup: %s", err)
+		}
+	}
+
+	// The thread is never unlocked so that it exits along with the
+	// process rather than being reused with the job's namespaces.
+	runtime.LockOSThread()
+	err = unix.Unshare(unix.CLONE_FS)
+	if err != nil {
+		log.Fatalf("failed to unshare filesystem attributes: %s", err)
+	}
+
+	// Every file is opened before any namespace is joined since the job's
+	// /proc does not contain the host's PIDs.
+	root, err := os.Open(fmt.Sprintf("/proc/%d/root", c.PID))
+	if err != nil {
+		log.Fatal(err)
+	}
+	namespaces := make([]*os.File, len(enterNamespaces))
+	for i, ns := range enterNamespaces {
+		namespaces[i], err = os.Open(fmt.Sprintf("/proc/%d/ns/%s", c.PID, ns))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	for i, ns := range enterNamespaces {
+		err = unix.Setns(int(namespaces[i].Fd()), 0)
+		if err != nil {
+			log.Fatalf("failed to join %s namespace: %s", ns, err)
+		}
+		_ = namespaces[i].Close()
+	}
+
+	// Joining the mount namespace sets the root directory to that of the
+	// namespace, whereas the job runs chrooted beneath it.
+	err = unix.Fchdir(int(root.Fd()))
+	if err == nil {
+		err = unix.Chroot(".")
+	}
+	if err == nil {
+		err = unix.Chdir("/")
+	}
+	if err != nil {
+		log.Fatalf("failed to change root directory: %s", err)
+	}
+	_ = root.Close()
+
+	err = applyLimits(c.Limits)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The job's root directory need not contain /dev/null so stdin is
+	// inherited rather than opened.
+	cmd := exec.Command(c.Argv[0], c.Argv[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// The command cannot be given a parent death signal since, as its
+	// parent is outside the job's PID namespace, Go would deliver it
+	// immediately. It is instead killed when this process receives
+	// SIGTERM, which the server sends, or arranges to be sent if it
+	// exits, when the caller goes away.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	err = cmd.Start()
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to run command: %s\n", err)
+		return 127
+	}
+	go func() {
+		<-signals
+		_ = cmd.Process.Kill()
+	}()
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to run command: %s\n", err)
+		return 127
+	}
+	return cmd.ProcessState.ExitCode()
+}
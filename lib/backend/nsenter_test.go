@@ -0,0 +1,67 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// TestEnterConfig verifies that a command is run in the namespaces and cgroup
+// of the job with the job's limits.
+func TestEnterConfig(t *testing.T) {
+	w := NewWorker(Config{})
+	defer w.Close()
+	j := &job{
+		pid:     42,
+		cgroup:  &cgroup{path: "/sys/fs/cgroup/worker-api/job"},
+		command: lib.Command{Limits: lib.Limits{Nice: 5, Core: &lib.Rlimit{Soft: 1 << 20, Hard: 1 << 20}}},
+	}
+
+	data, err := w.enterConfig(j, []string{"ps", "aux"})
+	require.Nil(t, err)
+	var c enterConfig
+	require.Nil(t, json.Unmarshal(data, &c))
+	require.Equal(t, enterConfig{
+		PID:    42,
+		Cgroup: "/sys/fs/cgroup/worker-api/job",
+		Argv:   []string{"ps", "aux"},
+		Limits: lib.Limits{Nice: 5, Core: &lib.Rlimit{Soft: 1 << 20, Hard: 1 << 20}},
+	}, c)
+}
+
+// TestEnter verifies that a command run inside the namespaces of a process,
+// those of the test itself, writes to its own stdout and stderr and that its
+// exit code is returned.
+func TestEnter(t *testing.T) {
+	skipCI(t)
+	config, err := json.Marshal(enterConfig{
+		PID:  os.Getpid(),
+		Argv: []string{"/bin/sh", "-c", "echo out; echo err >&2; exit 3"},
+	})
+	require.Nil(t, err)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestEnterHelperProcess$")
+	cmd.Env = append(os.Environ(), "WORKER_ENTER_CONFIG="+string(config))
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	_ = cmd.Run()
+	require.Equal(t, 3, cmd.ProcessState.ExitCode())
+	require.Equal(t, "out\n", stdout.String())
+	require.Equal(t, "err\n", stderr.String())
+}
+
+// TestEnterHelperProcess is run by TestEnter in a child process in place of
+// the enter child of the server.
+func TestEnterHelperProcess(t *testing.T) {
+	config := os.Getenv("WORKER_ENTER_CONFIG")
+	if config == "" {
+		return
+	}
+	os.Exit(Enter(config))
+}
@@ -0,0 +1,192 @@
+package backend
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// Each record of an output log starts with a fixed size header containing the
+// kind of record, the stream, sequence number, time in nanoseconds since the
+// Unix epoch, offset and length of a chunk, followed by the chunk's data.
+const logHeaderSize = 1 + 1 + 8 + 8 + 8 + 4
+
+const (
+	// logChunk records a chunk of output.
+	logChunk byte = iota
+
+	// logSize records the total size of the output, including any
+	// which was dropped, in the offset field.
+	logSize
+)
+
+// outputLog is an append-only file recording the chunks of a job's output so
+// that the output survives a restart of the server. Since the log records
+// every chunk written, it is rewritten to contain only the retained chunks
+// once it grows too large and when the output is closed.
+type outputLog struct {
+	path string
+	file *os.File
+
+	// size is the size of the file and base its size when it was last
+	// rewritten.
+	size int64
+	base int64
+}
+
+// openOutputLog opens the output log at the given path for appending,
+// creating it if necessary.
+func openOutputLog(path string) (*outputLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open output log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to open output log: %w", err)
+	}
+	return &outputLog{path: path, file: f, size: info.Size(), base: info.Size()}, nil
+}
+
+// AppendChunk appends a record of the given chunk to the log.
+func (l *outputLog) AppendChunk(c lib.OutputChunk) error {
+	return l.append(logChunk, c)
+}
+
+// AppendSize appends a record of the total size of the output to the log.
+func (l *outputLog) AppendSize(size int64) error {
+	return l.append(logSize, lib.OutputChunk{Offset: size})
+}
+
+// append writes a single record to the log.
+func (l *outputLog) append(kind byte, c lib.OutputChunk) error {
+	record := make([]byte, logHeaderSize+len(c.Data))
+	record[0] = kind
+	record[1] = byte(c.Stream)
+	binary.BigEndian.PutUint64(record[2:], c.Seq)
+	var t int64
+	if !c.Time.IsZero() {
+		t = c.Time.UnixNano()
+	}
+	binary.BigEndian.PutUint64(record[10:], uint64(t))
+	binary.BigEndian.PutUint64(record[18:], uint64(c.Offset))
+	binary.BigEndian.PutUint32(record[26:], uint32(len(c.Data)))
+	copy(record[logHeaderSize:], c.Data)
+
+	n, err := l.file.Write(record)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write output log: %w", err)
+	}
+	return nil
+}
+
+// Full returns true if the log should be rewritten.
+func (l *outputLog) Full(outputLimit int64) bool {
+	return logFull(l.size, l.base, outputLimit)
+}
+
+// Rewrite replaces the contents of the log with the given chunks followed by
+// the total size of the output.
+func (l *outputLog) Rewrite(chunks func(fn func(lib.OutputChunk) error) error, size int64) error {
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite output log: %w", err)
+	}
+	rewritten := &outputLog{path: l.path, file: f}
+	err = chunks(rewritten.AppendChunk)
+	if err == nil {
+		err = rewritten.AppendSize(size)
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	_ = l.file.Close()
+	l.file = f
+	l.size = rewritten.size
+	l.base = rewritten.size
+	return nil
+}
+
+// Close closes the log's file.
+func (l *outputLog) Close() error {
+	return l.file.Close()
+}
+
+// readRecordAt reads the record at the given position in the file, returning
+// its kind, contents and size. It returns io.EOF if there is no complete
+// record at the position, as is the case at the end of a log or part way
+// through a record which is still being written.
+func readRecordAt(f *os.File, pos int64) (byte, lib.OutputChunk, int64, error) {
+	header := make([]byte, logHeaderSize)
+	_, err := f.ReadAt(header, pos)
+	if err == io.EOF {
+		return 0, lib.OutputChunk{}, 0, io.EOF
+	}
+	if err != nil {
+		return 0, lib.OutputChunk{}, 0, fmt.Errorf("failed to read output log: %w", err)
+	}
+
+	c := lib.OutputChunk{
+		Stream: lib.OutputStream(header[1]),
+		Seq:    binary.BigEndian.Uint64(header[2:]),
+		Offset: int64(binary.BigEndian.Uint64(header[18:])),
+		Data:   make([]byte, binary.BigEndian.Uint32(header[26:])),
+	}
+	if t := int64(binary.BigEndian.Uint64(header[10:])); t != 0 {
+		c.Time = time.Unix(0, t)
+	}
+	_, err = f.ReadAt(c.Data, pos+logHeaderSize)
+	if err == io.EOF {
+		return 0, lib.OutputChunk{}, 0, io.EOF
+	}
+	if err != nil {
+		return 0, lib.OutputChunk{}, 0, fmt.Errorf("failed to read output log: %w", err)
+	}
+	if header[0] != logChunk && header[0] != logSize {
+		return 0, lib.OutputChunk{}, 0, fmt.Errorf("unknown output log record %d", header[0])
+	}
+	return header[0], c, logHeaderSize + int64(len(c.Data)), nil
+}
+
+// readOutputLog calls the given functions with each chunk and size recorded
+// in the output log at the given path. A partial record at the end of the log,
+// as left if the server exited while writing it, is ignored.
+func readOutputLog(path string, chunk func(lib.OutputChunk), size func(int64)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read output log: %w", err)
+	}
+	defer f.Close()
+
+	var pos int64
+	for {
+		kind, c, n, err := readRecordAt(f, pos)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pos += n
+
+		switch kind {
+		case logChunk:
+			chunk(c)
+		case logSize:
+			size(c.Offset)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// defaultQuota is the key of the quota which applies to clients without a
+// quota of their own or of one of their groups.
+const defaultQuota = "*"
+
+// QuotaPolicy determines the quota of each client. Quotas are keyed by the
+// CommonName of a client's certificate, the name of a group or "*". A client's
+// own quota takes precedence over that of any group it is a member of, which
+// in turn takes precedence over the default quota. Clients without a quota are
+// not limited.
+type QuotaPolicy struct {
+	// Groups contains the CommonNames of the members of each group.
+	Groups map[string][]string
+
+	// Quotas contains the quota of each client, group and the default.
+	Quotas map[string]lib.Quota
+}
+
+// LoadQuotaPolicy reads a JSON encoded QuotaPolicy from the file at the given
+// path.
+func LoadQuotaPolicy(path string) (QuotaPolicy, error) {
+	var p QuotaPolicy
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, fmt.Errorf("failed to read quota policy: %w", err)
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	err = d.Decode(&p)
+	if err != nil {
+		return p, fmt.Errorf("failed to parse quota policy: %w", err)
+	}
+	for key, q := range p.Quotas {
+		if q.MaxRunningJobs < 0 || q.MaxQueuedJobs < 0 || q.MaxCPU < 0 || q.MaxMemory < 0 || q.MaxRetainedBytes < 0 {
+			return p, fmt.Errorf("quota of %s must not be negative", key)
+		}
+	}
+	return p, nil
+}
+
+// quota returns the quota of the given client. It returns false if the client
+// is not limited.
+func (p QuotaPolicy) quota(owner string) (lib.Quota, bool) {
+	if q, ok := p.Quotas[owner]; ok {
+		return q, true
+	}
+
+	// Groups are considered in order of name so that the quota of a
+	// member of several groups does not vary.
+	groups := make([]string, 0, len(p.Groups))
+	for group := range p.Groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		q, ok := p.Quotas[group]
+		if ok && containsString(p.Groups[group], owner) {
+			return q, true
+		}
+	}
+
+	q, ok := p.Quotas[defaultQuota]
+	return q, ok
+}
+
+// Quota returns the quota of the given client and its current usage. A zero
+// quota means that the client is not limited.
+func (w *Worker) Quota(owner string) (lib.Quota, lib.QuotaUsage) {
+	q, _ := w.config.Quotas.quota(owner)
+	w.RLock()
+	defer w.RUnlock()
+	return q, w.quotaUsage(owner)
+}
+
+// checkQuota returns an error if the given command would exceed the quota of
+// the client which submitted it. A job only counts against the limit on
+// queued jobs if it would be queued. The Worker's lock must be held by the caller
+// until the job has been registered so that concurrent submissions cannot
+// together exceed the quota.
+func (w *Worker) checkQuota(c lib.Command) error {
+	q, ok := w.config.Quotas.quota(c.Owner)
+	if !ok {
+		return nil
+	}
+	// Without a limit a job's reservation could not be counted.
+	if q.MaxCPU > 0 && c.Limits.CPU == 0 {
+		return fmt.Errorf("a CPU limit is required by the quota")
+	}
+	if q.MaxMemory > 0 && c.Limits.Memory == 0 {
+		return fmt.Errorf("a memory limit is required by the quota")
+	}
+
+	u := w.quotaUsage(c.Owner)
+	switch {
+	case q.MaxRunningJobs > 0 && u.RunningJobs >= q.MaxRunningJobs:
+		return fmt.Errorf("%w: %d of %d jobs running", lib.ErrQuotaExceeded, u.RunningJobs, q.MaxRunningJobs)
+	case q.MaxQueuedJobs > 0 && u.QueuedJobs >= q.MaxQueuedJobs && w.scheduler.wouldWait(requestOf(c)):
+		return fmt.Errorf("%w: %d of %d jobs queued", lib.ErrQuotaExceeded, u.QueuedJobs, q.MaxQueuedJobs)
+	case q.MaxCPU > 0 && u.CPU+c.Limits.CPU > q.MaxCPU:
+		return fmt.Errorf("%w: %d of %d thousandths of a CPU reserved", lib.ErrQuotaExceeded, u.CPU, q.MaxCPU)
+	case q.MaxMemory > 0 && u.Memory+c.Limits.Memory > q.MaxMemory:
+		return fmt.Errorf("%w: %d of %d bytes of memory reserved", lib.ErrQuotaExceeded, u.Memory, q.MaxMemory)
+	case q.MaxRetainedBytes > 0 && u.RetainedBytes >= q.MaxRetainedBytes:
+		return fmt.Errorf("%w: %d of %d bytes of output retained", lib.ErrQuotaExceeded, u.RetainedBytes, q.MaxRetainedBytes)
+	}
+	return nil
+}
+
+// quotaUsage returns the jobs and resources of the given client counted
+// against its quota. The Worker's lock must be held by the caller.
+func (w *Worker) quotaUsage(owner string) lib.QuotaUsage {
+	var u lib.QuotaUsage
+	for _, j := range w.jobs {
+		if j.command.Owner != owner {
+			continue
+		}
+		j.statusMtx.RLock()
+		status := j.status.Status
+		j.statusMtx.RUnlock()
+
+		switch status {
+		case lib.RUNNING, lib.PAUSED:
+			u.RunningJobs++
+		case lib.QUEUED:
+			u.QueuedJobs++
+		}
+		if status == lib.RUNNING || status == lib.PAUSED || status == lib.QUEUED {
+			u.CPU += j.command.Limits.CPU
+			u.Memory += j.command.Limits.Memory
+		}
+		u.RetainedBytes += j.output.retainedBytes()
+	}
+	return u
+}
+
+// containsString returns true if the slice contains the given value.
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package backend
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// TestQuotaPolicy verifies that a client's own quota takes precedence over
+// that of its groups, which takes precedence over the default.
+func TestQuotaPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	err := ioutil.WriteFile(path, []byte(`{
+		"Groups": {"batch": ["a", "b"], "devs": ["b", "c"]},
+		"Quotas": {
+			"*": {"MaxRunningJobs": 1},
+			"a": {"MaxRunningJobs": 2},
+			"batch": {"MaxRunningJobs": 3},
+			"devs": {"MaxRunningJobs": 4}
+		}
+	}`), 0600)
+	require.Nil(t, err)
+	p, err := LoadQuotaPolicy(path)
+	require.Nil(t, err)
+
+	tests := []struct {
+		owner    string
+		expected int
+	}{
+		{"a", 2},
+		{"b", 3},
+		{"c", 4},
+		{"d", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.owner, func(t *testing.T) {
+			q, ok := p.quota(test.owner)
+			require.True(t, ok)
+			require.Equal(t, test.expected, q.MaxRunningJobs)
+		})
+	}
+
+	_, ok := QuotaPolicy{}.quota("a")
+	require.False(t, ok)
+}
+
+// TestCheckQuota verifies that jobs which would exceed the client's quota are
+// rejected.
+func TestCheckQuota(t *testing.T) {
+	w := NewWorker(Config{Quotas: QuotaPolicy{Quotas: map[string]lib.Quota{
+		"a": {MaxQueuedJobs: 1, MaxCPU: 1000, MaxMemory: 1 << 20, MaxRetainedBytes: 10},
+	}}})
+	add := func(owner string, status lib.StatusCode, cpu, memory int64, output string) {
+		j := &job{
+			status:  lib.Status{Status: status},
+			command: lib.Command{Owner: owner, Limits: lib.Limits{CPU: cpu, Memory: memory}},
+			output:  newBroadcastBuffer(bufferConfig{}),
+		}
+		_, err := j.output.write(lib.STDOUT, []byte(output), time.Now())
+		require.Nil(t, err)
+		w.jobs[uuid.NewV4()] = j
+	}
+	add("a", lib.RUNNING, 500, 1<<19, "")
+	add("a", lib.COMPLETED, 500, 1<<19, "12345")
+	add("b", lib.QUEUED, 1000, 1<<20, "1234567890")
+
+	tests := []struct {
+		name     string
+		command  lib.Command
+		exceeded bool
+		err      bool
+	}{
+		{"within quota", lib.Command{Owner: "a", Limits: lib.Limits{CPU: 500, Memory: 1 << 19}}, false, false},
+		{"CPU", lib.Command{Owner: "a", Limits: lib.Limits{CPU: 501, Memory: 1}}, true, true},
+		{"memory", lib.Command{Owner: "a", Limits: lib.Limits{CPU: 1, Memory: 1<<19 + 1}}, true, true},
+		{"no CPU limit", lib.Command{Owner: "a", Limits: lib.Limits{Memory: 1}}, false, true},
+		{"no memory limit", lib.Command{Owner: "a", Limits: lib.Limits{CPU: 1}}, false, true},
+		{"no quota", lib.Command{Owner: "b"}, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := w.checkQuota(test.command)
+			require.Equal(t, test.err, err != nil)
+			require.Equal(t, test.exceeded, errors.Is(err, lib.ErrQuotaExceeded))
+		})
+	}
+
+	// Once the client has a queued job no further jobs are accepted
+	// which would be queued, although those which can start are.
+	add("a", lib.QUEUED, 0, 0, "")
+	require.Nil(t, w.checkQuota(lib.Command{Owner: "a", Limits: lib.Limits{CPU: 1, Memory: 1}}))
+	w.scheduler.limit = 1
+	w.scheduler.hold(uuid.NewV4(), request{})
+	require.True(t, errors.Is(w.checkQuota(lib.Command{Owner: "a", Limits: lib.Limits{CPU: 1, Memory: 1}}), lib.ErrQuotaExceeded))
+
+	// Nor are any once the client is running its quota of jobs or has
+	// retained its quota of output.
+	w.config.Quotas.Quotas["a"] = lib.Quota{MaxRunningJobs: 1}
+	require.True(t, errors.Is(w.checkQuota(lib.Command{Owner: "a"}), lib.ErrQuotaExceeded))
+	w.config.Quotas.Quotas["a"] = lib.Quota{MaxRetainedBytes: 10}
+	require.Nil(t, w.checkQuota(lib.Command{Owner: "a"}))
+	add("a", lib.COMPLETED, 0, 0, "67890")
+	require.True(t, errors.Is(w.checkQuota(lib.Command{Owner: "a"}), lib.ErrQuotaExceeded))
+
+	q, u := w.Quota("a")
+	require.Equal(t, int64(10), q.MaxRetainedBytes)
+	require.Equal(t, lib.QuotaUsage{RunningJobs: 1, QueuedJobs: 1, CPU: 500, Memory: 1 << 19, RetainedBytes: 10}, u)
+}
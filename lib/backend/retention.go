@@ -0,0 +1,146 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+const (
+	// reapInterval is the interval at which the retention policy is
+	// applied.
+	reapInterval = time.Minute
+
+	// expiredRetention is the time for which a deleted job is remembered
+	// so that requests for it return lib.ErrExpired.
+	expiredRetention = 24 * time.Hour
+)
+
+// RetentionPolicy determines when finished jobs are deleted. Jobs are deleted
+// in the order in which they finished, oldest first. A zero value field means
+// no limit.
+type RetentionPolicy struct {
+	// MaxAge is the time after a job finishes at which it is deleted.
+	MaxAge time.Duration
+
+	// MaxFinishedJobs is the number of finished jobs which are retained.
+	MaxFinishedJobs int
+
+	// MaxRetainedBytes is the number of bytes of output, in memory or on
+	// disk, which are retained for finished jobs.
+	MaxRetainedBytes int64
+}
+
+// Delete deletes the finished job identified by jobID along with its output.
+// Running and queued jobs must be stopped before they can be deleted.
+func (w *Worker) Delete(jobID uuid.UUID) error {
+	job, err := w.getJob(jobID)
+	if err != nil {
+		return err
+	}
+
+	job.statusMtx.RLock()
+	status := job.status.Status
+	job.statusMtx.RUnlock()
+	if status == lib.RUNNING || status == lib.QUEUED || status == lib.PAUSED {
+		return fmt.Errorf("job %s has not finished", jobID)
+	}
+
+	w.remove(jobID, time.Now())
+	log.WithField("jobID", jobID).Info("job deleted")
+	return nil
+}
+
+// remove deletes the job identified by jobID and discards its output.
+func (w *Worker) remove(jobID uuid.UUID, now time.Time) {
+	w.Lock()
+	job, ok := w.jobs[jobID]
+	delete(w.jobs, jobID)
+	w.expired[jobID] = now
+	w.Unlock()
+	if ok {
+		job.output.release()
+	}
+	err := w.unpersist(jobID)
+	if err != nil {
+		log.WithError(err).WithField("jobID", jobID).Error("failed to remove persisted job")
+	}
+}
+
+// reaper applies the retention policy until the Worker is closed.
+func (w *Worker) reaper() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			w.reap(now)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// reap deletes the finished jobs which exceed the retention policy and
+// forgets jobs which were deleted more than expiredRetention ago.
+func (w *Worker) reap(now time.Time) {
+	type finishedJob struct {
+		id       uuid.UUID
+		finished time.Time
+		bytes    int64
+	}
+
+	w.RLock()
+	var finished []finishedJob
+	var total int64
+	for id, j := range w.jobs {
+		j.statusMtx.RLock()
+		f := j.finished
+		j.statusMtx.RUnlock()
+		if f.IsZero() {
+			continue
+		}
+		bytes := j.output.retainedBytes()
+		finished = append(finished, finishedJob{id: id, finished: f, bytes: bytes})
+		total += bytes
+	}
+	w.RUnlock()
+
+	// Since the oldest jobs are deleted first, once a job is within every
+	// limit so are all of the jobs which finished after it.
+	sort.Slice(finished, func(i, k int) bool {
+		return finished[i].finished.Before(finished[k].finished)
+	})
+	policy := w.config.Retention
+	remaining := len(finished)
+	for _, f := range finished {
+		if !(policy.MaxAge > 0 && now.Sub(f.finished) > policy.MaxAge) &&
+			!(policy.MaxFinishedJobs > 0 && remaining > policy.MaxFinishedJobs) &&
+			!(policy.MaxRetainedBytes > 0 && total > policy.MaxRetainedBytes) {
+			break
+		}
+		w.remove(f.id, now)
+		remaining--
+		total -= f.bytes
+		log.WithField("jobID", f.id).Info("job expired")
+	}
+
+	w.Lock()
+	var forgotten []uuid.UUID
+	for id, deleted := range w.expired {
+		if now.Sub(deleted) > expiredRetention {
+			delete(w.expired, id)
+			forgotten = append(forgotten, id)
+		}
+	}
+	w.Unlock()
+	if w.config.OnForget != nil {
+		for _, id := range forgotten {
+			w.config.OnForget(id)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package backend
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// addFinishedJob adds a job to the worker which finished at the given time
+// having written size bytes of output.
+func addFinishedJob(t *testing.T, w *Worker, finished time.Time, size int) uuid.UUID {
+	b := newBroadcastBuffer(bufferConfig{})
+	_, err := b.Write([]byte(strings.Repeat("a", size)))
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+
+	id := uuid.NewV4()
+	w.jobs[id] = &job{
+		status:   lib.Status{Status: lib.COMPLETED},
+		output:   b,
+		started:  finished,
+		finished: finished,
+	}
+	return id
+}
+
+// TestReap verifies that finished jobs are deleted, oldest first, once they
+// exceed the retention policy.
+func TestReap(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		policy   RetentionPolicy
+		expected int
+	}{
+		{"no policy", RetentionPolicy{}, 0},
+		{"max age", RetentionPolicy{MaxAge: 90 * time.Minute}, 3},
+		{"max finished jobs", RetentionPolicy{MaxFinishedJobs: 3}, 1},
+		{"max retained bytes", RetentionPolicy{MaxRetainedBytes: 250}, 2},
+		{"combined", RetentionPolicy{MaxAge: 150 * time.Minute, MaxFinishedJobs: 2}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := NewWorker(Config{Retention: test.policy})
+			defer w.Close()
+			var ids []uuid.UUID
+			for i := 4; i > 0; i-- {
+				ids = append(ids, addFinishedJob(t, w, now.Add(-time.Duration(i)*time.Hour), 100))
+			}
+
+			w.reap(now)
+			for i, id := range ids {
+				_, err := w.Status(id)
+				if i < test.expected {
+					require.Equal(t, lib.ErrExpired, err)
+				} else {
+					require.Nil(t, err)
+				}
+			}
+		})
+	}
+}
+
+// TestDelete verifies that a deleted job returns ErrExpired until it is
+// forgotten.
+func TestDelete(t *testing.T) {
+	var forgotten []uuid.UUID
+	w := NewWorker(Config{OnForget: func(id uuid.UUID) {
+		forgotten = append(forgotten, id)
+	}})
+	defer w.Close()
+
+	id := addFinishedJob(t, w, time.Now(), 10)
+	r, err := w.Logs(context.Background(), id, lib.LogOptions{})
+	require.Nil(t, err)
+
+	require.Nil(t, w.Delete(id))
+	_, err = w.Status(id)
+	require.Equal(t, lib.ErrExpired, err)
+	require.Equal(t, lib.ErrExpired, w.Delete(id))
+
+	// Readers which were already open can no longer read the output.
+	_, err = r.ReadChunk()
+	require.Equal(t, lib.ErrExpired, err)
+
+	w.reap(time.Now().Add(expiredRetention + time.Minute))
+	_, err = w.Status(id)
+	require.Equal(t, lib.ErrNotFound, err)
+	require.Equal(t, []uuid.UUID{id}, forgotten)
+
+	running := uuid.NewV4()
+	w.jobs[running] = &job{status: lib.Status{Status: lib.RUNNING}}
+	require.Error(t, w.Delete(running))
+}
@@ -0,0 +1,590 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// numPriorities is the number of priority classes.
+const numPriorities = 3
+
+// scheduler limits the jobs which run at once: their number, in total and for
+// each owner, and the CPU and memory reserved by their limits. Jobs submitted
+// once a limit has been reached are queued and started as running jobs finish,
+// those of higher priority classes first and otherwise in the order in which
+// they were submitted.
+type scheduler struct {
+	mtx sync.Mutex
+
+	// limit is the maximum number of running jobs. Zero means no limit.
+	limit int
+
+	// ownerLimit, if set, returns the maximum number of running jobs of
+	// the given owner. Zero means no limit.
+	ownerLimit func(owner string) int
+
+	// cpuCapacity and memoryCapacity are the CPU, in thousandths of a
+	// CPU, and memory which may be reserved by running jobs. Paused jobs
+	// continue to reserve their memory. Zero means no limit.
+	cpuCapacity    int64
+	memoryCapacity int64
+
+	// running contains each job which holds a place, along with the
+	// order in which the jobs were started.
+	running map[uuid.UUID]runningJob
+	started uint64
+
+	// queues contains the queued jobs of each priority class, indexed
+	// by rank.
+	queues [numPriorities][]queuedJob
+}
+
+// request describes the place requested by a job.
+type request struct {
+	priority lib.Priority
+	owner    string
+
+	// cpu and memory are the resources reserved by the job's limits.
+	cpu    int64
+	memory int64
+}
+
+// requestOf returns the place requested by a job which runs the given command.
+func requestOf(c lib.Command) request {
+	return request{
+		priority: c.Priority,
+		owner:    c.Owner,
+		cpu:      c.Limits.CPU,
+		memory:   c.Limits.Memory,
+	}
+}
+
+// queuedJob describes a job which is waiting for a place.
+type queuedJob struct {
+	request
+	id uuid.UUID
+
+	// paused is true if the job has been paused, in which case it
+	// continues to reserve its memory.
+	paused bool
+}
+
+// runningJob describes a job which holds a place in the scheduler.
+type runningJob struct {
+	request
+	order uint64
+
+	// preempting is true once the job has been chosen to be preempted.
+	preempting bool
+}
+
+// newScheduler returns a scheduler which runs at most limit jobs at once.
+func newScheduler(limit int) *scheduler {
+	return &scheduler{limit: limit, running: make(map[uuid.UUID]runningJob)}
+}
+
+// checkCapacity returns an error if the given request could never be admitted
+// because it reserves more than the capacity of the host.
+func (s *scheduler) checkCapacity(r request) error {
+	if s.cpuCapacity > 0 && r.cpu > s.cpuCapacity {
+		return fmt.Errorf("CPU limit of %d exceeds the host's capacity of %d", r.cpu, s.cpuCapacity)
+	}
+	if s.memoryCapacity > 0 && r.memory > s.memoryCapacity {
+		return fmt.Errorf("memory limit of %d bytes exceeds the host's capacity of %d", r.memory, s.memoryCapacity)
+	}
+	return nil
+}
+
+// admit returns true if the job identified by jobID may start immediately, in
+// which case it holds a place. Otherwise the job is queued.
+func (s *scheduler) admit(jobID uuid.UUID, r request) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.mustWait(r) {
+		queue := &s.queues[r.priority.Rank()]
+		*queue = append(*queue, queuedJob{id: jobID, request: r})
+		return false
+	}
+	s.hold(jobID, r)
+	return true
+}
+
+// wouldWait returns true if a job making the given request would be queued
+// were it submitted now.
+func (s *scheduler) wouldWait(r request) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.mustWait(r)
+}
+
+// mustWait returns true if a job making the given request must be queued
+// rather than started. The lock must be held by the caller.
+func (s *scheduler) mustWait(r request) bool {
+	return s.full() || s.ownerFull(r.owner) || !s.fits(r, false) || s.waiting(r.priority.Rank())
+}
+
+// adopt gives a place to a job which is already running, such as one adopted
+// on a restart of the server, regardless of the limits.
+func (s *scheduler) adopt(jobID uuid.UUID, r request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.hold(jobID, r)
+}
+
+// hold gives the job identified by jobID a place. The lock must be held by the
+// caller.
+func (s *scheduler) hold(jobID uuid.UUID, r request) {
+	s.started++
+	s.running[jobID] = runningJob{request: r, order: s.started}
+}
+
+// full returns true if every place is taken. The lock must be held by the
+// caller.
+func (s *scheduler) full() bool {
+	return s.limit > 0 && len(s.running) >= s.limit
+}
+
+// ownerFull returns true if the given owner has as many running jobs as it is
+// permitted. The lock must be held by the caller.
+func (s *scheduler) ownerFull(owner string) bool {
+	if s.ownerLimit == nil {
+		return false
+	}
+	limit := s.ownerLimit(owner)
+	if limit <= 0 {
+		return false
+	}
+	running := 0
+	for _, r := range s.running {
+		if r.owner == owner {
+			running++
+		}
+	}
+	return running >= limit
+}
+
+// fits returns true if the resources of the given request can be reserved. A
+// paused job already reserves its memory. The lock must be held by the
+// caller.
+func (s *scheduler) fits(r request, paused bool) bool {
+	cpu, memory := s.reservations()
+	if !paused {
+		memory += r.memory
+	}
+	return (s.cpuCapacity <= 0 || cpu+r.cpu <= s.cpuCapacity) &&
+		(s.memoryCapacity <= 0 || memory <= s.memoryCapacity)
+}
+
+// reservations returns the CPU reserved by running jobs and the memory
+// reserved by running and paused jobs. The lock must be held by the caller.
+func (s *scheduler) reservations() (cpu, memory int64) {
+	for _, r := range s.running {
+		cpu += r.cpu
+		memory += r.memory
+	}
+	for _, queue := range s.queues {
+		for _, q := range queue {
+			if q.paused {
+				memory += q.memory
+			}
+		}
+	}
+	return cpu, memory
+}
+
+// load returns the resources reserved by running and paused jobs along with
+// the number of running and queued jobs.
+func (s *scheduler) load() (cpu, memory int64, running, queued int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	cpu, memory = s.reservations()
+	for _, queue := range s.queues {
+		queued += len(queue)
+	}
+	return cpu, memory, len(s.running), queued
+}
+
+// waiting returns true if a job of the given, or a higher, rank is queued
+// which is not held back by its owner's limit. Such a job is waiting for a
+// place or resources and a job of the given rank must not start ahead of it.
+// The lock must be held by the caller.
+func (s *scheduler) waiting(rank int) bool {
+	for ; rank < numPriorities; rank++ {
+		for _, q := range s.queues[rank] {
+			if !s.ownerFull(q.owner) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// release frees the place of the job identified by jobID, if it holds one,
+// and returns the next queued job if one can take its place.
+func (s *scheduler) release(jobID uuid.UUID) (uuid.UUID, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.running, jobID)
+	return s.next()
+}
+
+// requeue frees the place of the job identified by jobID and queues it ahead
+// of the other jobs of its priority class, returning the next queued job if
+// one can take its place. The job is requeued even if it did not hold a
+// place, as is the case for a paused job restored on a restart of the server.
+func (s *scheduler) requeue(jobID uuid.UUID, r request, paused bool) (uuid.UUID, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.running, jobID)
+	queue := &s.queues[r.priority.Rank()]
+	*queue = append([]queuedJob{{id: jobID, request: r, paused: paused}}, *queue...)
+	return s.next()
+}
+
+// pop returns the next queued job if one can start, such as once the resources
+// released by a finished job allow several queued jobs to start.
+func (s *scheduler) pop() (uuid.UUID, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.next()
+}
+
+// next removes the first queued job which may start from the queue, if there
+// is a free place, and gives it the place. Jobs are considered in order of
+// priority class, passing over those whose owner may not run another job. A
+// job whose resources cannot be reserved holds back those behind it so that
+// it is not starved by smaller jobs. The lock must be held by the caller.
+func (s *scheduler) next() (uuid.UUID, bool) {
+	if s.full() {
+		return uuid.Nil, false
+	}
+	for rank := numPriorities - 1; rank >= 0; rank-- {
+		for i, q := range s.queues[rank] {
+			if s.ownerFull(q.owner) {
+				continue
+			}
+			if !s.fits(q.request, q.paused) {
+				return uuid.Nil, false
+			}
+			s.queues[rank] = append(s.queues[rank][:i], s.queues[rank][i+1:]...)
+			s.hold(q.id, q.request)
+			return q.id, true
+		}
+	}
+	return uuid.Nil, false
+}
+
+// victim chooses a running job of a lower priority class than the given
+// request to be preempted, if there is one, to make way for it. The most
+// recently started job of the lowest class is chosen so that the least work is
+// interrupted. No job is chosen if the request's owner may not run another
+// job, since the freed place would not be given to its job.
+func (s *scheduler) victim(r request) (uuid.UUID, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.ownerFull(r.owner) {
+		return uuid.Nil, false
+	}
+	var victim uuid.UUID
+	var chosen runningJob
+	found := false
+	for id, v := range s.running {
+		if v.preempting || v.priority.Rank() >= r.priority.Rank() {
+			continue
+		}
+		if !found || v.priority.Rank() < chosen.priority.Rank() ||
+			(v.priority.Rank() == chosen.priority.Rank() && v.order > chosen.order) {
+			victim, chosen, found = id, v, true
+		}
+	}
+	if found {
+		chosen.preempting = true
+		s.running[victim] = chosen
+	}
+	return victim, found
+}
+
+// spare clears the mark on a job chosen to be preempted which could not be.
+func (s *scheduler) spare(jobID uuid.UUID) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if r, ok := s.running[jobID]; ok {
+		r.preempting = false
+		s.running[jobID] = r
+	}
+}
+
+// remove removes the job identified by jobID from the queue. It returns false
+// if the job is not queued.
+func (s *scheduler) remove(jobID uuid.UUID) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for rank, queue := range s.queues {
+		for i, q := range queue {
+			if q.id == jobID {
+				s.queues[rank] = append(queue[:i], queue[i+1:]...)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// position returns the position of the job identified by jobID in the queue,
+// starting from one, or zero if it is not queued.
+func (s *scheduler) position(jobID uuid.UUID) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ahead := 0
+	for rank := numPriorities - 1; rank >= 0; rank-- {
+		for i, q := range s.queues[rank] {
+			if q.id == jobID {
+				return ahead + i + 1
+			}
+		}
+		ahead += len(s.queues[rank])
+	}
+	return 0
+}
+
+// Preemption determines how a running job is preempted to make way for a
+// queued job of a higher priority class.
+type Preemption int
+
+const (
+	// PreemptNone never preempts running jobs.
+	PreemptNone Preemption = iota
+
+	// PreemptPause pauses the running job until a place becomes free.
+	PreemptPause
+
+	// PreemptRequeue stops the running job, with SIGTERM and then SIGKILL
+	// once the grace period has passed, and queues it to be run again
+	// from the start.
+	PreemptRequeue
+)
+
+// defaultPreemptionGracePeriod is the time allowed for a job preempted with
+// PreemptRequeue to exit if no grace period is configured.
+const defaultPreemptionGracePeriod = 10 * time.Second
+
+// schedule starts the given job, which must be registered with the Worker, if
+// the concurrency limit allows. Otherwise the job is queued and a running job
+// of a lower priority class may be preempted to make way for it.
+func (w *Worker) schedule(jobID uuid.UUID, j *job) error {
+	r := requestOf(j.command)
+	if !w.scheduler.admit(jobID, r) {
+		log.WithField("jobID", jobID).Infof("queued command: %s", j.command.Command)
+		w.preempt(r)
+		return nil
+	}
+	err := w.start(jobID, j)
+	if err != nil {
+		w.release(jobID)
+	}
+	return err
+}
+
+// release frees the place of a job which has finished and starts, or resumes,
+// the next queued job, if any.
+func (w *Worker) release(jobID uuid.UUID) {
+	w.run(w.scheduler.release(jobID))
+}
+
+// run starts, or resumes if it was paused, the given queued job which has been
+// given a place. A queued job which fails to start is finished with the reason
+// written to its output and the following job started in its place. Since the
+// resources freed by a job may allow several queued jobs to start, jobs are
+// started until none can be.
+func (w *Worker) run(jobID uuid.UUID, ok bool) {
+	for ok {
+		w.RLock()
+		j := w.jobs[jobID]
+		w.RUnlock()
+
+		j.statusMtx.RLock()
+		paused := j.status.Status == lib.PAUSED
+		j.statusMtx.RUnlock()
+		if paused {
+			w.resume(jobID, j)
+			jobID, ok = w.scheduler.pop()
+			continue
+		}
+
+		err := w.start(jobID, j)
+		if err == nil {
+			jobID, ok = w.scheduler.pop()
+			continue
+		}
+		_, _ = fmt.Fprintf(j.output.StreamWriter(lib.STDERR), "failed to start job: %s\n", err)
+		w.finish(jobID, j, lib.Status{Status: lib.COMPLETED, ExitCode: -1})
+		jobID, ok = w.scheduler.release(jobID)
+	}
+}
+
+// preempt preempts a running job of a lower priority class than the given
+// request, if the Worker is so configured, to make way for the queued job
+// which made it.
+func (w *Worker) preempt(r request) {
+	if w.config.Preemption == PreemptNone {
+		return
+	}
+	victimID, ok := w.scheduler.victim(r)
+	if !ok {
+		return
+	}
+	w.RLock()
+	v := w.jobs[victimID]
+	w.RUnlock()
+
+	switch w.config.Preemption {
+	case PreemptPause:
+		err := v.pause()
+		if err != nil {
+			log.WithError(err).WithField("jobID", victimID).Error("failed to pause job")
+			w.scheduler.spare(victimID)
+			return
+		}
+		// A job which exited before it was paused frees its
+		// place as usual.
+		v.statusMtx.Lock()
+		running := v.status.Status == lib.RUNNING
+		if running {
+			v.status = lib.Status{Status: lib.PAUSED}
+		}
+		v.statusMtx.Unlock()
+		if !running {
+			return
+		}
+		w.persist(victimID, v)
+		log.WithField("jobID", victimID).Info("job paused to make way for a higher priority job")
+		w.run(w.scheduler.requeue(victimID, requestOf(v.command), true))
+
+	case PreemptRequeue:
+		v.statusMtx.Lock()
+		v.preempted = true
+		exited := v.exited
+		v.statusMtx.Unlock()
+		log.WithField("jobID", victimID).Info("stopping job to make way for a higher priority job")
+
+		// The job is given the chance to exit cleanly before it is
+		// killed. Jobs started without their own process group are
+		// signalled directly.
+		err := syscall.Kill(-v.pid, syscall.SIGTERM)
+		if err == syscall.ESRCH {
+			err = syscall.Kill(v.pid, syscall.SIGTERM)
+		}
+		if err != nil {
+			log.WithError(err).WithField("jobID", victimID).Warn("failed to signal job")
+		}
+		grace := w.config.PreemptionGracePeriod
+		if grace == 0 {
+			grace = defaultPreemptionGracePeriod
+		}
+		go func() {
+			timer := time.NewTimer(grace)
+			defer timer.Stop()
+			select {
+			case <-exited:
+			case <-timer.C:
+				_ = v.kill()
+			}
+		}()
+	}
+}
+
+// requeuePreempted queues a job which has exited after being preempted to be
+// run again from the start and starts the next queued job in its place.
+func (w *Worker) requeuePreempted(jobID uuid.UUID, j *job) {
+	j.removeCgroup(jobID)
+	if w.config.DataDir != "" {
+		w.removeShimFiles(jobID)
+	}
+	_, _ = fmt.Fprintf(j.output.StreamWriter(lib.STDERR), "job preempted by a higher priority job, it will be run again from the start\n")
+
+	j.statusMtx.Lock()
+	j.status = lib.Status{Status: lib.QUEUED}
+	j.started = time.Time{}
+	j.pid = 0
+	j.shimPID = 0
+	j.launched = make(chan struct{})
+	j.statusMtx.Unlock()
+	w.persist(jobID, j)
+	log.WithField("jobID", jobID).Info("preempted job requeued")
+	w.run(w.scheduler.requeue(jobID, requestOf(j.command), false))
+}
+
+// resume resumes the given paused job which has been given a place.
+func (w *Worker) resume(jobID uuid.UUID, j *job) {
+	err := j.unpause()
+	if err != nil {
+		// The job holds its place until it has been killed.
+		log.WithError(err).WithField("jobID", jobID).Error("failed to resume job, stopping it")
+		_ = j.kill()
+		return
+	}
+	j.statusMtx.Lock()
+	if j.status.Status == lib.PAUSED {
+		j.status = lib.Status{Status: lib.RUNNING}
+	}
+	j.statusMtx.Unlock()
+	w.persist(jobID, j)
+	log.WithField("jobID", jobID).Info("job resumed")
+}
+
+// pause stops every process of the job from running, using the cgroup freezer
+// if the job has a cgroup and otherwise SIGSTOP.
+func (j *job) pause() error {
+	if cg := j.getCgroup(); cg != nil {
+		return cg.freeze(true)
+	}
+	return j.signalAll(syscall.SIGSTOP)
+}
+
+// unpause resumes the processes of a paused job.
+func (j *job) unpause() error {
+	if cg := j.getCgroup(); cg != nil {
+		return cg.freeze(false)
+	}
+	return j.signalAll(syscall.SIGCONT)
+}
+
+// signalAll sends the given signal to every process of the job.
+func (j *job) signalAll(sig syscall.Signal) error {
+	err := syscall.Kill(j.pid, sig)
+	if err != nil {
+		return err
+	}
+	for _, pid := range descendants("/proc", j.pid)[1:] {
+		// A process may have exited since the list of PIDs was read.
+		_ = syscall.Kill(pid, sig)
+	}
+	return nil
+}
+
+// scheduleRestored schedules the given restored jobs, which were queued when
+// the server exited, in the order in which they were submitted.
+func (w *Worker) scheduleRestored(jobs map[uuid.UUID]*job) {
+	ids := make([]uuid.UUID, 0, len(jobs))
+	for id := range jobs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, k int) bool {
+		return jobs[ids[i]].created.Before(jobs[ids[k]].created)
+	})
+	for _, id := range ids {
+		j := jobs[id]
+		err := w.schedule(id, j)
+		if err != nil {
+			_, _ = fmt.Fprintf(j.output.StreamWriter(lib.STDERR), "failed to start job: %s\n", err)
+			w.finish(id, j, lib.Status{Status: lib.COMPLETED, ExitCode: -1})
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package backend
+
+import (
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// TestScheduler verifies that the scheduler admits jobs up to its limit and
+// then queues them in the order in which they were submitted.
+func TestScheduler(t *testing.T) {
+	s := newScheduler(2)
+	ids := make([]uuid.UUID, 5)
+	for i := range ids {
+		ids[i] = uuid.NewV4()
+	}
+
+	require.True(t, s.admit(ids[0], request{priority: lib.PriorityDefault}))
+	require.True(t, s.admit(ids[1], request{priority: lib.PriorityDefault}))
+	require.False(t, s.admit(ids[2], request{priority: lib.PriorityDefault}))
+	require.False(t, s.admit(ids[3], request{priority: lib.PriorityDefault}))
+	require.False(t, s.admit(ids[4], request{priority: lib.PriorityDefault}))
+	require.Equal(t, 0, s.position(ids[0]))
+	require.Equal(t, 1, s.position(ids[2]))
+	require.Equal(t, 3, s.position(ids[4]))
+
+	// A removed job is never started and those behind it move up.
+	require.True(t, s.remove(ids[3]))
+	require.False(t, s.remove(ids[3]))
+	require.Equal(t, 2, s.position(ids[4]))
+
+	next, ok := s.release(ids[0])
+	require.True(t, ok)
+	require.Equal(t, ids[2], next)
+	next, ok = s.release(ids[1])
+	require.True(t, ok)
+	require.Equal(t, ids[4], next)
+	_, ok = s.release(ids[2])
+	require.False(t, ok)
+	require.Len(t, s.running, 1)
+
+	// An adopted job counts towards the limit.
+	s.adopt(ids[0], request{priority: lib.PriorityDefault})
+	require.False(t, s.admit(ids[1], request{priority: lib.PriorityDefault}))
+}
+
+// TestSchedulerNoLimit verifies that every job is admitted without a limit.
+func TestSchedulerNoLimit(t *testing.T) {
+	s := newScheduler(0)
+	for i := 0; i < 100; i++ {
+		require.True(t, s.admit(uuid.NewV4(), request{priority: lib.PriorityBatch}))
+	}
+}
+
+// TestSchedulerPriorities verifies that queued jobs of higher priority classes
+// are started first and that a requeued job is started before the other jobs
+// of its class.
+func TestSchedulerPriorities(t *testing.T) {
+	s := newScheduler(1)
+	running := uuid.NewV4()
+	batch := uuid.NewV4()
+	normal := uuid.NewV4()
+	interactive := uuid.NewV4()
+
+	require.True(t, s.admit(running, request{priority: lib.PriorityBatch}))
+	require.False(t, s.admit(batch, request{priority: lib.PriorityBatch}))
+	require.False(t, s.admit(normal, request{priority: lib.PriorityDefault}))
+	require.False(t, s.admit(interactive, request{priority: lib.PriorityInteractive}))
+	require.Equal(t, 1, s.position(interactive))
+	require.Equal(t, 2, s.position(normal))
+	require.Equal(t, 3, s.position(batch))
+
+	next, ok := s.requeue(running, request{priority: lib.PriorityBatch}, false)
+	require.True(t, ok)
+	require.Equal(t, interactive, next)
+	require.Equal(t, 2, s.position(running))
+	require.Equal(t, 3, s.position(batch))
+
+	for _, expected := range []uuid.UUID{normal, running, batch} {
+		next, ok = s.release(next)
+		require.True(t, ok)
+		require.Equal(t, expected, next)
+	}
+}
+
+// TestSchedulerVictim verifies that the most recently started job of the
+// lowest priority class is chosen to be preempted, and only once.
+func TestSchedulerVictim(t *testing.T) {
+	s := newScheduler(0)
+	first := uuid.NewV4()
+	second := uuid.NewV4()
+	normal := uuid.NewV4()
+	s.adopt(first, request{priority: lib.PriorityBatch})
+	s.adopt(normal, request{priority: lib.PriorityDefault})
+	s.adopt(second, request{priority: lib.PriorityBatch})
+
+	_, ok := s.victim(request{priority: lib.PriorityBatch})
+	require.False(t, ok)
+
+	victim, ok := s.victim(request{priority: lib.PriorityInteractive})
+	require.True(t, ok)
+	require.Equal(t, second, victim)
+	victim, ok = s.victim(request{priority: lib.PriorityInteractive})
+	require.True(t, ok)
+	require.Equal(t, first, victim)
+	victim, ok = s.victim(request{priority: lib.PriorityInteractive})
+	require.True(t, ok)
+	require.Equal(t, normal, victim)
+	_, ok = s.victim(request{priority: lib.PriorityInteractive})
+	require.False(t, ok)
+
+	// A spared job may be chosen again.
+	s.spare(first)
+	victim, ok = s.victim(request{priority: lib.PriorityDefault})
+	require.True(t, ok)
+	require.Equal(t, first, victim)
+}
+
+// TestSchedulerOwnerLimit verifies that jobs of an owner with as many running
+// jobs as it is permitted are queued, and passed over, until one finishes.
+func TestSchedulerOwnerLimit(t *testing.T) {
+	s := newScheduler(3)
+	s.ownerLimit = func(owner string) int {
+		if owner == "a" {
+			return 1
+		}
+		return 0
+	}
+	first := uuid.NewV4()
+	second := uuid.NewV4()
+	other := uuid.NewV4()
+	third := uuid.NewV4()
+
+	require.True(t, s.admit(first, request{priority: lib.PriorityBatch, owner: "a"}))
+	require.False(t, s.admit(second, request{priority: lib.PriorityInteractive, owner: "a"}))
+	require.True(t, s.admit(other, request{priority: lib.PriorityDefault, owner: "b"}))
+	require.True(t, s.admit(third, request{priority: lib.PriorityDefault, owner: "b"}))
+
+	// A place freed by another owner is not given to a job of an owner
+	// at its limit, nor does such a job cause preemption.
+	_, ok := s.victim(request{priority: lib.PriorityInteractive, owner: "a"})
+	require.False(t, ok)
+	_, ok = s.release(other)
+	require.False(t, ok)
+
+	next, ok := s.release(first)
+	require.True(t, ok)
+	require.Equal(t, second, next)
+}
+
+// TestSchedulerResources verifies that jobs are admitted only while their
+// reservations fit, that a job which does not fit holds back those behind it
+// and that paused jobs continue to reserve their memory.
+func TestSchedulerResources(t *testing.T) {
+	s := newScheduler(0)
+	s.cpuCapacity = 2000
+	s.memoryCapacity = 4 << 30
+	big := request{priority: lib.PriorityBatch, cpu: 1500, memory: 2 << 30}
+	small := request{priority: lib.PriorityBatch, cpu: 500, memory: 1 << 30}
+	tiny := request{priority: lib.PriorityBatch, cpu: 1}
+	urgent := request{priority: lib.PriorityInteractive, cpu: 1000, memory: 1 << 30}
+	ids := make([]uuid.UUID, 5)
+	for i := range ids {
+		ids[i] = uuid.NewV4()
+	}
+
+	require.NotNil(t, s.checkCapacity(request{cpu: 2001}))
+	require.NotNil(t, s.checkCapacity(request{memory: 4<<30 + 1}))
+	require.Nil(t, s.checkCapacity(big))
+
+	require.True(t, s.admit(ids[0], big))
+	require.True(t, s.admit(ids[1], small))
+	require.False(t, s.admit(ids[2], big))
+	require.False(t, s.admit(ids[3], tiny))
+
+	// The tiny job would fit once the small job finishes but is not
+	// started ahead of the big job.
+	_, ok := s.release(ids[1])
+	require.False(t, ok)
+
+	// Pausing the first job makes way for the urgent job, but the first
+	// job continues to reserve its memory.
+	require.False(t, s.admit(ids[4], urgent))
+	next, ok := s.requeue(ids[0], big, true)
+	require.True(t, ok)
+	require.Equal(t, ids[4], next)
+	cpu, memory, running, queued := s.load()
+	require.Equal(t, int64(1000), cpu)
+	require.Equal(t, int64(3<<30), memory)
+	require.Equal(t, 1, running)
+	require.Equal(t, 3, queued)
+	_, ok = s.pop()
+	require.False(t, ok)
+
+	next, ok = s.release(ids[4])
+	require.True(t, ok)
+	require.Equal(t, ids[0], next)
+	next, ok = s.release(ids[0])
+	require.True(t, ok)
+	require.Equal(t, ids[2], next)
+
+	// The resources released by a job may allow several jobs to start.
+	next, ok = s.pop()
+	require.True(t, ok)
+	require.Equal(t, ids[3], next)
+	_, ok = s.pop()
+	require.False(t, ok)
+}
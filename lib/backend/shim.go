@@ -0,0 +1,421 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/thompsy/worker-api-service/lib"
+	"golang.org/x/sys/unix"
+)
+
+// The files within a job's directory used by its shim.
+const (
+	// captureFile is an output log of the output captured by the shim.
+	captureFile = "capture"
+
+	// capturePosFile contains the position in the capture file up to
+	// which the server has copied, and freed, the captured output.
+	capturePosFile = "capture.pos"
+
+	// pidFile contains the PID of the job's process once it has started.
+	pidFile = "pid"
+
+	// exitFile contains the JSON encoded shimExit once the job has
+	// exited.
+	exitFile = "exit.json"
+
+	// shimLogFile contains the shim's own log messages.
+	shimLogFile = "shim.log"
+)
+
+const (
+	// shimStartTimeout is the time allowed for the shim to start the job.
+	shimStartTimeout = 10 * time.Second
+
+	// shimPollInterval is the interval at which the server checks for
+	// captured output and whether an adopted shim has exited.
+	shimPollInterval = 50 * time.Millisecond
+
+	// captureFreeSize is the number of bytes of captured output after
+	// which the space they use is freed once copied to the job's output.
+	captureFreeSize = 1 << 20
+)
+
+// shimExit is the exit status of a job, written by its shim.
+type shimExit struct {
+	ExitCode int
+	Killed   bool
+	Usage    lib.ResourceUsage
+}
+
+// Shim runs the job described by the given JSON encoded execConfig, capturing
+// its output to the job's directory. The shim is run by the server as a
+// separate process, which does not exit with the server, so that the job
+// survives a restart of the server. The server stops the job by sending SIGTERM
+// to the shim. The offset is the size of the job's output before it was
+// started, which is non-zero if the job is being rerun.
+func Shim(dir, config, offset string) {
+	start, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil {
+		log.WithError(err).Fatal("invalid output offset")
+	}
+	capture, err := openOutputLog(filepath.Join(dir, captureFile))
+	if err != nil {
+		log.WithError(err).Fatal("failed to open capture file")
+	}
+	w := &captureWriter{log: capture, offset: start}
+
+	cmd := exec.Command("/proc/self/exe", "exec", config)
+	cmd.Stdout = w.stream(lib.STDOUT)
+	cmd.Stderr = w.stream(lib.STDERR)
+	cmd.SysProcAttr = jobSysProcAttr()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	err = cmd.Start()
+	if err != nil {
+		log.WithError(err).Fatal("failed to start job")
+	}
+	err = writeFileAtomic(filepath.Join(dir, pidFile), []byte(strconv.Itoa(cmd.Process.Pid)))
+	if err != nil {
+		_ = cmd.Process.Kill()
+		log.WithError(err).Fatal("failed to write pid file")
+	}
+	go func() {
+		<-signals
+		_ = cmd.Process.Kill()
+	}()
+
+	waitErr := cmd.Wait()
+	rusage, _ := cmd.ProcessState.SysUsage().(*syscall.Rusage)
+	exit, err := json.Marshal(shimExit{
+		ExitCode: cmd.ProcessState.ExitCode(),
+		Killed:   waitErr != nil && waitErr.Error() == "signal: killed",
+		Usage:    rusageToUsage(rusage),
+	})
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(dir, exitFile), exit)
+	}
+	if err != nil {
+		log.WithError(err).Fatal("failed to write exit status")
+	}
+}
+
+// captureWriter records the output of a job in the capture file. The output is
+// recorded in the same way as by a broadcastBuffer so that it can be copied to
+// one by the server.
+type captureWriter struct {
+	mtx    sync.Mutex
+	log    *outputLog
+	seq    uint64
+	offset int64
+}
+
+// stream returns an io.Writer which records output written to the given
+// stream.
+func (w *captureWriter) stream(stream lib.OutputStream) io.Writer {
+	return captureStream{w: w, stream: stream}
+}
+
+// captureStream is an io.Writer which records output written to a single
+// stream.
+type captureStream struct {
+	w      *captureWriter
+	stream lib.OutputStream
+}
+
+// Write records the given output.
+func (s captureStream) Write(p []byte) (int, error) {
+	s.w.mtx.Lock()
+	defer s.w.mtx.Unlock()
+	err := s.w.log.AppendChunk(lib.OutputChunk{
+		Stream: s.stream,
+		Data:   p,
+		Seq:    s.w.seq,
+		Time:   time.Now(),
+		Offset: s.w.offset,
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.w.seq++
+	s.w.offset += int64(len(p))
+	return len(p), nil
+}
+
+// startShim starts a shim to run the job described by the given execConfig. It
+// returns a function which copies the job's output to its buffer until the job
+// exits and then returns its final status.
+func (w *Worker) startShim(jobID uuid.UUID, j *job, config []byte) (func() lib.Status, error) {
+	dir := w.jobDir(jobID)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job directory: %w", err)
+	}
+	logFile, err := os.OpenFile(filepath.Join(dir, shimLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create shim log: %w", err)
+	}
+	defer logFile.Close()
+
+	offset := strconv.FormatInt(j.output.totalSize(), 10)
+	cmd := exec.Command("/proc/self/exe", "shim", dir, string(config), offset)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// The shim is placed in its own session and, unlike the job itself,
+	// is not killed when its parent exits.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start shim: %w", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+
+	pid, err := waitForPID(dir, exited)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		return nil, err
+	}
+	j.setShim(cmd.Process.Pid, pid)
+	return superviseShim(dir, j, exited), nil
+}
+
+// adoptShim resumes supervising the shim of a job which was running when the
+// server restarted.
+func (w *Worker) adoptShim(jobID uuid.UUID, j *job, shimPID, pid int) {
+	dir := w.jobDir(jobID)
+	j.setShim(shimPID, pid)
+	if w.config.CgroupRoot != "" {
+		j.setCgroup(openCgroup(w.config.CgroupRoot, jobID))
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		for shimRunning(shimPID, dir) {
+			time.Sleep(shimPollInterval)
+		}
+		close(exited)
+	}()
+
+	w.supervise(jobID, j, superviseShim(dir, j, exited))
+}
+
+// jobDir returns the directory of the job identified by jobID within the data
+// directory, in which its shim is run.
+func (w *Worker) jobDir(jobID uuid.UUID) string {
+	return filepath.Join(w.config.DataDir, jobID.String())
+}
+
+// removeShimFiles removes the files used by the shim of the job identified by
+// jobID once the job has finished, other than the shim's log.
+func (w *Worker) removeShimFiles(jobID uuid.UUID) {
+	for _, name := range []string{captureFile, capturePosFile, pidFile, exitFile} {
+		err := os.Remove(filepath.Join(w.jobDir(jobID), name))
+		if err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithField("jobID", jobID).Warn("failed to remove shim file")
+		}
+	}
+}
+
+// setShim records the PIDs of the job's shim and process.
+func (j *job) setShim(shimPID, pid int) {
+	j.shimPID = shimPID
+	j.pid = pid
+	j.kill = func() error {
+		return syscall.Kill(shimPID, syscall.SIGTERM)
+	}
+}
+
+// waitForPID waits for the shim to write the PID of the job's process to the
+// job's directory.
+func waitForPID(dir string, exited <-chan struct{}) (int, error) {
+	timeout := time.NewTimer(shimStartTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		data, err := ioutil.ReadFile(filepath.Join(dir, pidFile))
+		if err == nil {
+			return strconv.Atoi(string(data))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-exited:
+			return 0, fmt.Errorf("shim exited before starting the job, see %s", filepath.Join(dir, shimLogFile))
+		case <-timeout.C:
+			return 0, fmt.Errorf("timed out waiting for shim to start the job")
+		}
+	}
+}
+
+// shimRunning returns true if the process with the given PID is the shim of
+// the job with the given directory.
+func shimRunning(pid int, dir string) bool {
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(cmdline), "\x00shim\x00"+dir+"\x00")
+}
+
+// superviseShim returns a function which copies the output captured by the
+// job's shim to the job's buffer until the shim exits and then returns the
+// job's final status.
+func superviseShim(dir string, j *job, exited <-chan struct{}) func() lib.Status {
+	return func() lib.Status {
+		capture, err := openCapture(dir)
+		if err != nil {
+			log.WithError(err).Error("failed to open captured output")
+			<-exited
+			return readShimExit(dir)
+		}
+		defer capture.Close()
+
+		ticker := time.NewTicker(shimPollInterval)
+		defer ticker.Stop()
+		for {
+			// The shim has written all of the output before it
+			// exits so a final copy reads the remainder.
+			select {
+			case <-exited:
+				err := capture.copyTo(j.output)
+				if err != nil {
+					log.WithError(err).Error("failed to copy captured output")
+				}
+				return readShimExit(dir)
+			case <-ticker.C:
+				err := capture.copyTo(j.output)
+				if err != nil {
+					log.WithError(err).Error("failed to copy captured output")
+				}
+			}
+		}
+	}
+}
+
+// readShimExit returns the final status of the job written by its shim. If
+// the shim exited without writing one the job is lost.
+func readShimExit(dir string) lib.Status {
+	data, err := ioutil.ReadFile(filepath.Join(dir, exitFile))
+	if err != nil {
+		return lib.Status{Status: lib.LOST}
+	}
+	var exit shimExit
+	err = json.Unmarshal(data, &exit)
+	if err != nil {
+		return lib.Status{Status: lib.LOST}
+	}
+
+	status := lib.Status{
+		Status:   lib.COMPLETED,
+		ExitCode: exit.ExitCode,
+		Usage:    exit.Usage,
+	}
+	if exit.Killed {
+		status.Status = lib.STOPPED
+	}
+	return status
+}
+
+// captureReader copies the output captured by a shim to the job's buffer.
+type captureReader struct {
+	file    *os.File
+	posPath string
+
+	// pos is the position of the next record to be read and freed the
+	// position up to which the space used by records has been freed.
+	pos   int64
+	freed int64
+}
+
+// openCapture opens the capture file in the given job directory, starting
+// from the position recorded when the captured output was last freed.
+func openCapture(dir string) (*captureReader, error) {
+	f, err := os.OpenFile(filepath.Join(dir, captureFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+	r := &captureReader{file: f, posPath: filepath.Join(dir, capturePosFile)}
+	data, err := ioutil.ReadFile(r.posPath)
+	if err == nil {
+		r.pos, err = strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("invalid capture position: %w", err)
+		}
+		r.freed = r.pos
+	}
+	return r, nil
+}
+
+// copyTo writes the output captured since the last call to the given buffer.
+// Output which the buffer already contains, as is the case after a restart of
+// the server, is skipped.
+func (r *captureReader) copyTo(b *broadcastBuffer) error {
+	for {
+		_, c, n, err := readRecordAt(r.file, r.pos)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		r.pos += n
+
+		if skip := b.totalSize() - c.Offset; skip > 0 {
+			if skip >= int64(len(c.Data)) {
+				continue
+			}
+			c.Data = c.Data[skip:]
+		}
+		_, err = b.write(c.Stream, c.Data, c.Time)
+		if err != nil {
+			return err
+		}
+	}
+	return r.free()
+}
+
+// free releases the space used by output which has been copied once enough
+// has accumulated.
+func (r *captureReader) free() error {
+	if r.pos-r.freed < captureFreeSize {
+		return nil
+	}
+
+	// The position is recorded before the space is freed so that the
+	// freed records are never read.
+	err := writeFileAtomic(r.posPath, []byte(strconv.FormatInt(r.pos, 10)))
+	if err != nil {
+		return err
+	}
+	err = unix.Fallocate(int(r.file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, r.freed, r.pos-r.freed)
+	if err != nil {
+		return fmt.Errorf("failed to free captured output: %w", err)
+	}
+	r.freed = r.pos
+	return nil
+}
+
+// Close closes the capture file.
+func (r *captureReader) Close() error {
+	return r.file.Close()
+}
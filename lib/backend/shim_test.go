@@ -0,0 +1,94 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// TestCaptureReader verifies that output captured by a shim is copied to the
+// job's buffer exactly once, including when copying resumes after a restart
+// of the server and once the space used by copied output has been freed.
+func TestCaptureReader(t *testing.T) {
+	dir := t.TempDir()
+	capture, err := openOutputLog(filepath.Join(dir, captureFile))
+	require.Nil(t, err)
+	w := &captureWriter{log: capture}
+	defer capture.Close()
+
+	var expected bytes.Buffer
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			line := fmt.Sprintf("%06d %s\n", i, bytes.Repeat([]byte("x"), 1000))
+			_, err := w.stream(lib.STDOUT).Write([]byte(line))
+			require.Nil(t, err)
+			expected.WriteString(line)
+		}
+	}
+
+	store := NewFileStore(t.TempDir())
+	id := uuid.NewV4()
+	l, err := store.OpenLog(id)
+	require.Nil(t, err)
+	b := newBroadcastBuffer(bufferConfig{outputLog: l})
+
+	write(0, 1500)
+	r, err := openCapture(dir)
+	require.Nil(t, err)
+	require.Nil(t, r.copyTo(b))
+	require.True(t, r.freed > 0)
+	_, err = os.Stat(filepath.Join(dir, capturePosFile))
+	require.Nil(t, err)
+
+	// The server exits having copied more output than it recorded as
+	// freed and a new buffer is restored from the output log.
+	write(1500, 1600)
+	require.Nil(t, r.copyTo(b))
+	require.Nil(t, r.Close())
+	require.Nil(t, b.config.outputLog.Close())
+	write(1600, 1700)
+
+	b, err = restoreBuffer(bufferConfig{}, store, id)
+	require.Nil(t, err)
+	r, err = openCapture(dir)
+	require.Nil(t, err)
+	defer r.Close()
+	require.Nil(t, r.copyTo(b))
+	require.Nil(t, b.Close())
+
+	output, err := ioutil.ReadAll(b.NewReader(context.Background(), lib.LogOptions{}))
+	require.Nil(t, err)
+	require.Equal(t, expected.String(), string(output))
+}
+
+// TestReadShimExit verifies that the final status of a job is read from the
+// exit status written by its shim.
+func TestReadShimExit(t *testing.T) {
+	tests := []struct {
+		name     string
+		exit     string
+		expected lib.Status
+	}{
+		{"completed", `{"ExitCode":3}`, lib.Status{Status: lib.COMPLETED, ExitCode: 3}},
+		{"killed", `{"ExitCode":-1,"Killed":true}`, lib.Status{Status: lib.STOPPED, ExitCode: -1}},
+		{"missing", "", lib.Status{Status: lib.LOST}},
+		{"invalid", "{", lib.Status{Status: lib.LOST}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if test.exit != "" {
+				require.Nil(t, ioutil.WriteFile(filepath.Join(dir, exitFile), []byte(test.exit), 0600))
+			}
+			require.Equal(t, test.expected, readShimExit(dir))
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// sqlSchema creates the tables used by an SQLStore. The statements, like the
+// queries below, are portable between PostgreSQL and SQLite.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS jobs (
+		id VARCHAR(36) PRIMARY KEY,
+		record TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS job_output (
+		job_id VARCHAR(36) NOT NULL,
+		pos BIGINT NOT NULL,
+		kind SMALLINT NOT NULL,
+		stream SMALLINT NOT NULL,
+		seq BIGINT NOT NULL,
+		time_ns BIGINT NOT NULL,
+		output_offset BIGINT NOT NULL,
+		data BYTEA NOT NULL,
+		PRIMARY KEY (job_id, pos)
+	)`,
+}
+
+// SQLStore is a Store which persists jobs in an SQL database. Each job's
+// record is stored as JSON in the jobs table and each record of its output log
+// as a row of the job_output table.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore returns an SQLStore which persists jobs in the given database,
+// creating its tables if they do not already exist.
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	for _, stmt := range sqlSchema {
+		_, err := db.Exec(stmt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tables: %w", err)
+		}
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// SaveJob saves the given record, replacing any previous record of the job.
+func (s *SQLStore) SaveJob(r JobRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode job record: %w", err)
+	}
+	_, err = s.db.Exec(`INSERT INTO jobs (id, record) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET record = excluded.record`, r.ID.String(), string(data))
+	if err != nil {
+		return fmt.Errorf("failed to save job record: %w", err)
+	}
+	return nil
+}
+
+// LoadJobs returns the records of every saved job. Records which cannot be
+// decoded are skipped.
+func (s *SQLStore) LoadJobs() ([]JobRecord, error) {
+	rows, err := s.db.Query(`SELECT record FROM jobs`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load job records: %w", err)
+	}
+	defer rows.Close()
+
+	var records []JobRecord
+	for rows.Next() {
+		var data string
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load job records: %w", err)
+		}
+		var r JobRecord
+		err = json.Unmarshal([]byte(data), &r)
+		if err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load job records: %w", err)
+	}
+	return records, nil
+}
+
+// DeleteJob deletes the record of the job identified by jobID.
+func (s *SQLStore) DeleteJob(jobID uuid.UUID) error {
+	_, err := s.db.Exec(`DELETE FROM jobs WHERE id = $1`, jobID.String())
+	if err != nil {
+		return fmt.Errorf("failed to delete job record: %w", err)
+	}
+	return nil
+}
+
+// OpenLog returns the log of the job identified by jobID. Records are appended
+// after any already in the database.
+func (s *SQLStore) OpenLog(jobID uuid.UUID) (OutputLog, error) {
+	l := &sqlLog{db: s.db, jobID: jobID.String()}
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(pos) + 1, 0), COALESCE(SUM(LENGTH(data)), 0)
+		FROM job_output WHERE job_id = $1`, l.jobID).Scan(&l.pos, &l.size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open output log: %w", err)
+	}
+	l.base = l.size
+	return l, nil
+}
+
+// ReadLog calls the given functions with each record in the log of the job
+// identified by jobID.
+func (s *SQLStore) ReadLog(jobID uuid.UUID, chunk func(lib.OutputChunk), size func(int64)) error {
+	rows, err := s.db.Query(`SELECT kind, stream, seq, time_ns, output_offset, data
+		FROM job_output WHERE job_id = $1 ORDER BY pos`, jobID.String())
+	if err != nil {
+		return fmt.Errorf("failed to read output log: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind byte
+		var seq, t int64
+		var c lib.OutputChunk
+		err = rows.Scan(&kind, &c.Stream, &seq, &t, &c.Offset, &c.Data)
+		if err != nil {
+			return fmt.Errorf("failed to read output log: %w", err)
+		}
+		c.Seq = uint64(seq)
+		if t != 0 {
+			c.Time = time.Unix(0, t)
+		}
+
+		switch kind {
+		case logChunk:
+			chunk(c)
+		case logSize:
+			size(c.Offset)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("failed to read output log: %w", err)
+	}
+	return nil
+}
+
+// DeleteLog deletes the log of the job identified by jobID.
+func (s *SQLStore) DeleteLog(jobID uuid.UUID) error {
+	_, err := s.db.Exec(`DELETE FROM job_output WHERE job_id = $1`, jobID.String())
+	if err != nil {
+		return fmt.Errorf("failed to delete output log: %w", err)
+	}
+	return nil
+}
+
+// sqlExecer is implemented by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// sqlLog is the log of a single job's output held by an SQLStore.
+type sqlLog struct {
+	db    *sql.DB
+	jobID string
+
+	// pos is the position of the next record in the log.
+	pos int64
+
+	// size is the number of bytes of output in the log and base its size
+	// when it was last rewritten.
+	size int64
+	base int64
+}
+
+// AppendChunk appends a record of the given chunk to the log.
+func (l *sqlLog) AppendChunk(c lib.OutputChunk) error {
+	return l.append(l.db, logChunk, c)
+}
+
+// AppendSize appends a record of the total size of the output to the log.
+func (l *sqlLog) AppendSize(size int64) error {
+	return l.append(l.db, logSize, lib.OutputChunk{Offset: size})
+}
+
+// append inserts a single record into the log.
+func (l *sqlLog) append(db sqlExecer, kind byte, c lib.OutputChunk) error {
+	var t int64
+	if !c.Time.IsZero() {
+		t = c.Time.UnixNano()
+	}
+	data := c.Data
+	if data == nil {
+		data = []byte{}
+	}
+	_, err := db.Exec(`INSERT INTO job_output (job_id, pos, kind, stream, seq, time_ns, output_offset, data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		l.jobID, l.pos, int16(kind), int16(c.Stream), int64(c.Seq), t, c.Offset, data)
+	if err != nil {
+		return fmt.Errorf("failed to write output log: %w", err)
+	}
+	l.pos++
+	l.size += int64(len(c.Data))
+	return nil
+}
+
+// Full returns true if the log should be rewritten.
+func (l *sqlLog) Full(outputLimit int64) bool {
+	return logFull(l.size, l.base, outputLimit)
+}
+
+// Rewrite replaces the contents of the log with the given chunks followed by
+// the total size of the output. The log is replaced within a transaction so
+// that it is never seen partially rewritten.
+func (l *sqlLog) Rewrite(chunks func(fn func(lib.OutputChunk) error) error, size int64) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to rewrite output log: %w", err)
+	}
+	_, err = tx.Exec(`DELETE FROM job_output WHERE job_id = $1`, l.jobID)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to rewrite output log: %w", err)
+	}
+
+	rewritten := &sqlLog{jobID: l.jobID}
+	err = chunks(func(c lib.OutputChunk) error {
+		return rewritten.append(tx, logChunk, c)
+	})
+	if err == nil {
+		err = rewritten.append(tx, logSize, lib.OutputChunk{Offset: size})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	l.pos = rewritten.pos
+	l.size = rewritten.size
+	l.base = rewritten.size
+	return nil
+}
+
+// Close does nothing since the database is owned by the caller.
+func (l *sqlLog) Close() error {
+	return nil
+}
@@ -0,0 +1,278 @@
+package backend
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// A Store persists jobs and their output so that they survive a restart of
+// the server. FileStore, MemoryStore and SQLStore are provided.
+type Store interface {
+	JobStore
+	LogStore
+}
+
+// JobStore persists the records of jobs.
+type JobStore interface {
+	// SaveJob saves the given record, replacing any previous record of
+	// the job.
+	SaveJob(r JobRecord) error
+
+	// LoadJobs returns the records of every saved job.
+	LoadJobs() ([]JobRecord, error)
+
+	// DeleteJob deletes the record of the job identified by jobID.
+	DeleteJob(jobID uuid.UUID) error
+}
+
+// LogStore persists the output of jobs as a log of the chunks written to
+// each job's output.
+type LogStore interface {
+	// OpenLog returns the log of the job identified by jobID, creating
+	// it if necessary. Records are appended to any already in the log.
+	OpenLog(jobID uuid.UUID) (OutputLog, error)
+
+	// ReadLog calls the given functions with each chunk and size
+	// recorded in the log of the job identified by jobID, in the order
+	// in which they were recorded.
+	ReadLog(jobID uuid.UUID, chunk func(lib.OutputChunk), size func(int64)) error
+
+	// DeleteLog deletes the log of the job identified by jobID.
+	DeleteLog(jobID uuid.UUID) error
+}
+
+// OutputLog records the chunks of a single job's output. Since the log records
+// every chunk written, it is rewritten to contain only the retained chunks
+// once it grows too large and when the output is closed.
+type OutputLog interface {
+	// AppendChunk appends a record of the given chunk.
+	AppendChunk(c lib.OutputChunk) error
+
+	// AppendSize appends a record of the total size of the output,
+	// including any which was dropped.
+	AppendSize(size int64) error
+
+	// Full returns true if the log has grown enough since it was last
+	// rewritten that it should be rewritten again.
+	Full(outputLimit int64) bool
+
+	// Rewrite replaces the contents of the log with the chunks passed
+	// to fn by chunks followed by the total size of the output.
+	Rewrite(chunks func(fn func(lib.OutputChunk) error) error, size int64) error
+
+	// Close closes the log. The log is not deleted.
+	Close() error
+}
+
+// JobRecord is the persisted state of a job.
+type JobRecord struct {
+	ID uuid.UUID
+
+	// ShimPID and PID are the PIDs of the job's shim and process while it
+	// is running.
+	ShimPID int
+	PID     int
+
+	Command  lib.Command
+	Status   lib.Status
+	Created  time.Time
+	Started  time.Time
+	Finished time.Time
+}
+
+// logFull returns true if a log of the given size, which was of size base when
+// it was last rewritten, should be rewritten. The log is allowed to double in
+// size, and to grow by at least the output limit, so that rewriting takes
+// amortised constant time per write.
+func logFull(size, base, outputLimit int64) bool {
+	if outputLimit <= 0 {
+		return false
+	}
+	threshold := base
+	if threshold < outputLimit {
+		threshold = outputLimit
+	}
+	return size >= 2*threshold
+}
+
+// restoreBuffer returns a buffer containing the output recorded in the log of
+// the job identified by jobID. The buffer continues to record its output in the
+// log and is left open so that any further output can be written to it.
+func restoreBuffer(c bufferConfig, logs LogStore, jobID uuid.UUID) (*broadcastBuffer, error) {
+	onLimit := c.onLimit
+	c.onLimit = nil
+	c.outputLog = nil
+	b := newBroadcastBuffer(c)
+
+	b.mtx.Lock()
+	err := logs.ReadLog(jobID, func(chunk lib.OutputChunk) {
+		if chunk.Offset > b.outputSize {
+			b.truncated = true
+		}
+		b.written = chunk.Seq
+		b.appendChunk(chunk.Stream, chunk.Data, chunk.Offset, chunk.Time)
+		b.outputSize = chunk.Offset + int64(len(chunk.Data))
+		b.spill()
+	}, func(size int64) {
+		if size > b.outputSize {
+			b.truncated = true
+			b.outputSize = size
+		}
+	})
+	b.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	b.config.onLimit = onLimit
+	b.config.outputLog, err = logs.OpenLog(jobID)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// persist saves the current state of the given job if a store is configured.
+func (w *Worker) persist(jobID uuid.UUID, j *job) {
+	if w.store == nil {
+		return
+	}
+
+	j.statusMtx.RLock()
+	r := JobRecord{
+		ID:       jobID,
+		Command:  j.command,
+		Status:   j.status,
+		Created:  j.created,
+		Started:  j.started,
+		Finished: j.finished,
+		ShimPID:  j.shimPID,
+		PID:      j.pid,
+	}
+	j.statusMtx.RUnlock()
+	r.Status.OutputTruncated = j.output.isTruncated()
+
+	err := w.store.SaveJob(r)
+	if err != nil {
+		log.WithError(err).WithField("jobID", jobID).Error("failed to persist job")
+	}
+}
+
+// unpersist deletes the persisted record and output of the job identified by
+// jobID, along with its directory in the data directory.
+func (w *Worker) unpersist(jobID uuid.UUID) error {
+	if w.store == nil {
+		return nil
+	}
+	err := w.store.DeleteLog(jobID)
+	if err == nil {
+		err = w.store.DeleteJob(jobID)
+	}
+	if err == nil && w.config.DataDir != "" {
+		err = os.RemoveAll(w.jobDir(jobID))
+	}
+	return err
+}
+
+// Restore loads the jobs persisted in the store, if one is configured. Jobs
+// which were running when the server exited are adopted from their shims, or
+// marked as lost if they were not run under a shim, and queued jobs are queued
+// again.
+func (w *Worker) Restore() error {
+	if w.store == nil {
+		return nil
+	}
+	records, err := w.store.LoadJobs()
+	if err != nil {
+		return err
+	}
+
+	queued := make(map[uuid.UUID]*job)
+	var paused []uuid.UUID
+	for _, r := range records {
+		j := &job{
+			status:   r.Status,
+			stopped:  make(chan struct{}),
+			launched: make(chan struct{}),
+			created:  r.Created,
+			started:  r.Started,
+			finished: r.Finished,
+			command:  r.Command,
+		}
+		// Records persisted before jobs could be queued only have the
+		// time at which the job was created and started.
+		if j.started.IsZero() && j.status.Status != lib.QUEUED {
+			j.started = r.Created
+		}
+		// A running or paused job is adopted if its shim is still
+		// running and otherwise finished once the output it captured
+		// is copied.
+		active := j.status.Status == lib.RUNNING || j.status.Status == lib.PAUSED
+		adopt := active && r.ShimPID != 0 && w.config.DataDir != ""
+
+		config := w.bufferConfig()
+		config.outputLimit = r.Command.OutputLimit
+		if (adopt || j.status.Status == lib.QUEUED) && r.Command.KillOnOutputLimit {
+			jobID := r.ID
+			config.onLimit = func() {
+				log.WithField("jobID", jobID).Info("output limit exceeded, stopping job")
+				_ = j.kill()
+			}
+		}
+		j.output, err = restoreBuffer(config, w.store, r.ID)
+		if err != nil {
+			log.WithError(err).WithField("jobID", r.ID).Warn("failed to restore job output")
+			j.output = newBroadcastBuffer(config)
+			if !adopt && j.status.Status != lib.QUEUED {
+				_ = j.output.Close()
+			}
+		}
+
+		w.Lock()
+		w.jobs[r.ID] = j
+		w.Unlock()
+
+		switch {
+		case adopt:
+			if j.status.Status == lib.PAUSED {
+				paused = append(paused, r.ID)
+			} else {
+				w.scheduler.adopt(r.ID, requestOf(r.Command))
+			}
+			w.adoptShim(r.ID, j, r.ShimPID, r.PID)
+			log.WithField("jobID", r.ID).Info("adopted running job")
+		case j.status.Status == lib.QUEUED:
+			queued[r.ID] = j
+			continue
+		case active:
+			close(j.stopped)
+			_ = j.output.Close()
+			j.status = lib.Status{Status: lib.LOST}
+			j.finished = time.Now()
+			w.persist(r.ID, j)
+			log.WithField("jobID", r.ID).Warn("job lost on restart")
+		default:
+			close(j.stopped)
+			_ = j.output.Close()
+		}
+		if !adopt {
+			err = j.output.compact()
+			if err != nil && !errors.Is(err, lib.ErrExpired) {
+				log.WithError(err).WithField("jobID", r.ID).Error("failed to compact output")
+			}
+		}
+	}
+	// Paused jobs are resumed before queued jobs of the same class are
+	// started.
+	for _, id := range paused {
+		w.run(w.scheduler.requeue(id, requestOf(w.jobs[id].command), true))
+	}
+	w.scheduleRestored(queued)
+	log.Infof("restored %d jobs", len(records))
+	return nil
+}
@@ -0,0 +1,250 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// TestRestoreBuffer verifies that output recorded in an output log is
+// restored, whether or not the buffer was closed before the restart.
+func TestRestoreBuffer(t *testing.T) {
+	tests := []struct {
+		name        string
+		outputLimit int64
+		close       bool
+	}{
+		{"closed", 0, true},
+		{"not closed", 0, false},
+		{"truncated", 100, true},
+		{"truncated not closed", 100, false},
+	}
+	for _, store := range testStores(t) {
+		for _, test := range tests {
+			t.Run(store.name+" "+test.name, func(t *testing.T) {
+				id := uuid.NewV4()
+				l, err := store.OpenLog(id)
+				require.Nil(t, err)
+
+				b := newBroadcastBuffer(bufferConfig{outputLimit: test.outputLimit, outputLog: l})
+				for i := 0; i < 1000; i++ {
+					stream := lib.STDOUT
+					if i%3 == 0 {
+						stream = lib.STDERR
+					}
+					_, err := b.StreamWriter(stream).Write([]byte(fmt.Sprintf("line %d\n", i)))
+					require.Nil(t, err)
+				}
+				if test.close {
+					require.Nil(t, b.Close())
+				}
+
+				// The log is rewritten once it grows too large so
+				// it remains bounded by the output limit.
+				var records int
+				require.Nil(t, store.ReadLog(id, func(lib.OutputChunk) { records++ }, func(int64) { records++ }))
+				if test.outputLimit > 0 {
+					require.Less(t, records, 100)
+				}
+
+				restored, err := restoreBuffer(bufferConfig{outputLimit: test.outputLimit}, store, id)
+				require.Nil(t, err)
+				require.Nil(t, restored.Close())
+				require.Equal(t, test.outputLimit > 0, restored.isTruncated())
+				require.Equal(t, b.nextSeq(), restored.nextSeq())
+				require.Equal(t, b.totalSize(), restored.totalSize())
+
+				for _, stream := range []lib.OutputStream{lib.BOTH, lib.STDERR} {
+					opts := lib.LogOptions{Stream: stream, NoFollow: true}
+					expected, err := ioutil.ReadAll(b.NewReader(context.Background(), opts))
+					require.Nil(t, err)
+					actual, err := ioutil.ReadAll(restored.NewReader(context.Background(), opts))
+					require.Nil(t, err)
+					require.Equal(t, string(expected), string(actual))
+				}
+			})
+		}
+	}
+}
+
+// TestStores verifies that each store saves, loads and deletes job records
+// and output logs.
+func TestStores(t *testing.T) {
+	for _, store := range testStores(t) {
+		t.Run(store.name, func(t *testing.T) {
+			now := time.Now()
+			a := JobRecord{ID: uuid.NewV4(), Command: lib.Command{Command: "true"}, Status: lib.Status{Status: lib.RUNNING}, Created: now}
+			b := JobRecord{ID: uuid.NewV4(), Command: lib.Command{Command: "false"}, Status: lib.Status{Status: lib.RUNNING}, Created: now}
+			require.Nil(t, store.SaveJob(a))
+			require.Nil(t, store.SaveJob(b))
+			b.Status = lib.Status{Status: lib.COMPLETED, ExitCode: 1}
+			b.Finished = now.Add(time.Second)
+			require.Nil(t, store.SaveJob(b))
+
+			records, err := store.LoadJobs()
+			require.Nil(t, err)
+			require.Len(t, records, 2)
+			for _, r := range records {
+				expected := a
+				if r.ID == b.ID {
+					expected = b
+				}
+				require.Equal(t, expected.Command, r.Command)
+				require.Equal(t, expected.Status, r.Status)
+				require.True(t, expected.Created.Equal(r.Created))
+				require.True(t, expected.Finished.Equal(r.Finished))
+			}
+
+			// Records appended after the log is reopened follow
+			// those already in the log.
+			chunk := func(seq uint64, data string) lib.OutputChunk {
+				return lib.OutputChunk{Stream: lib.STDERR, Seq: seq, Time: now, Offset: int64(seq), Data: []byte(data)}
+			}
+			l, err := store.OpenLog(a.ID)
+			require.Nil(t, err)
+			require.Nil(t, l.AppendChunk(chunk(0, "a")))
+			require.Nil(t, l.Close())
+			l, err = store.OpenLog(a.ID)
+			require.Nil(t, err)
+			require.Nil(t, l.AppendChunk(chunk(1, "b")))
+			require.Nil(t, l.AppendSize(2))
+
+			read := func() ([]lib.OutputChunk, []int64) {
+				var chunks []lib.OutputChunk
+				var sizes []int64
+				require.Nil(t, store.ReadLog(a.ID, func(c lib.OutputChunk) {
+					chunks = append(chunks, c)
+				}, func(size int64) {
+					sizes = append(sizes, size)
+				}))
+				return chunks, sizes
+			}
+			chunks, sizes := read()
+			require.Len(t, chunks, 2)
+			require.Equal(t, "ab", string(chunks[0].Data)+string(chunks[1].Data))
+			require.Equal(t, lib.STDERR, chunks[1].Stream)
+			require.Equal(t, uint64(1), chunks[1].Seq)
+			require.Equal(t, int64(1), chunks[1].Offset)
+			require.True(t, now.Equal(chunks[1].Time))
+			require.Equal(t, []int64{2}, sizes)
+
+			require.Nil(t, l.Rewrite(func(fn func(lib.OutputChunk) error) error {
+				return fn(chunk(1, "b"))
+			}, 5))
+			require.Nil(t, l.AppendChunk(chunk(5, "c")))
+			require.Nil(t, l.Close())
+			chunks, sizes = read()
+			require.Len(t, chunks, 2)
+			require.Equal(t, "bc", string(chunks[0].Data)+string(chunks[1].Data))
+			require.Equal(t, []int64{5}, sizes)
+
+			require.Nil(t, store.DeleteLog(a.ID))
+			require.Nil(t, store.DeleteJob(a.ID))
+			chunks, sizes = read()
+			require.Empty(t, chunks)
+			require.Empty(t, sizes)
+			records, err = store.LoadJobs()
+			require.Nil(t, err)
+			require.Len(t, records, 1)
+			require.Equal(t, b.ID, records[0].ID)
+		})
+	}
+}
+
+// TestRestore verifies that persisted jobs are restored by a new Worker and
+// that jobs which were running are marked as lost.
+func TestRestore(t *testing.T) {
+	for _, store := range testStores(t) {
+		t.Run(store.name, func(t *testing.T) {
+			testRestore(t, store.Store)
+		})
+	}
+}
+
+func testRestore(t *testing.T, s Store) {
+	now := time.Now()
+
+	persist := func(status lib.Status, output string) uuid.UUID {
+		id := uuid.NewV4()
+		l, err := s.OpenLog(id)
+		require.Nil(t, err)
+		_, err = newBroadcastBuffer(bufferConfig{outputLog: l}).Write([]byte(output))
+		require.Nil(t, err)
+		require.Nil(t, s.SaveJob(JobRecord{
+			ID:      id,
+			Command: lib.Command{Command: "echo", Owner: "client_a@example.com"},
+			Status:  status,
+			Created: now,
+		}))
+		return id
+	}
+	completed := persist(lib.Status{Status: lib.COMPLETED, ExitCode: 3}, "done\n")
+	running := persist(lib.Status{Status: lib.RUNNING}, "partial\n")
+
+	w := NewWorker(Config{Store: s})
+	defer w.Close()
+	require.Nil(t, w.Restore())
+
+	status, err := w.Status(completed)
+	require.Nil(t, err)
+	require.Equal(t, lib.COMPLETED, status.Status)
+	require.Equal(t, 3, status.ExitCode)
+
+	status, err = w.Status(running)
+	require.Nil(t, err)
+	require.Equal(t, lib.LOST, status.Status)
+	require.Error(t, w.Stop(running))
+
+	r, err := w.Logs(context.Background(), running, lib.LogOptions{})
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, "partial\n", string(data))
+
+	summaries := w.List(lib.JobFilter{Statuses: []lib.StatusCode{lib.LOST}})
+	require.Len(t, summaries, 1)
+	require.Equal(t, "client_a@example.com", summaries[0].Owner)
+	require.True(t, now.Equal(summaries[0].Created))
+
+	// The lost status is itself persisted and deleted jobs are removed.
+	require.Nil(t, w.Delete(completed))
+	w = NewWorker(Config{Store: s})
+	defer w.Close()
+	require.Nil(t, w.Restore())
+	status, err = w.Status(running)
+	require.Nil(t, err)
+	require.Equal(t, lib.LOST, status.Status)
+	_, err = w.Status(completed)
+	require.Equal(t, lib.ErrNotFound, err)
+}
+
+// namedStore is a Store under test.
+type namedStore struct {
+	Store
+	name string
+}
+
+// testStores returns an empty store of each kind. The SQL store is tested
+// against SQLite.
+func testStores(t *testing.T) []namedStore {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "jobs.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	sqlStore, err := NewSQLStore(db)
+	require.Nil(t, err)
+
+	return []namedStore{
+		{NewMemoryStore(), "memory"},
+		{NewFileStore(t.TempDir()), "file"},
+		{sqlStore, "sql"},
+	}
+}
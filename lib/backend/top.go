@@ -0,0 +1,152 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// clockTicks is the number of clock ticks per second used by /proc/<pid>/stat.
+// This is the value of USER_HZ which is 100 on all supported architectures.
+const clockTicks = 100
+
+// Top returns the processes running within the job identified by jobID. If
+// the job has finished an empty list is returned.
+func (w *Worker) Top(jobID uuid.UUID) ([]lib.Process, error) {
+	job, err := w.getJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	job.statusMtx.RLock()
+	running := job.status.Status == lib.RUNNING || job.status.Status == lib.PAUSED
+	cg := job.cgroup
+	job.statusMtx.RUnlock()
+	if !running {
+		return []lib.Process{}, nil
+	}
+
+	var pids []int
+	if cg != nil {
+		pids, err = cg.processes()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list job processes: %w", err)
+		}
+	} else {
+		pids = descendants("/proc", job.pid)
+	}
+
+	processes := make([]lib.Process, 0, len(pids))
+	for _, pid := range pids {
+		p, err := readProcess("/proc", pid)
+		if err != nil {
+			// The process may have exited since the list of PIDs
+			// was read.
+			continue
+		}
+		processes = append(processes, p)
+	}
+	return processes, nil
+}
+
+// descendants returns the given PID along with the PIDs of all of its
+// descendants.
+func descendants(procDir string, pid int) []int {
+	pids := []int{pid}
+	for i := 0; i < len(pids); i++ {
+		tasks, err := ioutil.ReadDir(filepath.Join(procDir, strconv.Itoa(pids[i]), "task"))
+		if err != nil {
+			continue
+		}
+		for _, t := range tasks {
+			children, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pids[i]), "task", t.Name(), "children"))
+			if err != nil {
+				continue
+			}
+			for _, c := range strings.Fields(string(children)) {
+				child, err := strconv.Atoi(c)
+				if err == nil {
+					pids = append(pids, child)
+				}
+			}
+		}
+	}
+	return pids
+}
+
+// readProcess reads the details of the process with the given host PID from
+// procDir.
+func readProcess(procDir string, pid int) (lib.Process, error) {
+	dir := filepath.Join(procDir, strconv.Itoa(pid))
+	p := lib.Process{
+		PID:     pid,
+		HostPID: pid,
+	}
+
+	f, err := os.Open(filepath.Join(dir, "status"))
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch kv[0] {
+		case "State":
+			p.State = value
+		case "NSpid":
+			// The last PID is the PID within the innermost PID
+			// namespace i.e. that of the job.
+			ids := strings.Fields(value)
+			if len(ids) > 0 {
+				p.PID, _ = strconv.Atoi(ids[len(ids)-1])
+			}
+		case "VmRSS":
+			// VmRSS is reported in kB.
+			kb, _ := strconv.ParseUint(strings.TrimSuffix(value, " kB"), 10, 64)
+			p.RSS = kb * 1024
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return p, err
+	}
+
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return p, err
+	}
+	// The command name in the second field may contain spaces so the
+	// remaining fields are found after the closing parenthesis.
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return p, fmt.Errorf("invalid stat for pid %d", pid)
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	// utime and stime are the 14th and 15th fields of the file.
+	if len(fields) < 13 {
+		return p, fmt.Errorf("invalid stat for pid %d", pid)
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	p.CPUTime = time.Duration(utime+stime) * time.Second / clockTicks
+
+	cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil {
+		return p, err
+	}
+	p.Command = strings.TrimSpace(string(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '})))
+	return p, nil
+}
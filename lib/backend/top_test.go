@@ -0,0 +1,36 @@
+package backend
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// TestReadProcess verifies that the details of a process are read from /proc.
+func TestReadProcess(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	require.Nil(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	// The command line is that of the test until the child has exec'd.
+	var p lib.Process
+	require.Eventually(t, func() bool {
+		var err error
+		p, err = readProcess("/proc", cmd.Process.Pid)
+		return err == nil && p.Command == "sleep 10"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, cmd.Process.Pid, p.HostPID)
+	require.NotEmpty(t, p.State)
+
+	require.Contains(t, descendants("/proc", os.Getpid()), cmd.Process.Pid)
+
+	_, err := readProcess("/proc", -1)
+	require.Error(t, err)
+}
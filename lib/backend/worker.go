@@ -2,27 +2,127 @@ package backend
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"os/exec"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/thompsy/worker-api-service/lib"
 )
 
+// Config contains the configuration options of the Worker.
+type Config struct {
+	// Limits constrains the limits clients may request for their jobs.
+	Limits LimitPolicy
+
+	// CgroupRoot is the directory, within a cgroup v2 hierarchy, beneath
+	// which a cgroup is created for each job. If empty, jobs are not
+	// placed in their own cgroup and only the resource usage reported by
+	// the kernel when a job exits is available.
+	CgroupRoot string
+
+	// OutputMemoryLimit is the number of bytes of each job's output which
+	// are kept in memory. Once exceeded the oldest output is spilled to a
+	// file in OutputSpillDir. Zero means that all output is kept in
+	// memory.
+	OutputMemoryLimit int
+
+	// OutputSpillDir is the directory in which spilled output is stored.
+	// If empty the default directory for temporary files is used.
+	OutputSpillDir string
+
+	// MaxOutputBytes is the maximum output limit which may be requested
+	// for a job. If a job does not request a limit the maximum is
+	// applied. Zero means that there is no maximum.
+	MaxOutputBytes int64
+
+	// DataDir is the local directory in which jobs are run under shims
+	// so that they survive a restart of the server. Unless Store is set,
+	// jobs and their output are also persisted in this directory. If
+	// empty, jobs do not survive a restart.
+	DataDir string
+
+	// Store, if set, persists jobs and their output in place of the
+	// data directory.
+	Store Store
+
+	// MaxRunningJobs is the maximum number of jobs which may run at
+	// once. Jobs submitted once it is reached are queued until a running
+	// job finishes. Zero means that there is no limit.
+	MaxRunningJobs int
+
+	// CPUOvercommit and MemoryOvercommit are the ratios of the host's
+	// CPUs and memory which may be reserved by the limits of running
+	// jobs, e.g. 2 admits jobs whose CPU limits sum to twice the host's
+	// CPUs. Jobs which do not fit are queued until enough is released.
+	// Zero means that jobs are admitted regardless of the resources they
+	// reserve.
+	CPUOvercommit    float64
+	MemoryOvercommit float64
+
+	// Preemption determines whether, and how, a running job is preempted
+	// to make way for a queued job of a higher priority class.
+	Preemption Preemption
+
+	// PreemptionGracePeriod is the time allowed for a job preempted with
+	// PreemptRequeue to exit after it is sent SIGTERM before it is
+	// killed. If zero a default of ten seconds is used.
+	PreemptionGracePeriod time.Duration
+
+	// Quotas limits the jobs and resources of each client.
+	Quotas QuotaPolicy
+
+	// Retention determines when finished jobs are deleted.
+	Retention RetentionPolicy
+
+	// OnForget, if set, is called once a deleted job has been forgotten,
+	// after which requests for the job return lib.ErrNotFound rather
+	// than lib.ErrExpired.
+	OnForget func(jobID uuid.UUID)
+}
+
 // A Worker is a map guarded by a RWMutex which contains an entry for each
 // successfully started job.
 type Worker struct {
 	jobs map[uuid.UUID]*job
 	sync.RWMutex
+
+	// expired contains the time at which each deleted job was deleted
+	// until the job is forgotten.
+	expired map[uuid.UUID]time.Time
+
+	config Config
+
+	// store persists jobs if a store or data directory is configured,
+	// otherwise it is nil.
+	store Store
+
+	// scheduler limits the number of jobs running at once.
+	scheduler *scheduler
+
+	// hostCPU and hostMemory are the capacity of the host, in
+	// thousandths of a CPU and bytes.
+	hostCPU    int64
+	hostMemory int64
+
+	// done is closed to stop the reaper.
+	done chan struct{}
 }
 
-// A job is an exec.Cmd and its associated status and output reader.
+// A job is a process and its associated status and output reader.
 type job struct {
-	cmd *exec.Cmd
+	// pid is the PID of the job's process and kill kills it. If the job
+	// is run under a shim, shimPID is the PID of the shim.
+	pid     int
+	shimPID int
+	kill    func() error
 
 	// status is the current status of the job.
 	status    lib.Status
@@ -35,84 +135,377 @@ type job struct {
 	// after a call to Stop(). This prevents the Stop() method from
 	// returning before the actual cmd has been stopped.
 	stopped chan struct{}
+
+	// launched is closed once an attempt has been made to start a queued
+	// job and exited once the job's process has exited. Since a
+	// preempted job may be run again both are replaced each time the job
+	// is queued and started and are guarded by statusMtx.
+	launched chan struct{}
+	exited   chan struct{}
+
+	// preempted is true once the job has been stopped to make way for a
+	// job of a higher priority class. It is guarded by statusMtx.
+	preempted bool
+
+	// cgroup contains the processes of the job. It is nil if the job
+	// could not be placed in its own cgroup or is not running. Since a
+	// preempted job is given a new cgroup each time it is started it is
+	// guarded by statusMtx.
+	cgroup *cgroup
+
+	// created is the time at which the job was submitted and started
+	// the time at which it started running. started is zero while the
+	// job is queued and is guarded by statusMtx.
+	created time.Time
+	started time.Time
+
+	// finished is the time at which the job exited. It is guarded by
+	// statusMtx.
+	finished time.Time
+
+	// command is the command submitted by the client, with the output
+	// limit and the limit policy applied.
+	command lib.Command
 }
 
 // NewWorker returns a correctly initialized worker struct.
-func NewWorker() *Worker {
-	return &Worker{
-		jobs: make(map[uuid.UUID]*job),
+func NewWorker(c Config) *Worker {
+	w := &Worker{
+		jobs:      make(map[uuid.UUID]*job),
+		expired:   make(map[uuid.UUID]time.Time),
+		config:    c,
+		scheduler: newScheduler(c.MaxRunningJobs),
+		done:      make(chan struct{}),
+	}
+	w.store = c.Store
+	if w.store == nil && c.DataDir != "" {
+		w.store = NewFileStore(c.DataDir)
+	}
+	w.hostCPU, w.hostMemory = hostCapacity()
+	w.scheduler.cpuCapacity = int64(float64(w.hostCPU) * c.CPUOvercommit)
+	w.scheduler.memoryCapacity = int64(float64(w.hostMemory) * c.MemoryOvercommit)
+	if len(c.Quotas.Quotas) > 0 {
+		w.scheduler.ownerLimit = func(owner string) int {
+			q, _ := c.Quotas.quota(owner)
+			return q.MaxRunningJobs
+		}
 	}
+	go w.reaper()
+	return w
 }
 
-// Submit runs the given command in a goroutine and returns the ID of the job.
-func (w *Worker) Submit(cmdLine string) (uuid.UUID, error) {
-	if len(cmdLine) == 0 {
+// Close stops the Worker's background reaper. Running jobs are unaffected.
+func (w *Worker) Close() {
+	close(w.done)
+}
+
+// Submit runs the given command, once the concurrency limits allow, and returns
+// the ID of the job. An error wrapping lib.ErrQuotaExceeded is returned if the
+// job would exceed the quota of the client which submitted it.
+func (w *Worker) Submit(c lib.Command) (uuid.UUID, error) {
+	if len(c.Command) == 0 {
 		return uuid.Nil, fmt.Errorf("no command supplied")
 	}
-
-	cmd := exec.Command("/proc/self/exe", append([]string{"exec"}, cmdLine)...)
-	buffer := newBroadcastBuffer()
-	cmd.Stdout = buffer
-	cmd.Stderr = buffer
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Pdeathsig:    syscall.SIGKILL,
-		Cloneflags:   syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET,
-		Unshareflags: syscall.CLONE_NEWNS,
+	err := validateNetworkConfig(c)
+	if err != nil {
+		return uuid.Nil, err
 	}
-
-	j := &job{
-		cmd:     cmd,
-		output:  buffer,
-		stopped: make(chan struct{}, 1),
+	c.Limits, err = w.config.Limits.applyPolicy(c.Limits)
+	if err != nil {
+		return uuid.Nil, err
 	}
-
-	err := cmd.Start()
+	outputLimit, err := w.outputLimit(c)
 	if err != nil {
-		log.WithError(err).Errorf("failed to start job: %s", cmdLine)
 		return uuid.Nil, err
 	}
-	j.status = lib.Status{Status: lib.RUNNING}
+	for k := range c.Labels {
+		if k == "" {
+			return uuid.Nil, fmt.Errorf("label keys must not be empty")
+		}
+	}
+	if c.Priority < lib.PriorityDefault || c.Priority > lib.PriorityBatch {
+		return uuid.Nil, fmt.Errorf("unknown priority class %d", c.Priority)
+	}
+	err = w.scheduler.checkCapacity(requestOf(c))
+	if err != nil {
+		return uuid.Nil, err
+	}
+
 	jobID := uuid.NewV4()
+	j := &job{
+		status:   lib.Status{Status: lib.QUEUED},
+		stopped:  make(chan struct{}, 1),
+		launched: make(chan struct{}),
+		created:  time.Now(),
+		command:  c,
+	}
+	j.command.OutputLimit = outputLimit
+	j.command.Labels = make(map[string]string, len(c.Labels))
+	for k, v := range c.Labels {
+		j.command.Labels[k] = v
+	}
+
+	bufferConfig := w.bufferConfig()
+	bufferConfig.outputLimit = outputLimit
+	if c.KillOnOutputLimit {
+		// Output is only written once the job has started so it can
+		// always be killed.
+		bufferConfig.onLimit = func() {
+			log.WithField("jobID", jobID).Info("output limit exceeded, stopping job")
+			_ = j.kill()
+		}
+	}
+	if w.store != nil {
+		bufferConfig.outputLog, err = w.store.OpenLog(jobID)
+		if err != nil {
+			return uuid.Nil, err
+		}
+	}
+	j.output = newBroadcastBuffer(bufferConfig)
+
 	w.Lock()
-	w.jobs[jobID] = j
+	err = w.checkQuota(j.command)
+	if err == nil {
+		w.jobs[jobID] = j
+	}
 	w.Unlock()
-	log.WithField("jobID", jobID).Infof("started command: %s", cmdLine)
+	if err != nil {
+		j.output.release()
+		_ = w.unpersist(jobID)
+		return uuid.Nil, err
+	}
+	w.persist(jobID, j)
 
-	// this goroutine waits for command to complete before updating the
-	// status and closing the output buffer
-	go func() {
-		err := cmd.Wait()
+	err = w.schedule(jobID, j)
+	if err != nil {
+		w.Lock()
+		delete(w.jobs, jobID)
+		w.Unlock()
+		j.output.release()
+		_ = w.unpersist(jobID)
+		return uuid.Nil, err
+	}
+	return jobID, nil
+}
 
-		j.statusMtx.Lock()
-		if err != nil && err.Error() == "signal: killed" {
-			j.status = lib.Status{
-				Status:   lib.STOPPED,
-				ExitCode: j.cmd.ProcessState.ExitCode(),
-			}
-			log.WithField("jobID", jobID).Info("job stopped")
+// start runs the given job, which has been given a place by the scheduler.
+func (w *Worker) start(jobID uuid.UUID, j *job) error {
+	j.statusMtx.RLock()
+	launched := j.launched
+	j.statusMtx.RUnlock()
+	defer close(launched)
+
+	if w.config.CgroupRoot != "" {
+		cg, err := newCgroup(w.config.CgroupRoot, jobID)
+		if err != nil {
+			log.WithError(err).WithField("jobID", jobID).Warn("failed to create cgroup")
 		} else {
-			j.status = lib.Status{
-				Status:   lib.COMPLETED,
-				ExitCode: j.cmd.ProcessState.ExitCode(),
+			if err = cg.setLimits(j.command.Limits); err != nil {
+				log.WithError(err).WithField("jobID", jobID).Warn("failed to apply limits")
 			}
-			log.WithField("jobID", jobID).Info("job complete")
+			j.setCgroup(cg)
 		}
+	}
+	config, err := w.execConfig(jobID, j)
+	if err != nil {
+		j.removeCgroup(jobID)
+		return err
+	}
+
+	// If a data directory is configured jobs are run under a shim so
+	// that they survive a restart of the server.
+	var wait func() lib.Status
+	if w.config.DataDir != "" {
+		wait, err = w.startShim(jobID, j, config)
+	} else {
+		wait, err = startDirect(j, config)
+	}
+	if err != nil {
+		log.WithError(err).Errorf("failed to start job: %s", j.command.Command)
+		j.removeCgroup(jobID)
+		return err
+	}
+	j.statusMtx.Lock()
+	j.started = time.Now()
+	j.status = lib.Status{Status: lib.RUNNING}
+	j.statusMtx.Unlock()
+	w.persist(jobID, j)
+	log.WithField("jobID", jobID).Infof("started command: %s", j.command.Command)
+
+	w.supervise(jobID, j, wait)
+	return nil
+}
+
+// supervise waits, in a goroutine, for the given running job to exit before
+// finishing it, or requeuing it if it was preempted, and releasing its place.
+func (w *Worker) supervise(jobID uuid.UUID, j *job, wait func() lib.Status) {
+	exited := make(chan struct{})
+	j.statusMtx.Lock()
+	j.exited = exited
+	j.statusMtx.Unlock()
+
+	go func() {
+		status := wait()
+		close(exited)
+
+		j.statusMtx.Lock()
+		preempted := j.preempted
+		j.preempted = false
 		j.statusMtx.Unlock()
-		close(j.stopped)
-		buffer.Close()
+		if preempted {
+			w.requeuePreempted(jobID, j)
+			return
+		}
+		w.finish(jobID, j, status)
+		w.release(jobID)
 	}()
+}
 
-	return jobID, nil
+// execConfig returns the encoded execConfig used to run the given job,
+// identified by jobID, which joins the job's cgroup if it has one.
+func (w *Worker) execConfig(jobID uuid.UUID, j *job) ([]byte, error) {
+	c := j.command
+	hostname := c.Hostname
+	if hostname == "" {
+		hostname = strings.SplitN(jobID.String(), "-", 2)[0]
+	}
+	config := execConfig{
+		Command:  c.Command,
+		Hostname: hostname,
+		Hosts:    c.Hosts,
+		DNS:      c.DNS,
+		Limits:   c.Limits,
+	}
+	if cg := j.getCgroup(); cg != nil {
+		config.Cgroup = cg.path
+	}
+	return json.Marshal(config)
+}
+
+// startDirect runs the job described by the given execConfig as a child of the
+// server, writing its output directly to the job's output buffer. It returns a
+// function which waits for the job to exit and returns its final status.
+func startDirect(j *job, config []byte) (func() lib.Status, error) {
+	cmd := exec.Command("/proc/self/exe", "exec", string(config))
+	cmd.Stdout = j.output.StreamWriter(lib.STDOUT)
+	cmd.Stderr = j.output.StreamWriter(lib.STDERR)
+	cmd.SysProcAttr = jobSysProcAttr()
+
+	// The process is set by Start before any output can be written.
+	j.kill = func() error {
+		return cmd.Process.Kill()
+	}
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	j.pid = cmd.Process.Pid
+
+	return func() lib.Status {
+		err := cmd.Wait()
+		rusage, _ := cmd.ProcessState.SysUsage().(*syscall.Rusage)
+		status := lib.Status{
+			Status:   lib.COMPLETED,
+			ExitCode: cmd.ProcessState.ExitCode(),
+			Usage:    rusageToUsage(rusage),
+		}
+		if err != nil && err.Error() == "signal: killed" {
+			status.Status = lib.STOPPED
+		}
+		return status
+	}, nil
+}
+
+// jobSysProcAttr returns the attributes of the process in which a job is run.
+// The job is placed in its own namespaces and process group, so that it can be
+// signalled as a whole, and is killed if its parent exits.
+func jobSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Setpgid:      true,
+		Pdeathsig:    syscall.SIGKILL,
+		Cloneflags:   syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET,
+		Unshareflags: syscall.CLONE_NEWNS,
+	}
 }
 
-// Stop kills the job identified by jobID.
+// finish records the final status of a job once it has exited and closes its
+// output.
+func (w *Worker) finish(jobID uuid.UUID, j *job, status lib.Status) {
+	status.Usage = j.finalUsage(status.Usage)
+
+	j.statusMtx.Lock()
+	j.finished = time.Now()
+	j.status = status
+	j.statusMtx.Unlock()
+	switch status.Status {
+	case lib.STOPPED:
+		log.WithField("jobID", jobID).Info("job stopped")
+	case lib.LOST:
+		log.WithField("jobID", jobID).Warn("job lost")
+	default:
+		log.WithField("jobID", jobID).Info("job complete")
+	}
+	close(j.stopped)
+	j.output.Close()
+	w.persist(jobID, j)
+	if w.config.DataDir != "" {
+		w.removeShimFiles(jobID)
+	}
+
+	// Since no more output will be written it can be compressed to
+	// reduce the resources used to retain it.
+	err := j.output.compact()
+	if err != nil && !errors.Is(err, lib.ErrExpired) {
+		log.WithError(err).WithField("jobID", jobID).Error("failed to compact output")
+	}
+}
+
+// Stop kills the job identified by jobID, or removes it from the queue if it
+// has not yet started.
 func (w *Worker) Stop(jobID uuid.UUID) error {
 	job, err := w.getJob(jobID)
 	if err != nil {
 		return err
 	}
 
-	err = job.cmd.Process.Kill()
+	job.statusMtx.Lock()
+	status := job.status.Status
+	launched := job.launched
+	// A job which is being preempted is stopped rather than requeued.
+	job.preempted = false
+	job.statusMtx.Unlock()
+	if status == lib.PAUSED {
+		w.scheduler.remove(jobID)
+		err = job.kill()
+		if err != nil {
+			log.WithError(err).WithField("jobID", jobID).Error("failed to stop job")
+			return err
+		}
+		// The processes must be resumed in order to exit.
+		_ = job.unpause()
+		<-job.stopped
+		return nil
+	}
+	if status == lib.QUEUED {
+		if w.scheduler.remove(jobID) {
+			w.finish(jobID, job, lib.Status{Status: lib.STOPPED, ExitCode: -1})
+			log.WithField("jobID", jobID).Info("queued job stopped")
+			return nil
+		}
+
+		// The job has left the queue so wait for it to start, or
+		// fail to start, before stopping it.
+		<-launched
+		job.statusMtx.Lock()
+		job.preempted = false
+		status = job.status.Status
+		job.statusMtx.Unlock()
+	}
+	if status != lib.RUNNING {
+		return fmt.Errorf("job %s is not running", jobID)
+	}
+
+	err = job.kill()
 	if err != nil {
 		log.WithError(err).WithField("jobID", jobID).Error("failed to stop job")
 		return err
@@ -133,27 +526,205 @@ func (w *Worker) Status(jobID uuid.UUID) (lib.Status, error) {
 	}
 
 	job.statusMtx.RLock()
-	defer job.statusMtx.RUnlock()
-	return job.status, nil
+	status := job.status
+	job.statusMtx.RUnlock()
+
+	status.OutputTruncated = job.output.isTruncated()
+	if status.Status == lib.QUEUED || status.Status == lib.PAUSED {
+		status.QueuePosition = w.scheduler.position(jobID)
+	}
+	return status, nil
+}
+
+// List returns a summary of each job selected by the given filter, ordered by
+// the time at which the jobs were created.
+func (w *Worker) List(filter lib.JobFilter) []lib.JobSummary {
+	w.RLock()
+	summaries := make([]lib.JobSummary, 0, len(w.jobs))
+	for id, j := range w.jobs {
+		s := j.summary(id)
+		if matchesFilter(s, filter) {
+			summaries = append(summaries, s)
+		}
+	}
+	w.RUnlock()
+
+	sort.Slice(summaries, func(i, k int) bool {
+		if !summaries[i].Created.Equal(summaries[k].Created) {
+			return summaries[i].Created.Before(summaries[k].Created)
+		}
+		return summaries[i].ID < summaries[k].ID
+	})
+	return summaries
 }
 
-// Logs returns an io.Reader attached to both the stdout and stderr of the
-// job identified by jobID.
-func (w *Worker) Logs(ctx context.Context, jobID uuid.UUID) (io.Reader, error) {
+// summary returns a summary of the job, which has the given ID.
+func (j *job) summary(id uuid.UUID) lib.JobSummary {
+	j.statusMtx.RLock()
+	defer j.statusMtx.RUnlock()
+	return lib.JobSummary{
+		ID:       id.String(),
+		Command:  j.command.Command,
+		Owner:    j.command.Owner,
+		Labels:   j.command.Labels,
+		Status:   j.status.Status,
+		Created:  j.created,
+		Finished: j.finished,
+	}
+}
+
+// matchesFilter returns true if the given job is selected by the filter.
+func matchesFilter(s lib.JobSummary, f lib.JobFilter) bool {
+	if len(f.Statuses) > 0 {
+		found := false
+		for _, status := range f.Statuses {
+			if s.Status == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range f.Labels {
+		if label, ok := s.Labels[k]; !ok || label != v {
+			return false
+		}
+	}
+	if !f.CreatedAfter.IsZero() && s.Created.Before(f.CreatedAfter) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !s.Created.Before(f.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// Stats returns the resource usage of the job identified by jobID. Once the
+// job has finished the final totals are returned.
+func (w *Worker) Stats(jobID uuid.UUID) (lib.ResourceUsage, error) {
+	job, err := w.getJob(jobID)
+	if err != nil {
+		return lib.ResourceUsage{}, err
+	}
+
+	job.statusMtx.RLock()
+	status := job.status
+	cg := job.cgroup
+	started := job.started
+	job.statusMtx.RUnlock()
+	if status.Status != lib.RUNNING && status.Status != lib.PAUSED {
+		return status.Usage, nil
+	}
+
+	var usage lib.ResourceUsage
+	if cg != nil {
+		usage = cg.usage()
+	}
+	usage.WallTime = time.Since(started)
+	return usage, nil
+}
+
+// finalUsage returns the total resource usage of a job once it has exited,
+// given the usage reported by the kernel for its process, and removes its
+// cgroup.
+func (j *job) finalUsage(usage lib.ResourceUsage) lib.ResourceUsage {
+	j.statusMtx.RLock()
+	cg := j.cgroup
+	started := j.started
+	j.statusMtx.RUnlock()
+
+	if cg != nil {
+		usage = mergeUsage(cg.usage(), usage)
+		err := cg.remove()
+		if err != nil {
+			log.WithError(err).Warn("failed to remove cgroup")
+		}
+	}
+	if !started.IsZero() {
+		usage.WallTime = time.Since(started)
+	}
+	return usage
+}
+
+// getCgroup returns the cgroup of the job, if it has one.
+func (j *job) getCgroup() *cgroup {
+	j.statusMtx.RLock()
+	defer j.statusMtx.RUnlock()
+	return j.cgroup
+}
+
+// setCgroup sets the cgroup of the job.
+func (j *job) setCgroup(c *cgroup) {
+	j.statusMtx.Lock()
+	defer j.statusMtx.Unlock()
+	j.cgroup = c
+}
+
+// removeCgroup removes the cgroup of the job, if it has one, once its
+// processes have exited.
+func (j *job) removeCgroup(jobID uuid.UUID) {
+	j.statusMtx.Lock()
+	c := j.cgroup
+	j.cgroup = nil
+	j.statusMtx.Unlock()
+	if c == nil {
+		return
+	}
+	err := c.remove()
+	if err != nil {
+		log.WithError(err).WithField("jobID", jobID).Warn("failed to remove cgroup")
+	}
+}
+
+// Logs returns an OutputReader attached to the stdout and/or stderr of the
+// job identified by jobID, as selected by opts.
+func (w *Worker) Logs(ctx context.Context, jobID uuid.UUID, opts lib.LogOptions) (OutputReader, error) {
 	job, err := w.getJob(jobID)
 	if err != nil {
 		return nil, err
 	}
 
-	return job.output.NewReader(ctx), nil
+	return job.output.NewReader(ctx, opts), nil
+}
+
+// outputLimit validates the output limit requested by the given command
+// against the server's maximum and returns the limit to apply.
+func (w *Worker) outputLimit(c lib.Command) (int64, error) {
+	max := w.config.MaxOutputBytes
+	switch {
+	case c.OutputLimit < 0:
+		return 0, fmt.Errorf("output limit %d is negative", c.OutputLimit)
+	case c.OutputLimit == 0:
+		if c.KillOnOutputLimit && max == 0 {
+			return 0, fmt.Errorf("no output limit at which to stop the job")
+		}
+		return max, nil
+	case max > 0 && c.OutputLimit > max:
+		return 0, fmt.Errorf("output limit %d exceeds the maximum of %d", c.OutputLimit, max)
+	}
+	return c.OutputLimit, nil
 }
 
-// getJob returns the *job identified by jobID or ErrUnknownJob
+// bufferConfig returns the configuration of the output buffer of each job.
+func (w *Worker) bufferConfig() bufferConfig {
+	return bufferConfig{
+		memoryLimit: w.config.OutputMemoryLimit,
+		spillDir:    w.config.OutputSpillDir,
+	}
+}
+
+// getJob returns the *job identified by jobID, ErrExpired if it has been
+// deleted or ErrNotFound.
 func (w *Worker) getJob(jobID uuid.UUID) (*job, error) {
 	w.RLock()
+	defer w.RUnlock()
 	job, ok := w.jobs[jobID]
-	w.RUnlock()
 	if !ok {
+		if _, ok := w.expired[jobID]; ok {
+			return nil, lib.ErrExpired
+		}
 		return nil, lib.ErrNotFound
 	}
 	return job, nil
@@ -2,6 +2,7 @@ package backend
 
 import (
 	"context"
+	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/require"
 	"github.com/thompsy/worker-api-service/lib"
 	"io/ioutil"
@@ -27,8 +28,8 @@ const (
 // it's status and logs can be fetched.
 func TestSubmitCommand(t *testing.T) {
 	skipCI(t)
-	w := NewWorker()
-	jobID, err := w.Submit(wcCommand)
+	w := NewWorker(Config{})
+	jobID, err := w.Submit(lib.Command{Command: wcCommand})
 	require.Nil(t, err)
 
 	// Sleep for a moment to allow the command to finish.
@@ -39,7 +40,7 @@ func TestSubmitCommand(t *testing.T) {
 	require.Equal(t, 0, status.ExitCode)
 	require.Equal(t, lib.COMPLETED, status.Status)
 
-	reader, err := w.Logs(context.Background(), jobID)
+	reader, err := w.Logs(context.Background(), jobID, lib.LogOptions{})
 	require.Nil(t, err)
 
 	output, err := ioutil.ReadAll(reader)
@@ -51,8 +52,8 @@ func TestSubmitCommand(t *testing.T) {
 // status is reported correctly.
 func TestStopCommand(t *testing.T) {
 	skipCI(t)
-	w := NewWorker()
-	jobID, err := w.Submit(slowCommand)
+	w := NewWorker(Config{})
+	jobID, err := w.Submit(lib.Command{Command: slowCommand})
 	require.Nil(t, err)
 
 	status, err := w.Status(jobID)
@@ -72,15 +73,15 @@ func TestStopCommand(t *testing.T) {
 // TestConcurrentRead verifies that readers can read correctly from a slow writer.
 func TestConcurrentLogs(t *testing.T) {
 	skipCI(t)
-	w := NewWorker()
-	jobID, err := w.Submit("./test-slow-command.sh")
+	w := NewWorker(Config{})
+	jobID, err := w.Submit(lib.Command{Command: slowCommand})
 	require.Nil(t, err)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		r, err := w.Logs(context.Background(), jobID)
+		r, err := w.Logs(context.Background(), jobID, lib.LogOptions{})
 		require.Nil(t, err)
 		output, err := ioutil.ReadAll(r)
 		require.Nil(t, err)
@@ -99,15 +100,15 @@ func TestConcurrentLogs(t *testing.T) {
 
 func TestContextTimeout(t *testing.T) {
 	skipCI(t)
-	w := NewWorker()
-	jobID, err := w.Submit("./test-slow-command.sh")
+	w := NewWorker(Config{})
+	jobID, err := w.Submit(lib.Command{Command: slowCommand})
 	require.Nil(t, err)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(1*time.Second))
 	defer cancel()
 
 	go func() {
-		r, err := w.Logs(ctx, jobID)
+		r, err := w.Logs(ctx, jobID, lib.LogOptions{})
 		require.Nil(t, err)
 		_, _ = ioutil.ReadAll(r)
 	}()
@@ -120,6 +121,112 @@ func TestContextTimeout(t *testing.T) {
 	}
 }
 
+// TestQueue verifies that jobs beyond the concurrency limit are queued until a
+// running job finishes and that queued jobs can be stopped.
+func TestQueue(t *testing.T) {
+	skipCI(t)
+	w := NewWorker(Config{MaxRunningJobs: 1})
+	first, err := w.Submit(lib.Command{Command: slowCommand})
+	require.Nil(t, err)
+	second, err := w.Submit(lib.Command{Command: wcCommand})
+	require.Nil(t, err)
+	third, err := w.Submit(lib.Command{Command: wcCommand})
+	require.Nil(t, err)
+
+	status, err := w.Status(third)
+	require.Nil(t, err)
+	require.Equal(t, lib.QUEUED, status.Status)
+	require.Equal(t, 2, status.QueuePosition)
+
+	require.Nil(t, w.Stop(second))
+	status, err = w.Status(second)
+	require.Nil(t, err)
+	require.Equal(t, lib.STOPPED, status.Status)
+	status, err = w.Status(third)
+	require.Nil(t, err)
+	require.Equal(t, 1, status.QueuePosition)
+
+	require.Nil(t, w.Stop(first))
+	time.Sleep(time.Second)
+	status, err = w.Status(third)
+	require.Nil(t, err)
+	require.Equal(t, lib.COMPLETED, status.Status)
+}
+
+// TestOutputLimitPolicy verifies that requested output limits are checked
+// against the server's maximum.
+func TestOutputLimitPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int64
+		command  lib.Command
+		expected int64
+		err      bool
+	}{
+		{"no limits", 0, lib.Command{}, 0, false},
+		{"default to maximum", 100, lib.Command{}, 100, false},
+		{"below maximum", 100, lib.Command{OutputLimit: 50}, 50, false},
+		{"above maximum", 100, lib.Command{OutputLimit: 150}, 0, true},
+		{"no maximum", 0, lib.Command{OutputLimit: 150}, 150, false},
+		{"negative", 0, lib.Command{OutputLimit: -1}, 0, true},
+		{"kill without limit", 0, lib.Command{KillOnOutputLimit: true}, 0, true},
+		{"kill at maximum", 100, lib.Command{KillOnOutputLimit: true}, 100, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := NewWorker(Config{MaxOutputBytes: test.max})
+			limit, err := w.outputLimit(test.command)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, test.expected, limit)
+		})
+	}
+}
+
+// TestList verifies that jobs are listed in the order in which they were
+// created and selected by the filter.
+func TestList(t *testing.T) {
+	w := NewWorker(Config{})
+	now := time.Now()
+	add := func(created time.Duration, status lib.StatusCode, labels map[string]string) string {
+		id := uuid.NewV4()
+		w.jobs[id] = &job{
+			status:  lib.Status{Status: status},
+			created: now.Add(created),
+			command: lib.Command{Command: "true", Labels: labels},
+		}
+		return id.String()
+	}
+	a := add(-3*time.Minute, lib.COMPLETED, map[string]string{"env": "prod"})
+	b := add(-2*time.Minute, lib.RUNNING, map[string]string{"env": "prod", "team": "a"})
+	c := add(-time.Minute, lib.STOPPED, nil)
+
+	tests := []struct {
+		name     string
+		filter   lib.JobFilter
+		expected []string
+	}{
+		{"all", lib.JobFilter{}, []string{a, b, c}},
+		{"status", lib.JobFilter{Statuses: []lib.StatusCode{lib.COMPLETED, lib.STOPPED}}, []string{a, c}},
+		{"label", lib.JobFilter{Labels: map[string]string{"env": "prod"}}, []string{a, b}},
+		{"labels", lib.JobFilter{Labels: map[string]string{"env": "prod", "team": "a"}}, []string{b}},
+		{"created after", lib.JobFilter{CreatedAfter: now.Add(-2 * time.Minute)}, []string{b, c}},
+		{"created before", lib.JobFilter{CreatedBefore: now.Add(-2 * time.Minute)}, []string{a}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ids []string
+			for _, s := range w.List(test.filter) {
+				ids = append(ids, s.ID)
+			}
+			require.Equal(t, test.expected, ids)
+		})
+	}
+}
+
 // skipCI skips the current test if running in a CI environment. These tests
 // cannot be run in a non-privileged container.
 func skipCI(t *testing.T) {
@@ -7,13 +7,27 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	pb "github.com/thompsy/worker-api-service/lib/protobuf"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// maxLogReconnects is the number of consecutive times a dropped
+	// log stream is reconnected before giving up.
+	maxLogReconnects = 5
+
+	// logReconnectDelay is the initial delay before reconnecting a
+	// dropped log stream. It doubles after each failed attempt.
+	logReconnectDelay = 100 * time.Millisecond
 )
 
 // Client is a gRPC client that can connect to the worker-api and execute commands.
@@ -24,11 +38,17 @@ type Client struct {
 
 // Submit sends the given command to the server and returns the id of the resulting job.
 func (c *Client) Submit(cmd string) (string, error) {
-	response, err := c.client.Submit(context.Background(), &pb.Command{
+	return c.SubmitCommand(&pb.Command{
 		Command: cmd,
 	})
+}
+
+// SubmitCommand sends the given command, along with any configuration of the
+// job's environment, to the server and returns the id of the resulting job.
+func (c *Client) SubmitCommand(cmd *pb.Command) (string, error) {
+	response, err := c.client.Submit(context.Background(), cmd)
 	if err != nil {
-		return "", fmt.Errorf("failed to start command %s: %w", cmd, err)
+		return "", fmt.Errorf("failed to start command %s: %w", cmd.Command, err)
 	}
 	return response.Id, nil
 }
@@ -46,6 +66,19 @@ func (c *Client) Stop(jobID string) error {
 	return nil
 }
 
+// Delete deletes the finished job identified by the given jobID along with its
+// output.
+func (c *Client) Delete(jobID string) error {
+	req := &pb.JobId{
+		Id: jobID,
+	}
+	_, err := c.client.Delete(context.Background(), req)
+	if err != nil {
+		return fmt.Errorf("failed to delete job %s: %w", jobID, err)
+	}
+	return nil
+}
+
 // Status returns the status of the job identified by the given jobID.
 func (c *Client) Status(jobID string) (*pb.StatusResponse, error) {
 	req := &pb.JobId{
@@ -59,14 +92,93 @@ func (c *Client) Status(jobID string) (*pb.StatusResponse, error) {
 	return resp, nil
 }
 
+// Stats returns the resource usage of the job identified by the given jobID.
+func (c *Client) Stats(jobID string) (*pb.ResourceUsage, error) {
+	req := &pb.JobId{
+		Id: jobID,
+	}
+	resp, err := c.client.Stats(context.Background(), req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats for id %s: %w", jobID, err)
+	}
+	return resp, nil
+}
+
+// StreamStats calls fn with the resource usage of the job identified by the
+// given jobID each time it is received from the server. It returns once the
+// job has finished and the final usage has been received.
+func (c *Client) StreamStats(jobID string, fn func(*pb.ResourceUsage)) error {
+	req := &pb.JobId{
+		Id: jobID,
+	}
+	stream, err := c.client.StreamStats(context.Background(), req)
+	if err != nil {
+		return fmt.Errorf("failed to get stats for id %s: %w", jobID, err)
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(resp)
+	}
+}
+
+// Top returns the processes running within the job identified by the given jobID.
+func (c *Client) Top(jobID string) ([]*pb.Process, error) {
+	req := &pb.JobId{
+		Id: jobID,
+	}
+	resp, err := c.client.Top(context.Background(), req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get processes for id %s: %w", jobID, err)
+	}
+	return resp.Processes, nil
+}
+
+// ListJobs returns a page of the jobs selected by the given request.
+func (c *Client) ListJobs(req *pb.ListJobsRequest) (*pb.ListJobsResponse, error) {
+	resp, err := c.client.ListJobs(context.Background(), req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	return resp, nil
+}
+
+// GetQuota returns the quota, and its usage, of the given client or, if empty,
+// of this client.
+func (c *Client) GetQuota(identity string) (*pb.QuotaResponse, error) {
+	resp, err := c.client.GetQuota(context.Background(), &pb.QuotaRequest{Identity: identity})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quota: %w", err)
+	}
+	return resp, nil
+}
+
+// NodeInfo returns the capacity of the server's host, the resources reserved
+// by its jobs and its current usage.
+func (c *Client) NodeInfo() (*pb.NodeInfoResponse, error) {
+	resp, err := c.client.NodeInfo(context.Background(), &pb.Empty{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node info: %w", err)
+	}
+	return resp, nil
+}
+
 // GetLogs fetches the logs from the server and writes them to an io.Pipe.
-// The io.PipeReader is returned to the client for consumption.
+// The io.PipeReader is returned to the client for consumption. If the
+// connection to the server drops the logs are resumed from where they
+// stopped.
 func (c *Client) GetLogs(jobID string) (io.Reader, error) {
-	req := &pb.JobId{
+	req := &pb.LogsRequest{
 		Id: jobID,
 	}
 
-	stream, err := c.client.GetLogs(context.Background(), req)
+	recv, err := c.openLogs(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get logs for id: %s: %w", jobID, err)
 	}
@@ -74,25 +186,188 @@ func (c *Client) GetLogs(jobID string) (io.Reader, error) {
 	reader, writer := io.Pipe()
 
 	go func() {
-		for {
-			resp, err := stream.Recv()
-			if err == io.EOF {
-				_ = writer.Close()
-				return
+		err := c.receive(req, recv, c.openLogs, func(m offsetMessage) error {
+			_, err := writer.Write([]byte(m.(*pb.Log).GetLogLine() + "\n"))
+			return err
+		})
+		_ = writer.CloseWithError(err)
+	}()
+	return reader, nil
+}
+
+// StreamLogs fetches the logs selected by the given request from the server
+// and calls fn with each log line as it is received. It returns once all of
+// the logs have been received or fn returns an error. If the connection to
+// the server drops the logs are resumed from where they stopped.
+func (c *Client) StreamLogs(req *pb.LogsRequest, fn func(*pb.Log) error) error {
+	recv, err := c.openLogs(req)
+	if err != nil {
+		return fmt.Errorf("failed to get logs for id: %s: %w", req.Id, err)
+	}
+	return c.receive(req, recv, c.openLogs, func(m offsetMessage) error {
+		return fn(m.(*pb.Log))
+	})
+}
+
+// GetOutput fetches the raw output of the job identified by the given jobID
+// and writes everything written by the job to stdout and stderr to the
+// corresponding writer, byte-for-byte. It returns once the job has finished
+// and all of its output has been written. If the connection to the server
+// drops the output is resumed from where it stopped.
+func (c *Client) GetOutput(jobID string, stdout, stderr io.Writer) error {
+	req := &pb.LogsRequest{
+		Id: jobID,
+	}
+	return c.StreamOutput(req, func(chunk *pb.OutputChunk) error {
+		w := stdout
+		if chunk.Stream == pb.OutputStream_STDERR {
+			w = stderr
+		}
+		_, err := w.Write(chunk.Data)
+		return err
+	})
+}
+
+// StreamOutput fetches the raw output selected by the given request from the
+// server and calls fn with each chunk of output as it is received. It
+// returns once all of the output has been received or fn returns an error.
+// If the connection to the server drops the output is resumed from where it
+// stopped.
+func (c *Client) StreamOutput(req *pb.LogsRequest, fn func(*pb.OutputChunk) error) error {
+	recv, err := c.openOutput(req)
+	if err != nil {
+		return fmt.Errorf("failed to get output for id: %s: %w", req.Id, err)
+	}
+	return c.receive(req, recv, c.openOutput, func(m offsetMessage) error {
+		return fn(m.(*pb.OutputChunk))
+	})
+}
+
+// offsetMessage is a message containing output which records the offset in
+// the job's output immediately after that output.
+type offsetMessage interface {
+	GetOffset() int64
+}
+
+// receiver returns the next message from a stream.
+type receiver func() (offsetMessage, error)
+
+// openLogs opens a GetLogs stream for the given request.
+func (c *Client) openLogs(req *pb.LogsRequest) (receiver, error) {
+	stream, err := c.client.GetLogs(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	return func() (offsetMessage, error) {
+		return stream.Recv()
+	}, nil
+}
+
+// openOutput opens a GetOutput stream for the given request.
+func (c *Client) openOutput(req *pb.LogsRequest) (receiver, error) {
+	stream, err := c.client.GetOutput(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	return func() (offsetMessage, error) {
+		return stream.Recv()
+	}, nil
+}
+
+// receive calls fn with each message received from recv until the stream
+// ends. If the stream is dropped before it ends a new stream is opened using
+// open, starting from the offset of the last message received.
+func (c *Client) receive(req *pb.LogsRequest, recv receiver, open func(*pb.LogsRequest) (receiver, error), fn func(offsetMessage) error) error {
+	// Take a copy so that the caller's request is not modified when
+	// resuming.
+	req = proto.Clone(req).(*pb.LogsRequest)
+
+	reconnects := 0
+	for {
+		resp, err := recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if status.Code(err) != codes.Unavailable || reconnects >= maxLogReconnects {
+				return err
 			}
+			time.Sleep(logReconnectDelay << reconnects)
+			reconnects++
+			log.WithError(err).Infof("%s: stream dropped, resuming from offset %d", req.Id, req.Offset)
+
+			next, err := open(req)
 			if err != nil {
-				_ = writer.CloseWithError(err)
-				return
+				// Report the error from the next call to recv so that
+				// opening the stream is retried in the same way.
+				openErr := err
+				next = func() (offsetMessage, error) {
+					return nil, openErr
+				}
 			}
-			line := resp.GetLogLine()
-			_, err = writer.Write([]byte(line + "\n"))
-			if err != nil {
-				_ = writer.CloseWithError(err)
-				return
+			recv = next
+			continue
+		}
+
+		reconnects = 0
+		req.Offset = resp.GetOffset()
+
+		// The offset alone determines where a resumed stream starts.
+		// Were the tail and start time kept the server would apply
+		// them to the output as it is when the stream is resumed,
+		// skipping any output written while disconnected.
+		req.TailLines = 0
+		req.SinceUnixNano = 0
+		err = fn(resp)
+		if err != nil {
+			return err
+		}
+
+		// Ensure that a resumed GetLogs stream does not return more
+		// lines than were requested in total.
+		if _, ok := resp.(*pb.Log); ok && req.MaxLines > 0 {
+			req.MaxLines--
+			if req.MaxLines == 0 {
+				return nil
 			}
 		}
-	}()
-	return reader, nil
+	}
+}
+
+// Exec runs the given command inside the namespaces of the running job
+// identified by jobID. The stdout and stderr of the command are written to the
+// respective writers and its exit code is returned once it has finished.
+func (c *Client) Exec(jobID string, argv []string, stdout, stderr io.Writer) (int, error) {
+	req := &pb.ExecRequest{
+		JobId: jobID,
+		Argv:  argv,
+	}
+
+	stream, err := c.client.Exec(context.Background(), req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to exec in id: %s: %w", jobID, err)
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return 0, fmt.Errorf("exec stream for id %s ended without an exit code", jobID)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if resp.GetExited() {
+			return int(resp.GetExitCode()), nil
+		}
+		w := stdout
+		if resp.GetStream() == pb.OutputStream_STDERR {
+			w = stderr
+		}
+		_, err = w.Write(resp.GetData())
+		if err != nil {
+			return 0, err
+		}
+	}
 }
 
 // Close closes the connection to the server.
@@ -132,6 +407,10 @@ func NewClient(address, caCertFile, clientCertFile, clientKeyFile string) (*Clie
 
 	opts := []grpc.DialOption{
 		grpc.WithTransportCredentials(credentials.NewTLS(config)),
+		// Calls rejected because the client exceeded its rate limit
+		// are retried once the server allows.
+		grpc.WithUnaryInterceptor(retryUnaryInterceptor),
+		grpc.WithStreamInterceptor(retryStreamInterceptor),
 	}
 
 	//todo: think about timeouts again
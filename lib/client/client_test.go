@@ -0,0 +1,48 @@
+package client
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/thompsy/worker-api-service/lib/protobuf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestReceiveResume verifies that a dropped stream is resumed from the offset
+// of the last message received without reapplying the tail or start time.
+func TestReceiveResume(t *testing.T) {
+	req := &pb.LogsRequest{Id: "job", TailLines: 5, SinceUnixNano: 100}
+	messages := []*pb.Log{{LogLine: "a", Offset: 2}, {LogLine: "b", Offset: 4}}
+	recv := func() (offsetMessage, error) {
+		if len(messages) == 0 {
+			return nil, status.Error(codes.Unavailable, "dropped")
+		}
+		m := messages[0]
+		messages = messages[1:]
+		return m, nil
+	}
+
+	var resumed *pb.LogsRequest
+	open := func(r *pb.LogsRequest) (receiver, error) {
+		resumed = r
+		return func() (offsetMessage, error) {
+			return nil, io.EOF
+		}, nil
+	}
+
+	var lines []string
+	err := (&Client{}).receive(req, recv, open, func(m offsetMessage) error {
+		lines = append(lines, m.(*pb.Log).LogLine)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"a", "b"}, lines)
+	require.Equal(t, int64(4), resumed.Offset)
+	require.Zero(t, resumed.TailLines)
+	require.Zero(t, resumed.SinceUnixNano)
+
+	// The caller's request is not modified.
+	require.Equal(t, int64(5), req.TailLines)
+}
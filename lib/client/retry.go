@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thompsy/worker-api-service/lib"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// maxRateLimitRetries is the number of times a call rejected because
+	// the client exceeded its rate limit is retried before giving up.
+	maxRateLimitRetries = 5
+
+	// maxRetryAfter is the longest time for which the client waits to
+	// retry a rate limited call, regardless of the server's hint.
+	maxRetryAfter = time.Minute
+)
+
+// retryAfter returns the time after which the server asked for the call which
+// failed with the given error and trailer to be retried. It returns false if
+// the call was not rejected because the client exceeded its rate limit.
+func retryAfter(err error, trailer metadata.MD) (time.Duration, bool) {
+	if status.Code(err) != codes.ResourceExhausted {
+		return 0, false
+	}
+	values := trailer.Get(lib.RetryAfterKey)
+	if len(values) == 0 {
+		// Other exhausted resources, such as quotas, are not
+		// released by waiting.
+		return 0, false
+	}
+	wait, err := time.ParseDuration(values[0])
+	if err != nil || wait < 0 {
+		return 0, false
+	}
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait, true
+}
+
+// sleep waits for the given duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryUnaryInterceptor retries unary calls which are rate limited once the
+// time given by the server has passed.
+func retryUnaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	for attempt := 0; ; attempt++ {
+		var trailer metadata.MD
+		err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Trailer(&trailer))...)
+		wait, ok := retryAfter(err, trailer)
+		if !ok || attempt >= maxRateLimitRetries {
+			return err
+		}
+		log.Infof("%s: rate limited, retrying after %s", method, wait)
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// retryStreamInterceptor retries server streaming calls which are rate
+// limited once the time given by the server has passed. Since the server
+// rejects a stream before sending any messages the stream is only retried if
+// none have been received.
+func retryStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil || desc.ClientStreams {
+		return stream, err
+	}
+	return &retryStream{
+		ClientStream: stream,
+		ctx:          ctx,
+		method:       method,
+		open: func() (grpc.ClientStream, error) {
+			return streamer(ctx, desc, cc, method, opts...)
+		},
+	}, nil
+}
+
+// retryStream is a server streaming grpc.ClientStream which is reopened if it
+// is rejected because the client exceeded its rate limit.
+type retryStream struct {
+	grpc.ClientStream
+
+	// ctx is the context of the call, which unlike that of the stream is
+	// not done once the stream fails, and open reopens the stream.
+	ctx    context.Context
+	method string
+	open   func() (grpc.ClientStream, error)
+
+	// req is the request sent on the stream and received is true once a
+	// message has been received.
+	req      interface{}
+	received bool
+}
+
+// SendMsg sends the request on the stream, recording it so that it can be sent
+// again if the stream is reopened.
+func (s *retryStream) SendMsg(m interface{}) error {
+	s.req = m
+	return s.ClientStream.SendMsg(m)
+}
+
+// RecvMsg receives the next message from the stream, reopening the stream if
+// it is rate limited before any message has been received.
+func (s *retryStream) RecvMsg(m interface{}) error {
+	for attempt := 0; ; attempt++ {
+		err := s.ClientStream.RecvMsg(m)
+		if err == nil {
+			s.received = true
+			return nil
+		}
+		if s.received || s.req == nil {
+			return err
+		}
+		wait, ok := retryAfter(err, s.ClientStream.Trailer())
+		if !ok || attempt >= maxRateLimitRetries {
+			return err
+		}
+		log.Infof("%s: rate limited, retrying after %s", s.method, wait)
+		if err := sleep(s.ctx, wait); err != nil {
+			return err
+		}
+
+		stream, err := s.open()
+		if err != nil {
+			return err
+		}
+		err = stream.SendMsg(s.req)
+		if err == nil {
+			err = stream.CloseSend()
+		}
+		if err != nil {
+			return err
+		}
+		s.ClientStream = stream
+	}
+}
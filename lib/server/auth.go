@@ -18,16 +18,60 @@ var lock sync.RWMutex
 //todo we could add a group() function
 // isAuthorized returns true if the given clientID is authorized to access the jobID.
 func isAuthorized(clientID *string, jobID string) bool {
-	if *clientID == "admin@example.com" {
+	if isAdmin(clientID) {
 		return true
 	}
+	owningClientID, ok := jobOwner(jobID)
+	if !ok {
+		return false
+	}
+	return *clientID == owningClientID
+}
+
+// isAdmin returns true if the given clientID is authorized to access every job.
+func isAdmin(clientID *string) bool {
+	return *clientID == "admin@example.com"
+}
+
+// mayUsePriority returns true if the given clientID may submit jobs with the
+// given priority class under the given policy.
+func mayUsePriority(priorities map[string][]lib.Priority, clientID string, p lib.Priority) bool {
+	if priorities == nil || p == lib.PriorityDefault || isAdmin(&clientID) {
+		return true
+	}
+	for _, id := range []string{clientID, "*"} {
+		for _, allowed := range priorities[id] {
+			if allowed == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jobOwner returns the clientID of the client which submitted the jobID.
+func jobOwner(jobID string) (string, bool) {
 	lock.RLock()
+	defer lock.RUnlock()
 	owningClientID, ok := jobs[jobID]
-	lock.RUnlock()
 	if !ok {
-		return false
+		return "", false
 	}
-	return *clientID == *owningClientID
+	return *owningClientID, true
+}
+
+// recordOwner records that the clientID submitted the jobID.
+func recordOwner(jobID, clientID string) {
+	lock.Lock()
+	jobs[jobID] = &clientID
+	lock.Unlock()
+}
+
+// forgetOwner removes the record of the client which submitted the jobID.
+func forgetOwner(jobID string) {
+	lock.Lock()
+	delete(jobs, jobID)
+	lock.Unlock()
 }
 
 // getClientCertSerialNumber extracts the TLS certificate number from client certificate.
@@ -61,21 +105,48 @@ func unaryAuthorizationInterceptor(ctx context.Context, req interface{}, info *g
 	if info.FullMethod == "/protobuf.WorkerService/Submit" {
 		h, err := handler(ctx, req)
 		if err == nil {
-			jobID := h.(*pb.JobId).Id
-			lock.Lock()
-			jobs[jobID] = clientID
-			lock.Unlock()
+			recordOwner(h.(*pb.JobId).Id, *clientID)
 		}
 		return h, err
 	}
 
-	jobID := req.(*pb.JobId).Id
-	if !isAuthorized(clientID, jobID) {
+	// any client may list jobs but only those jobs which it is authorized
+	// to access are returned.
+	if info.FullMethod == "/protobuf.WorkerService/ListJobs" {
+		return handler(ctx, req)
+	}
+
+	// any client may get its own quota, only the admin that of another
+	// client.
+	if info.FullMethod == "/protobuf.WorkerService/GetQuota" {
+		return handler(ctx, req)
+	}
+
+	// any client may get the capacity and usage of the node.
+	if info.FullMethod == "/protobuf.WorkerService/NodeInfo" {
+		return handler(ctx, req)
+	}
+
+	jobID, ok := requestJobID(req)
+	if !ok || !isAuthorized(clientID, jobID) {
 		return nil, lib.ErrNotFound
 	}
 	return handler(ctx, req)
 }
 
+// requestJobID returns the ID of the job which the given request refers to.
+func requestJobID(req interface{}) (string, bool) {
+	switch r := req.(type) {
+	case *pb.JobId:
+		return r.Id, true
+	case *pb.ExecRequest:
+		return r.JobId, true
+	case *pb.LogsRequest:
+		return r.Id, true
+	}
+	return "", false
+}
+
 // authorizationStreamWrapper is a wrapper around a grpc.ServerStream which implements basic authorization
 // checking before beginning to stream.
 type authorizationStreamWrapper struct {
@@ -89,12 +160,15 @@ func (l authorizationStreamWrapper) RecvMsg(m interface{}) error {
 	if err != nil {
 		return err
 	}
-	jobID := m.(*pb.JobId)
+	jobID, ok := requestJobID(m)
+	if !ok {
+		return lib.ErrNotFound
+	}
 	clientID, err := clientIdentity(l.ServerStream.Context())
 	if err != nil {
 		return lib.ErrNotFound
 	}
-	if !isAuthorized(clientID, jobID.Id) {
+	if !isAuthorized(clientID, jobID) {
 		return lib.ErrNotFound
 	}
 	return nil
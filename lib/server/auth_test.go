@@ -0,0 +1,37 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// TestMayUsePriority verifies that clients may only submit jobs with the
+// priority classes permitted for them.
+func TestMayUsePriority(t *testing.T) {
+	priorities := map[string][]lib.Priority{
+		"*":                 {lib.PriorityBatch},
+		"alice@example.com": {lib.PriorityInteractive},
+	}
+	tests := []struct {
+		name       string
+		priorities map[string][]lib.Priority
+		clientID   string
+		priority   lib.Priority
+		expected   bool
+	}{
+		{"no policy", nil, "bob@example.com", lib.PriorityInteractive, true},
+		{"default", priorities, "bob@example.com", lib.PriorityDefault, true},
+		{"every client", priorities, "bob@example.com", lib.PriorityBatch, true},
+		{"not permitted", priorities, "bob@example.com", lib.PriorityInteractive, false},
+		{"permitted client", priorities, "alice@example.com", lib.PriorityInteractive, true},
+		{"permitted client every client", priorities, "alice@example.com", lib.PriorityBatch, true},
+		{"admin", priorities, "admin@example.com", lib.PriorityInteractive, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, mayUsePriority(test.priorities, test.clientID, test.priority))
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// lineFilter selects log lines using regular expressions.
+type lineFilter struct {
+	// include contains the patterns of which a line must match at least
+	// one. If empty all lines are included.
+	include []*regexp.Regexp
+
+	// exclude contains the patterns none of which a line may match.
+	exclude []*regexp.Regexp
+}
+
+// newLineFilter compiles the given include and exclude patterns into a
+// lineFilter.
+func newLineFilter(include, exclude []string) (*lineFilter, error) {
+	f := &lineFilter{}
+	for _, p := range include {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern %q: %w", p, err)
+		}
+		f.include = append(f.include, re)
+	}
+	for _, p := range exclude {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", p, err)
+		}
+		f.exclude = append(f.exclude, re)
+	}
+	return f, nil
+}
+
+// match returns true if the given line is selected by the filter.
+func (f *lineFilter) match(text string) bool {
+	for _, re := range f.exclude {
+		if re.MatchString(text) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
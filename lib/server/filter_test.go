@@ -0,0 +1,39 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLineFilter verifies that lines are selected by the include and exclude
+// patterns.
+func TestLineFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		text     string
+		expected bool
+	}{
+		{"no patterns", nil, nil, "anything", true},
+		{"include match", []string{"^error"}, nil, "error: failed", true},
+		{"include no match", []string{"^error"}, nil, "warning: error", false},
+		{"any include", []string{"^error", "^warning"}, nil, "warning: error", true},
+		{"exclude match", nil, []string{"debug"}, "debug: value", false},
+		{"exclude no match", nil, []string{"debug"}, "info: value", true},
+		{"exclude wins", []string{"value"}, []string{"debug"}, "debug: value", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := newLineFilter(test.include, test.exclude)
+			require.Nil(t, err)
+			require.Equal(t, test.expected, f.match(test.text))
+		})
+	}
+
+	_, err := newLineFilter([]string{"("}, nil)
+	require.Error(t, err)
+	_, err = newLineFilter(nil, []string{"["})
+	require.Error(t, err)
+}
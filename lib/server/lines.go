@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/thompsy/worker-api-service/lib"
+	"github.com/thompsy/worker-api-service/lib/backend"
+)
+
+// line is a single line of output written by a job to a stream. The
+// sequence number and time are those of the chunk in which the line started.
+// The offset is the position in the output from which reading must resume for
+// no line after this one to be lost. It is the position immediately after the
+// line unless a line of the other stream was still being written, in which case
+// it is where that line started, and lines already returned may be repeated.
+type line struct {
+	stream lib.OutputStream
+	seq    uint64
+	time   time.Time
+	offset int64
+	text   string
+}
+
+// lineReader splits the output read from a backend.OutputReader into lines.
+// The output of each stream is split separately so that partial lines
+// written to stdout and stderr are never merged.
+type lineReader struct {
+	reader backend.OutputReader
+
+	// partial contains the incomplete final line of each stream.
+	partial map[lib.OutputStream]line
+
+	// from contains, for the incomplete line of each stream, the
+	// position from which output must be read for it to be returned
+	// whole. Since a line of the other stream may have been incomplete
+	// when it started this is not necessarily the line's own start.
+	from map[lib.OutputStream]int64
+
+	// pending contains complete lines which have not yet been returned.
+	pending []line
+
+	// eof is true once the reader has returned io.EOF.
+	eof bool
+}
+
+// newLineReader returns a lineReader which reads from the given reader.
+func newLineReader(r backend.OutputReader) *lineReader {
+	return &lineReader{
+		reader:  r,
+		partial: make(map[lib.OutputStream]line),
+		from:    make(map[lib.OutputStream]int64),
+	}
+}
+
+// next returns the next line of output. Once all output has been read, any
+// unterminated lines are returned followed by io.EOF.
+func (l *lineReader) next() (line, error) {
+	for len(l.pending) == 0 {
+		if l.eof {
+			return line{}, io.EOF
+		}
+
+		c, err := l.reader.ReadChunk()
+		if err == io.EOF {
+			l.eof = true
+			l.flush(lib.STDOUT)
+			l.flush(lib.STDERR)
+			continue
+		}
+		if err != nil {
+			return line{}, err
+		}
+
+		l.split(c)
+	}
+
+	next := l.pending[0]
+	l.pending = l.pending[1:]
+	return next, nil
+}
+
+// split adds the complete lines in the given chunk to the pending lines and
+// retains any incomplete final line until the rest of it is read.
+func (l *lineReader) split(c lib.OutputChunk) {
+	data := c.Data
+	offset := c.Offset
+	for len(data) > 0 {
+		current, ok := l.partial[c.Stream]
+		if !ok {
+			current = line{stream: c.Stream, seq: c.Seq, time: c.Time}
+			l.from[c.Stream] = l.resumeOffset(offset)
+		}
+
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			current.text += string(data)
+			current.offset = offset + int64(len(data))
+			l.partial[c.Stream] = current
+			return
+		}
+		current.text += string(data[:i])
+		delete(l.partial, c.Stream)
+		delete(l.from, c.Stream)
+		end := offset + int64(i) + 1
+		if c.Dropped > 0 {
+			// A truncation marker ends with the output it
+			// stands in for.
+			end = c.End()
+		}
+		current.offset = l.resumeOffset(end)
+		l.pending = append(l.pending, current)
+		data = data[i+1:]
+		offset += int64(i) + 1
+	}
+}
+
+// flush adds the unterminated line of the given stream, if any, to the
+// pending lines.
+func (l *lineReader) flush(stream lib.OutputStream) {
+	if current, ok := l.partial[stream]; ok {
+		delete(l.partial, stream)
+		delete(l.from, stream)
+		current.offset = l.resumeOffset(current.offset)
+		l.pending = append(l.pending, current)
+	}
+}
+
+// resumeOffset returns the position from which output must be read for the
+// output from the given position onwards to be returned without loss, which
+// is earlier if a line is incomplete.
+func (l *lineReader) resumeOffset(offset int64) int64 {
+	for _, from := range l.from {
+		if from < offset {
+			offset = from
+		}
+	}
+	return offset
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// chunkReader is a backend.OutputReader which returns a fixed list of chunks.
+type chunkReader struct {
+	chunks []lib.OutputChunk
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (r *chunkReader) ReadChunk() (lib.OutputChunk, error) {
+	if len(r.chunks) == 0 {
+		return lib.OutputChunk{}, io.EOF
+	}
+	c := r.chunks[0]
+	r.chunks = r.chunks[1:]
+	return c, nil
+}
+
+// TestLineReader verifies that output is split into lines separately for
+// each stream so that interleaved partial lines are not merged.
+func TestLineReader(t *testing.T) {
+	r := newLineReader(&chunkReader{chunks: []lib.OutputChunk{
+		{Stream: lib.STDOUT, Seq: 0, Offset: 0, Data: []byte("first ")},
+		{Stream: lib.STDERR, Seq: 1, Offset: 6, Data: []byte("warning\nerr")},
+		{Stream: lib.STDOUT, Seq: 2, Offset: 17, Data: []byte("line\nsecond line\n\nthird")},
+		{Stream: lib.STDERR, Seq: 3, Offset: 40, Data: []byte("or")},
+	}})
+
+	var lines []line
+	for {
+		l, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		lines = append(lines, l)
+	}
+
+	// Until the final stderr line is complete reading must resume from the
+	// start of the output, as that line spans the others.
+	require.Equal(t, []line{
+		{stream: lib.STDERR, seq: 1, offset: 0, text: "warning"},
+		{stream: lib.STDOUT, seq: 0, offset: 0, text: "first line"},
+		{stream: lib.STDOUT, seq: 2, offset: 0, text: "second line"},
+		{stream: lib.STDOUT, seq: 2, offset: 0, text: ""},
+		{stream: lib.STDOUT, seq: 2, offset: 0, text: "third"},
+		{stream: lib.STDERR, seq: 1, offset: 42, text: "error"},
+	}, lines)
+}
+
+// TestLineReaderResume verifies that reading resumed from the offset of any
+// line returns every following line, whole, even when a line of the other
+// stream was incomplete.
+func TestLineReaderResume(t *testing.T) {
+	chunks := []lib.OutputChunk{
+		{Stream: lib.STDOUT, Offset: 0, Data: []byte("first ")},
+		{Stream: lib.STDERR, Offset: 6, Data: []byte("warning\n")},
+		{Stream: lib.STDOUT, Offset: 14, Data: []byte("line\nsecond\n")},
+		{Stream: lib.STDERR, Offset: 26, Data: []byte("done\n")},
+		{Stream: lib.STDOUT, Offset: 31, Data: []byte("[... 9 bytes of output truncated ...]\n"), Dropped: 9},
+		{Stream: lib.STDOUT, Offset: 40, Data: []byte("last\n")},
+	}
+	lines := readLines(t, chunks, 0)
+	require.Equal(t, []int64{0, 19, 26, 31, 40, 45}, lineOffsets(lines))
+
+	for i, l := range lines {
+		resumed := readLines(t, chunks, l.offset)
+		expected := lineTexts(lines[i+1:])
+		require.GreaterOrEqual(t, len(resumed), len(expected))
+		require.Equal(t, expected, lineTexts(resumed[len(resumed)-len(expected):]))
+	}
+}
+
+// readLines returns the lines of the given output read from the given offset.
+// A truncation marker is returned whole if the offset is within the output it
+// stands in for.
+func readLines(t *testing.T, chunks []lib.OutputChunk, offset int64) []line {
+	var from []lib.OutputChunk
+	for _, c := range chunks {
+		if skip := offset - c.Offset; skip > 0 {
+			if offset >= c.End() {
+				continue
+			}
+			if c.Dropped == 0 {
+				c.Data = c.Data[skip:]
+				c.Offset = offset
+			}
+		}
+		from = append(from, c)
+	}
+
+	r := newLineReader(&chunkReader{chunks: from})
+	var lines []line
+	for {
+		l, err := r.next()
+		if err == io.EOF {
+			return lines
+		}
+		require.Nil(t, err)
+		lines = append(lines, l)
+	}
+}
+
+// lineOffsets returns the offsets of the given lines.
+func lineOffsets(lines []line) []int64 {
+	offsets := make([]int64, len(lines))
+	for i, l := range lines {
+		offsets[i] = l.offset
+	}
+	return offsets
+}
+
+// lineTexts returns the stream and text of each of the given lines.
+func lineTexts(lines []line) []string {
+	texts := make([]string, len(lines))
+	for i, l := range lines {
+		texts[i] = fmt.Sprintf("%d: %s", l.stream, l.text)
+	}
+	return texts
+}
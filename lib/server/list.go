@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+const (
+	// defaultPageSize is the number of jobs returned by ListJobs if the
+	// request does not give a page size.
+	defaultPageSize = 100
+
+	// maxPageSize is the largest number of jobs returned by ListJobs.
+	maxPageSize = 1000
+)
+
+// pageCursor identifies the last job returned by a previous ListJobs request.
+// Jobs are listed in order of their creation time and then their ID so the
+// cursor remains valid even if the job it refers to has since been removed.
+type pageCursor struct {
+	created time.Time
+	id      string
+}
+
+// encode returns the page token representing the cursor.
+func (c pageCursor) encode() string {
+	s := fmt.Sprintf("%d/%s", c.created.UnixNano(), c.id)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// before returns true if the given job is listed before or is the job
+// identified by the cursor.
+func (c pageCursor) before(s lib.JobSummary) bool {
+	if !s.Created.Equal(c.created) {
+		return s.Created.Before(c.created)
+	}
+	return s.ID <= c.id
+}
+
+// decodePageToken returns the cursor represented by the given page token. An
+// empty token returns a nil cursor.
+func decodePageToken(token string) (*pageCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page token")
+	}
+	parts := strings.SplitN(string(data), "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid page token")
+	}
+	ns, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page token")
+	}
+	return &pageCursor{created: time.Unix(0, ns), id: parts[1]}, nil
+}
+
+// paginate returns up to size of the given jobs following the cursor, which
+// may be nil, along with the page token of the next page. The token is empty
+// if there are no more jobs.
+func paginate(jobs []lib.JobSummary, cursor *pageCursor, size int) ([]lib.JobSummary, string) {
+	if size <= 0 {
+		size = defaultPageSize
+	}
+	if size > maxPageSize {
+		size = maxPageSize
+	}
+
+	start := 0
+	if cursor != nil {
+		for start < len(jobs) && cursor.before(jobs[start]) {
+			start++
+		}
+	}
+	jobs = jobs[start:]
+	if len(jobs) <= size {
+		return jobs, ""
+	}
+	page := jobs[:size]
+	last := page[len(page)-1]
+	return page, pageCursor{created: last.Created, id: last.ID}.encode()
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// TestPaginate verifies that following the page tokens returns every job
+// exactly once.
+func TestPaginate(t *testing.T) {
+	now := time.Now()
+	var jobs []lib.JobSummary
+	for i := 0; i < 7; i++ {
+		// Pairs of jobs share a creation time to check that the ID
+		// orders them.
+		jobs = append(jobs, lib.JobSummary{
+			ID:      fmt.Sprintf("job-%d", i),
+			Created: now.Add(time.Duration(i/2) * time.Second),
+		})
+	}
+
+	var listed []lib.JobSummary
+	token := ""
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 4)
+		cursor, err := decodePageToken(token)
+		require.Nil(t, err)
+		var page []lib.JobSummary
+		page, token = paginate(jobs, cursor, 2)
+		require.LessOrEqual(t, len(page), 2)
+		listed = append(listed, page...)
+		if token == "" {
+			break
+		}
+	}
+	require.Equal(t, jobs, listed)
+
+	// A cursor remains valid if the job it refers to is removed.
+	cursor, err := decodePageToken(pageCursor{created: jobs[2].Created, id: jobs[2].ID}.encode())
+	require.Nil(t, err)
+	page, token := paginate(append(jobs[:2:2], jobs[3:]...), cursor, 10)
+	require.Equal(t, jobs[3:], page)
+	require.Empty(t, token)
+
+	_, err = decodePageToken("not a token")
+	require.Error(t, err)
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/thompsy/worker-api-service/lib"
+	"github.com/thompsy/worker-api-service/lib/backend"
+)
+
+// batchOutput reads the raw output from the given reader and calls send with
+// batches of consecutive chunks written to the same stream. A batch is sent
+// once it holds at least maxSize bytes or maxDelay after its first chunk was
+// read, whichever is sooner, so that small writes are combined without
+// delaying output indefinitely. As well as the batch, send is given the
+// offset in the output immediately after the batch's last chunk, or after the
+// dropped output if that chunk is a truncation marker.
+func batchOutput(ctx context.Context, r backend.OutputReader, maxSize int, maxDelay time.Duration, send func(batch lib.OutputChunk, end int64) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Chunks are read in a separate goroutine so that a partially filled
+	// batch can be sent while waiting for more output.
+	chunks := make(chan lib.OutputChunk)
+	var readErr error
+	go func() {
+		defer close(chunks)
+		for {
+			c, err := r.ReadChunk()
+			if err != nil {
+				readErr = err
+				return
+			}
+			select {
+			case chunks <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var batch lib.OutputChunk
+	var end int64
+	var timeout <-chan time.Time
+	flush := func() error {
+		if len(batch.Data) == 0 {
+			return nil
+		}
+		err := send(batch, end)
+		batch = lib.OutputChunk{}
+		timeout = nil
+		return err
+	}
+
+	for {
+		select {
+		case c, ok := <-chunks:
+			if !ok {
+				err := flush()
+				if err != nil {
+					return err
+				}
+				if readErr == io.EOF {
+					return nil
+				}
+				return readErr
+			}
+
+			if len(batch.Data) > 0 && c.Stream != batch.Stream {
+				err := flush()
+				if err != nil {
+					return err
+				}
+			}
+			if len(batch.Data) == 0 {
+				// The data must be copied since it may be shared
+				// with the buffer holding the job's output.
+				batch = c
+				batch.Data = append([]byte(nil), c.Data...)
+				timeout = time.After(maxDelay)
+			} else {
+				batch.Data = append(batch.Data, c.Data...)
+			}
+			end = c.End()
+			if len(batch.Data) >= maxSize {
+				err := flush()
+				if err != nil {
+					return err
+				}
+			}
+
+		case <-timeout:
+			err := flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
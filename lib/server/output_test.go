@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+)
+
+// TestBatchOutput verifies that consecutive chunks written to the same stream
+// are combined up to the maximum size and that the output is otherwise
+// returned unchanged.
+func TestBatchOutput(t *testing.T) {
+	r := &chunkReader{chunks: []lib.OutputChunk{
+		{Stream: lib.STDOUT, Offset: 0, Data: []byte("\x00\x01")},
+		{Stream: lib.STDOUT, Offset: 2, Data: []byte("progress\r")},
+		{Stream: lib.STDOUT, Offset: 11, Data: []byte("long chunk")},
+		{Stream: lib.STDERR, Offset: 21, Data: []byte("no newline")},
+		{Stream: lib.STDOUT, Offset: 31, Data: []byte("\n")},
+	}}
+
+	type batch struct {
+		stream lib.OutputStream
+		data   string
+		end    int64
+	}
+	var batches []batch
+	err := batchOutput(context.Background(), r, 10, time.Minute, func(c lib.OutputChunk, end int64) error {
+		batches = append(batches, batch{stream: c.Stream, data: string(c.Data), end: end})
+		return nil
+	})
+	require.Nil(t, err)
+
+	require.Equal(t, []batch{
+		{stream: lib.STDOUT, data: "\x00\x01progress\r", end: 11},
+		{stream: lib.STDOUT, data: "long chunk", end: 21},
+		{stream: lib.STDERR, data: "no newline", end: 31},
+		{stream: lib.STDOUT, data: "\n", end: 32},
+	}, batches)
+}
+
+// TestBatchOutputMarker verifies that the offset after a truncation marker is
+// that at which the output resumes rather than one counting the marker's text.
+func TestBatchOutputMarker(t *testing.T) {
+	r := &chunkReader{chunks: []lib.OutputChunk{
+		{Stream: lib.STDOUT, Offset: 0, Data: []byte("head\n")},
+		{Stream: lib.STDOUT, Offset: 5, Data: []byte("[... 100 bytes of output truncated ...]\n"), Dropped: 100},
+		{Stream: lib.STDERR, Offset: 105, Data: []byte("tail\n")},
+	}}
+
+	var ends []int64
+	err := batchOutput(context.Background(), r, 1, time.Minute, func(c lib.OutputChunk, end int64) error {
+		ends = append(ends, end)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []int64{5, 105, 110}, ends)
+}
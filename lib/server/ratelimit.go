@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/thompsy/worker-api-service/lib"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// bucketPruneInterval is the interval at which the token buckets of clients
+// which have not made requests recently are discarded.
+const bucketPruneInterval = time.Minute
+
+// RateLimit is the rate at which a client may make requests, enforced with a
+// token bucket.
+type RateLimit struct {
+	// Rate is the number of requests per second which may be made on
+	// average. Zero means no limit.
+	Rate float64
+
+	// Burst is the number of requests which may be made at once. Values
+	// below one are treated as one.
+	Burst int
+}
+
+// burst returns the capacity of the token bucket.
+func (r RateLimit) burst() float64 {
+	if r.Burst < 1 {
+		return 1
+	}
+	return float64(r.Burst)
+}
+
+// RateLimits determines the rate at which each client may make requests.
+type RateLimits struct {
+	// Default applies to clients without a limit of their own.
+	Default RateLimit
+
+	// Clients contains the limits of individual clients, keyed by the
+	// CommonName of their certificate.
+	Clients map[string]RateLimit
+}
+
+// limit returns the rate limit of the given client.
+func (r RateLimits) limit(clientID string) RateLimit {
+	if l, ok := r.Clients[clientID]; ok {
+		return l
+	}
+	return r.Default
+}
+
+// tokenBucket holds the tokens available to a single client as of the time at
+// which it was last updated.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter limits the rate of requests made by each client.
+type rateLimiter struct {
+	limits RateLimits
+
+	mtx     sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+// newRateLimiter returns a rateLimiter which enforces the given limits.
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{limits: limits, buckets: make(map[string]*tokenBucket)}
+}
+
+// take takes a token from the bucket of the given client at the given time.
+// If none is available it returns the time after which one will be.
+func (l *rateLimiter) take(clientID string, now time.Time) (time.Duration, bool) {
+	limit := l.limits.limit(clientID)
+	if limit.Rate <= 0 {
+		return 0, true
+	}
+	burst := limit.burst()
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.prune(now)
+	b, ok := l.buckets[clientID]
+	if !ok {
+		b = &tokenBucket{tokens: burst, updated: now}
+		l.buckets[clientID] = b
+	}
+	b.tokens += now.Sub(b.updated).Seconds() * limit.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.updated = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// giveBack returns a token taken from the bucket of the given client to it,
+// for a call which was then rejected by another limit.
+func (l *rateLimiter) giveBack(clientID string) {
+	limit := l.limits.limit(clientID)
+	if limit.Rate <= 0 {
+		return
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	b, ok := l.buckets[clientID]
+	if !ok {
+		return
+	}
+	b.tokens++
+	if b.tokens > limit.burst() {
+		b.tokens = limit.burst()
+	}
+}
+
+// prune discards the buckets which have refilled since they were last used,
+// since they are equivalent to new buckets. The lock must be held by the
+// caller.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < bucketPruneInterval {
+		return
+	}
+	l.pruned = now
+	for clientID, b := range l.buckets {
+		limit := l.limits.limit(clientID)
+		if limit.Rate <= 0 || b.tokens+now.Sub(b.updated).Seconds()*limit.Rate >= limit.burst() {
+			delete(l.buckets, clientID)
+		}
+	}
+}
+
+// rateLimited returns the error with which a rate limited call fails, having
+// set the metadata which tells the client when it may retry the call.
+func rateLimited(wait time.Duration, setTrailer func(metadata.MD) error) error {
+	// The wait is rounded up so that a client which retries after it
+	// will find a token available.
+	wait = (wait + time.Millisecond - 1).Truncate(time.Millisecond)
+	_ = setTrailer(metadata.Pairs(lib.RetryAfterKey, wait.String()))
+	return status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry after %s", wait)
+}
+
+// unaryRateLimitInterceptor returns a unary interceptor which limits the rate
+// of calls made by each client, with submit applying to Submit calls only and
+// requests to every call.
+func unaryRateLimitInterceptor(submit, requests *rateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		// Clients without an identity are rejected by the
+		// authorization interceptor.
+		clientID, err := clientIdentity(ctx)
+		if err != nil {
+			return handler(ctx, req)
+		}
+		now := time.Now()
+		setTrailer := func(md metadata.MD) error {
+			return grpc.SetTrailer(ctx, md)
+		}
+		if wait, ok := requests.take(*clientID, now); !ok {
+			return nil, rateLimited(wait, setTrailer)
+		}
+		if info.FullMethod == "/protobuf.WorkerService/Submit" {
+			if wait, ok := submit.take(*clientID, now); !ok {
+				// A rejected call does not count against the
+				// limit on every call.
+				requests.giveBack(*clientID)
+				return nil, rateLimited(wait, setTrailer)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// streamRateLimitInterceptor returns a stream interceptor which limits the
+// rate at which each client opens streams.
+func streamRateLimitInterceptor(requests *rateLimiter) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		clientID, err := clientIdentity(ss.Context())
+		if err != nil {
+			return handler(srv, ss)
+		}
+		if wait, ok := requests.take(*clientID, time.Now()); !ok {
+			return rateLimited(wait, func(md metadata.MD) error {
+				ss.SetTrailer(md)
+				return nil
+			})
+		}
+		return handler(srv, ss)
+	}
+}
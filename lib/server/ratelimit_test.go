@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestRateLimiter verifies that each client may make a burst of requests and
+// then requests at the configured rate.
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(RateLimits{
+		Default: RateLimit{Rate: 2, Burst: 3},
+		Clients: map[string]RateLimit{
+			"admin@example.com": {},
+			"batch@example.com": {Rate: 1},
+		},
+	})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		_, ok := l.take("client_a@example.com", now)
+		require.True(t, ok)
+	}
+	wait, ok := l.take("client_a@example.com", now)
+	require.False(t, ok)
+	require.Equal(t, 500*time.Millisecond, wait)
+
+	// Each client has its own bucket.
+	_, ok = l.take("client_b@example.com", now)
+	require.True(t, ok)
+
+	// Tokens are added at the configured rate.
+	_, ok = l.take("client_a@example.com", now.Add(wait))
+	require.True(t, ok)
+	wait, ok = l.take("client_a@example.com", now.Add(600*time.Millisecond))
+	require.False(t, ok)
+	require.Equal(t, 400*time.Millisecond, wait)
+
+	// A client may have its own limit, including none.
+	for i := 0; i < 10; i++ {
+		_, ok = l.take("admin@example.com", now)
+		require.True(t, ok)
+	}
+	_, ok = l.take("batch@example.com", now)
+	require.True(t, ok)
+	wait, ok = l.take("batch@example.com", now)
+	require.False(t, ok)
+	require.Equal(t, time.Second, wait)
+
+	// Buckets which have refilled are discarded.
+	later := now.Add(bucketPruneInterval + time.Second)
+	_, ok = l.take("client_b@example.com", later)
+	require.True(t, ok)
+	require.Len(t, l.buckets, 1)
+}
+
+// TestUnaryRateLimitInterceptor verifies that a Submit call rejected by the
+// submit limit does not count against the limit on every call.
+func TestUnaryRateLimitInterceptor(t *testing.T) {
+	submit := newRateLimiter(RateLimits{Default: RateLimit{Rate: 0.001, Burst: 1}})
+	requests := newRateLimiter(RateLimits{Default: RateLimit{Rate: 0.001, Burst: 3}})
+	interceptor := unaryRateLimitInterceptor(submit, requests)
+
+	ctx := clientContext("client_a@example.com")
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	call := func(method string) error {
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+
+	require.NoError(t, call("/protobuf.WorkerService/Submit"))
+	for i := 0; i < 5; i++ {
+		err := call("/protobuf.WorkerService/Submit")
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	}
+
+	// Only the successful Submit call took a token from the limit on
+	// every call.
+	require.NoError(t, call("/protobuf.WorkerService/Status"))
+	require.NoError(t, call("/protobuf.WorkerService/Status"))
+	err := call("/protobuf.WorkerService/Status")
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
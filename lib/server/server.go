@@ -1,21 +1,39 @@
 package server
 
 import (
-	"bufio"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
+	"github.com/thompsy/worker-api-service/lib"
 	"github.com/thompsy/worker-api-service/lib/backend"
 	pb "github.com/thompsy/worker-api-service/lib/protobuf"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// statsInterval is the interval at which StreamStats sends resource
+	// usage.
+	statsInterval = time.Second
+
+	// outputBatchSize is the number of bytes of output after which
+	// GetOutput sends a chunk.
+	outputBatchSize = 32 * 1024
+
+	// outputBatchDelay is the longest time for which GetOutput holds
+	// output while waiting to fill a chunk.
+	outputBatchDelay = 50 * time.Millisecond
 )
 
 // Config contains the configuration options required by the Server
@@ -24,6 +42,26 @@ type Config struct {
 	ServerCertFile string
 	ServerKeyFile  string
 	Address        string
+
+	// Priorities lists the priority classes, other than the default, which
+	// each client may submit jobs with. The entry for "*" applies to every
+	// client and the admin may use any class. If nil every client may use
+	// any class.
+	Priorities map[string][]lib.Priority
+
+	// QuotaFile is the path of a JSON encoded backend.QuotaPolicy which
+	// limits the jobs and resources of each client. If empty the
+	// worker's configured quotas are used.
+	QuotaFile string
+
+	// SubmitRateLimits limits the rate at which each client may submit
+	// jobs and RequestRateLimits the rate at which each client may make
+	// any call, including Submit.
+	SubmitRateLimits  RateLimits
+	RequestRateLimits RateLimits
+
+	// Worker contains the configuration of the backend.Worker.
+	Worker backend.Config
 }
 
 // Server is a gRPC server which implements the worker-api.
@@ -36,7 +74,17 @@ type Server struct {
 
 // Submit passes the command to the worker library and returns the JobId of the resulting process.
 func (s Server) Submit(ctx context.Context, in *pb.Command) (*pb.JobId, error) {
-	jobId, err := s.worker.Submit(in.Command)
+	c := commandFromProto(in)
+	if clientID, err := clientIdentity(ctx); err == nil {
+		c.Owner = *clientID
+	}
+	if !mayUsePriority(s.Priorities, c.Owner, c.Priority) {
+		return nil, status.Errorf(codes.PermissionDenied, "priority class not permitted")
+	}
+	jobId, err := s.worker.Submit(c)
+	if errors.Is(err, lib.ErrQuotaExceeded) {
+		return nil, status.Errorf(codes.ResourceExhausted, "failed to start command %s: %s", in.Command, err)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to start command %s: %w", in.Command, err)
 	}
@@ -45,6 +93,55 @@ func (s Server) Submit(ctx context.Context, in *pb.Command) (*pb.JobId, error) {
 	}, nil
 }
 
+// commandFromProto converts the submitted pb.Command into a lib.Command.
+func commandFromProto(in *pb.Command) lib.Command {
+	c := lib.Command{
+		Command:           in.Command,
+		Hostname:          in.Hostname,
+		OutputLimit:       in.OutputLimit,
+		KillOnOutputLimit: in.KillOnOutputLimit,
+		Labels:            in.Labels,
+		Priority:          lib.Priority(in.Priority),
+		DNS: lib.DNSConfig{
+			Nameservers: in.GetDns().GetNameservers(),
+			Search:      in.GetDns().GetSearch(),
+			Options:     in.GetDns().GetOptions(),
+		},
+	}
+	for _, h := range in.Hosts {
+		c.Hosts = append(c.Hosts, lib.HostEntry{
+			IP:        h.Ip,
+			Hostnames: h.Hostnames,
+		})
+	}
+	if l := in.Limits; l != nil {
+		c.Limits = lib.Limits{
+			NoFile:     rlimitFromProto(l.Nofile),
+			Core:       rlimitFromProto(l.Core),
+			FileSize:   rlimitFromProto(l.Fsize),
+			Stack:      rlimitFromProto(l.Stack),
+			Nice:       int(l.Nice),
+			IOClass:    lib.IOClass(l.IoClass),
+			IOPriority: int(l.IoPriority),
+			CPU:        l.CpuMillis,
+			Memory:     l.MemoryBytes,
+		}
+		for _, cpu := range l.Cpus {
+			c.Limits.CPUs = append(c.Limits.CPUs, int(cpu))
+		}
+	}
+	return c
+}
+
+// rlimitFromProto converts the given pb.Rlimit, which may be nil, into a
+// lib.Rlimit.
+func rlimitFromProto(r *pb.Rlimit) *lib.Rlimit {
+	if r == nil {
+		return nil
+	}
+	return &lib.Rlimit{Soft: r.Soft, Hard: r.Hard}
+}
+
 // Stop aborts the job identified by the given JobId.
 func (s Server) Stop(ctx context.Context, in *pb.JobId) (*pb.Empty, error) {
 	jobID, err := uuid.FromString(in.Id)
@@ -58,6 +155,20 @@ func (s Server) Stop(ctx context.Context, in *pb.JobId) (*pb.Empty, error) {
 	return &pb.Empty{}, nil
 }
 
+// Delete deletes the finished job identified by the given JobId along with its
+// output.
+func (s Server) Delete(ctx context.Context, in *pb.JobId) (*pb.Empty, error) {
+	jobID, err := uuid.FromString(in.Id)
+	if err != nil {
+		return nil, err
+	}
+	err = s.worker.Delete(jobID)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Empty{}, nil
+}
+
 // Status returns the status of the job identified by the given JobId.
 func (s Server) Status(ctx context.Context, in *pb.JobId) (*pb.StatusResponse, error) {
 	jobID, err := uuid.FromString(in.Id)
@@ -69,37 +180,344 @@ func (s Server) Status(ctx context.Context, in *pb.JobId) (*pb.StatusResponse, e
 		return nil, fmt.Errorf("failed to get status for jobId: %s: %w", in.Id, err)
 	}
 
-	return &pb.StatusResponse{
-		Status:   pb.StatusResponse_StatusType(status.Status),
-		ExitCode: int32(status.ExitCode),
+	resp := &pb.StatusResponse{
+		Status:          pb.StatusResponse_StatusType(status.Status),
+		ExitCode:        int32(status.ExitCode),
+		OutputTruncated: status.OutputTruncated,
+		QueuePosition:   int32(status.QueuePosition),
+	}
+	// The usage of a job lost on restart is unknown.
+	if status.Status == lib.COMPLETED || status.Status == lib.STOPPED {
+		resp.Usage = usageToProto(status.Usage)
+	}
+	return resp, nil
+}
+
+// Stats returns the resource usage of the job identified by the given JobId.
+func (s Server) Stats(ctx context.Context, in *pb.JobId) (*pb.ResourceUsage, error) {
+	jobID, err := uuid.FromString(in.Id)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := s.worker.Stats(jobID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats for jobId: %s: %w", in.Id, err)
+	}
+	return usageToProto(usage), nil
+}
+
+// StreamStats streams the resource usage of the job identified by the given
+// JobId every statsInterval until the job has finished, including while it is
+// queued or paused. The final message
+// contains the total resource usage of the job.
+func (s Server) StreamStats(in *pb.JobId, stream pb.WorkerService_StreamStatsServer) error {
+	jobID, err := uuid.FromString(in.Id)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		status, err := s.worker.Status(jobID)
+		if err != nil {
+			return fmt.Errorf("failed to get stats for jobId: %s: %w", in.Id, err)
+		}
+		usage, err := s.worker.Stats(jobID)
+		if err != nil {
+			return fmt.Errorf("failed to get stats for jobId: %s: %w", in.Id, err)
+		}
+		err = stream.Send(usageToProto(usage))
+		if err != nil {
+			return fmt.Errorf("unable to stream stats for jobId %s: %w", in.Id, err)
+		}
+		// A queued or paused job is streamed until it has run to
+		// completion.
+		if status.Status != lib.RUNNING && status.Status != lib.QUEUED && status.Status != lib.PAUSED {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// Top returns the processes running within the job identified by the given JobId.
+func (s Server) Top(ctx context.Context, in *pb.JobId) (*pb.TopResponse, error) {
+	jobID, err := uuid.FromString(in.Id)
+	if err != nil {
+		return nil, err
+	}
+	processes, err := s.worker.Top(jobID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get processes for jobId: %s: %w", in.Id, err)
+	}
+
+	resp := &pb.TopResponse{}
+	for _, p := range processes {
+		resp.Processes = append(resp.Processes, &pb.Process{
+			Pid:         int32(p.PID),
+			HostPid:     int32(p.HostPID),
+			Command:     p.Command,
+			State:       p.State,
+			CpuTimeUsec: p.CPUTime.Microseconds(),
+			RssBytes:    p.RSS,
+		})
+	}
+	return resp, nil
+}
+
+// ListJobs returns a page of the jobs selected by the request which the client
+// is authorized to access.
+func (s Server) ListJobs(ctx context.Context, in *pb.ListJobsRequest) (*pb.ListJobsResponse, error) {
+	clientID, err := clientIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := decodePageToken(in.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := lib.JobFilter{
+		Labels:        in.Labels,
+		CreatedAfter:  timeFromUnixNano(in.CreatedAfterUnixNano),
+		CreatedBefore: timeFromUnixNano(in.CreatedBeforeUnixNano),
+	}
+	for _, status := range in.Statuses {
+		filter.Statuses = append(filter.Statuses, lib.StatusCode(status))
+	}
+
+	var jobs []lib.JobSummary
+	for _, j := range s.worker.List(filter) {
+		if !isAuthorized(clientID, j.ID) || (in.Owner != "" && j.Owner != in.Owner) {
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+
+	page, next := paginate(jobs, cursor, int(in.PageSize))
+	resp := &pb.ListJobsResponse{NextPageToken: next}
+	for _, j := range page {
+		summary := &pb.JobSummary{
+			Id:              j.ID,
+			Command:         j.Command,
+			Owner:           j.Owner,
+			Status:          pb.StatusResponse_StatusType(j.Status),
+			CreatedUnixNano: j.Created.UnixNano(),
+			Labels:          j.Labels,
+		}
+		if !j.Finished.IsZero() {
+			summary.FinishedUnixNano = j.Finished.UnixNano()
+		}
+		resp.Jobs = append(resp.Jobs, summary)
+	}
+	return resp, nil
+}
+
+// GetQuota returns the quota of the requested client, by default the calling
+// client, and its current usage.
+func (s Server) GetQuota(ctx context.Context, in *pb.QuotaRequest) (*pb.QuotaResponse, error) {
+	clientID, err := clientIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	owner := *clientID
+	if in.Identity != "" && in.Identity != owner {
+		if !isAdmin(clientID) {
+			return nil, status.Errorf(codes.PermissionDenied, "only the admin may get the quota of another client")
+		}
+		owner = in.Identity
+	}
+
+	q, u := s.worker.Quota(owner)
+	return &pb.QuotaResponse{
+		MaxRunningJobs:   int32(q.MaxRunningJobs),
+		MaxQueuedJobs:    int32(q.MaxQueuedJobs),
+		MaxCpuMillis:     q.MaxCPU,
+		MaxMemoryBytes:   q.MaxMemory,
+		MaxRetainedBytes: q.MaxRetainedBytes,
+		RunningJobs:      int32(u.RunningJobs),
+		QueuedJobs:       int32(u.QueuedJobs),
+		CpuMillis:        u.CPU,
+		MemoryBytes:      u.Memory,
+		RetainedBytes:    u.RetainedBytes,
+	}, nil
+}
+
+// NodeInfo returns the capacity of the host, the resources reserved by the
+// limits of its jobs and its current usage.
+func (s Server) NodeInfo(ctx context.Context, in *pb.Empty) (*pb.NodeInfoResponse, error) {
+	n := s.worker.NodeInfo()
+	return &pb.NodeInfoResponse{
+		CpuMillis:           n.CPU,
+		MemoryBytes:         n.Memory,
+		CpuOvercommit:       n.CPUOvercommit,
+		MemoryOvercommit:    n.MemoryOvercommit,
+		ReservedCpuMillis:   n.ReservedCPU,
+		ReservedMemoryBytes: n.ReservedMemory,
+		MemoryUsedBytes:     n.MemoryUsed,
+		LoadAverage:         n.LoadAverage,
+		RunningJobs:         int32(n.RunningJobs),
+		QueuedJobs:          int32(n.QueuedJobs),
 	}, nil
 }
 
-// GetLogs returns a stream of logs from the given JobId.
-func (s Server) GetLogs(in *pb.JobId, stream pb.WorkerService_GetLogsServer) error {
+// usageToProto converts the given lib.ResourceUsage into a pb.ResourceUsage.
+func usageToProto(u lib.ResourceUsage) *pb.ResourceUsage {
+	return &pb.ResourceUsage{
+		UserTimeUsec:       u.UserTime.Microseconds(),
+		SystemTimeUsec:     u.SystemTime.Microseconds(),
+		MemoryCurrentBytes: u.MemoryCurrent,
+		MemoryPeakBytes:    u.MemoryPeak,
+		IoReadBytes:        u.IOReadBytes,
+		IoWriteBytes:       u.IOWriteBytes,
+		Pids:               u.PIDs,
+		WallTimeUsec:       u.WallTime.Microseconds(),
+	}
+}
+
+// GetLogs returns a stream of logs from the job identified by the given
+// request. Each line is tagged with the stream to which it was written. Only
+// lines selected by the request's filters are sent and the stream ends once
+// the requested maximum number of lines has been sent.
+func (s Server) GetLogs(in *pb.LogsRequest, stream pb.WorkerService_GetLogsServer) error {
 	jobID, err := uuid.FromString(in.Id)
 	if err != nil {
 		return err
 	}
-	reader, err := s.worker.Logs(stream.Context(), jobID)
+	filter, err := newLineFilter(in.Include, in.Exclude)
+	if err != nil {
+		return err
+	}
+	var fields []field
+	for _, f := range in.Fields {
+		fields = append(fields, field{key: f.Key, value: f.Value})
+	}
+	reader, err := s.worker.Logs(stream.Context(), jobID, logOptions(in))
 	if err != nil {
 		return fmt.Errorf("unable to get logs for jobId %s: %w", in.Id, err)
 	}
 
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		t := scanner.Text()
-		err := stream.Send(&pb.Log{LogLine: t})
+	lines := newLineReader(reader)
+	var sent int64
+	for in.MaxLines <= 0 || sent < in.MaxLines {
+		l, err := lines.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to fetch logs for jobId %s: %w", in.Id, err)
+		}
+		if !filter.match(l.text) {
+			continue
+		}
+		out := &pb.Log{
+			LogLine:           l.text,
+			Stream:            pb.OutputStream(l.stream),
+			Sequence:          l.seq,
+			TimestampUnixNano: l.time.UnixNano(),
+			Offset:            l.offset,
+		}
+		if in.Structured || len(fields) > 0 {
+			e, ok := parseEntry(l.text)
+			if len(fields) > 0 && (!ok || !e.matchFields(fields)) {
+				continue
+			}
+			if ok {
+				out.Structured = true
+				out.Level = e.level
+				out.Message = e.message
+				for _, f := range e.fields {
+					out.Fields = append(out.Fields, &pb.Field{Key: f.key, Value: f.value})
+				}
+			}
+		}
+		sent++
+		err = stream.Send(out)
 		if err != nil {
 			return fmt.Errorf("unable to stream logs for jobId %s: %w", in.Id, err)
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("failed to fetch logs for jobId %s: %w", in.Id, err)
+	return nil
+}
+
+// GetOutput returns a stream of the raw output of the job identified by the
+// given request. Unlike GetLogs the output is not split into lines so that it
+// is returned byte-for-byte.
+func (s Server) GetOutput(in *pb.LogsRequest, stream pb.WorkerService_GetOutputServer) error {
+	jobID, err := uuid.FromString(in.Id)
+	if err != nil {
+		return err
+	}
+	reader, err := s.worker.Logs(stream.Context(), jobID, logOptions(in))
+	if err != nil {
+		return fmt.Errorf("unable to get output for jobId %s: %w", in.Id, err)
+	}
+
+	err = batchOutput(stream.Context(), reader, outputBatchSize, outputBatchDelay, func(c lib.OutputChunk, end int64) error {
+		return stream.Send(&pb.OutputChunk{
+			Data:   c.Data,
+			Stream: pb.OutputStream(c.Stream),
+			Offset: end,
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("unable to stream output for jobId %s: %w", in.Id, err)
 	}
 	return nil
 }
 
+// logOptions returns the options selecting the output requested by the
+// given request.
+func logOptions(in *pb.LogsRequest) lib.LogOptions {
+	return lib.LogOptions{
+		Stream:   lib.OutputStream(in.Stream),
+		Since:    timeFromUnixNano(in.SinceUnixNano),
+		Until:    timeFromUnixNano(in.UntilUnixNano),
+		Offset:   in.Offset,
+		Tail:     int(in.TailLines),
+		NoFollow: in.NoFollow,
+	}
+}
+
+// timeFromUnixNano converts a time in nanoseconds since the Unix epoch to a
+// time.Time. Zero is converted to the zero time.Time.
+func timeFromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// Exec runs a command inside the namespaces of a running job and streams its
+// raw output, batched as by GetOutput, followed by its exit code.
+func (s Server) Exec(in *pb.ExecRequest, stream pb.WorkerService_ExecServer) error {
+	jobID, err := uuid.FromString(in.JobId)
+	if err != nil {
+		return err
+	}
+	reader, wait, err := s.worker.Exec(stream.Context(), jobID, in.Argv)
+	if err != nil {
+		return fmt.Errorf("unable to exec in jobId %s: %w", in.JobId, err)
+	}
+
+	err = batchOutput(stream.Context(), reader, outputBatchSize, outputBatchDelay, func(c lib.OutputChunk, _ int64) error {
+		return stream.Send(&pb.ExecResponse{Data: c.Data, Stream: pb.OutputStream(c.Stream)})
+	})
+	if err != nil {
+		return fmt.Errorf("unable to stream exec output for jobId %s: %w", in.JobId, err)
+	}
+
+	return stream.Send(&pb.ExecResponse{
+		Exited:   true,
+		ExitCode: int32(wait()),
+	})
+}
+
 // Serve starts the server.
 func (s Server) Serve() error {
 	log.Info("Starting to serve...")
@@ -118,6 +536,7 @@ func (s Server) Serve() error {
 // Close stops the server and closes any connections.
 func (s Server) Close() {
 	s.grpc.Stop()
+	s.worker.Close()
 }
 
 // NewServer constructs a server from the given configuration.
@@ -151,16 +570,46 @@ func NewServer(c Config) (*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse timeout duration: %w", err)
 	}
+	// Every call counts towards the request rate limit, so the same
+	// limiter is shared by unary calls and streams.
+	requests := newRateLimiter(c.RequestRateLimits)
 	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(config)),
-		grpc.UnaryInterceptor(unaryAuthorizationInterceptor),
-		grpc.StreamInterceptor(authorizationStreamInterceptor()),
+		grpc.ChainUnaryInterceptor(
+			unaryRateLimitInterceptor(newRateLimiter(c.SubmitRateLimits), requests),
+			unaryAuthorizationInterceptor,
+		),
+		grpc.ChainStreamInterceptor(
+			streamRateLimitInterceptor(requests),
+			authorizationStreamInterceptor(),
+		),
 		grpc.ConnectionTimeout(timeout),
 	)
 
+	// Once a deleted job has been forgotten by the worker there is no
+	// need to remember which client submitted it.
+	c.Worker.OnForget = func(jobID uuid.UUID) {
+		forgetOwner(jobID.String())
+	}
+	if c.QuotaFile != "" {
+		c.Worker.Quotas, err = backend.LoadQuotaPolicy(c.QuotaFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	worker := backend.NewWorker(c.Worker)
+	err = worker.Restore()
+	if err != nil {
+		worker.Close()
+		return nil, fmt.Errorf("failed to restore jobs: %w", err)
+	}
+	for _, j := range worker.List(lib.JobFilter{}) {
+		recordOwner(j.ID, j.Owner)
+	}
+
 	w := Server{
 		Config: &c,
 		grpc:   s,
-		worker: backend.NewWorker(),
+		worker: worker,
 	}
 	pb.RegisterWorkerServiceServer(s, w)
 	return &w, nil
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thompsy/worker-api-service/lib"
+	"github.com/thompsy/worker-api-service/lib/backend"
+	pb "github.com/thompsy/worker-api-service/lib/protobuf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// TestMain stands in for the server's main when a job is started, in which
+// case the job writes a line of output and runs until it is stopped.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == "exec" {
+		fmt.Println("output")
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// TestSubmitQuota verifies that Submit fails with a ResourceExhausted status
+// when a job would exceed any limit of the client's quota.
+func TestSubmitQuota(t *testing.T) {
+	tests := []struct {
+		name  string
+		quota lib.Quota
+
+		// maxRunningJobs is the global limit on running jobs.
+		maxRunningJobs int
+
+		// jobs is the number of jobs submitted, and accepted, before
+		// the one which exceeds the quota.
+		jobs    int
+		command *pb.Command
+	}{
+		{"CPU", lib.Quota{MaxCPU: 500}, 0, 0, &pb.Command{Limits: &pb.Limits{CpuMillis: 1000}}},
+		{"memory", lib.Quota{MaxMemory: 1 << 20}, 0, 0, &pb.Command{Limits: &pb.Limits{MemoryBytes: 2 << 20}}},
+		{"running jobs", lib.Quota{MaxRunningJobs: 1}, 0, 1, &pb.Command{}},
+		{"queued jobs", lib.Quota{MaxQueuedJobs: 1}, 1, 2, &pb.Command{}},
+		{"retained output", lib.Quota{MaxRetainedBytes: 1}, 0, 1, &pb.Command{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.jobs > 0 {
+				skipCI(t)
+			}
+			worker := backend.NewWorker(backend.Config{
+				MaxRunningJobs: test.maxRunningJobs,
+				Quotas: backend.QuotaPolicy{Quotas: map[string]lib.Quota{
+					"client_a@example.com": test.quota,
+				}},
+			})
+			defer worker.Close()
+			s := Server{Config: &Config{}, worker: worker}
+			ctx := clientContext("client_a@example.com")
+
+			for i := 0; i < test.jobs; i++ {
+				jobID, err := s.Submit(ctx, &pb.Command{Command: "true"})
+				require.Nil(t, err)
+				defer func() {
+					_, _ = s.Stop(ctx, jobID)
+				}()
+			}
+			if test.quota.MaxRetainedBytes > 0 {
+				require.Eventually(t, func() bool {
+					_, u := worker.Quota("client_a@example.com")
+					return u.RetainedBytes > 0
+				}, 5*time.Second, 10*time.Millisecond)
+			}
+
+			test.command.Command = "true"
+			_, err := s.Submit(ctx, test.command)
+			require.Equal(t, codes.ResourceExhausted, status.Code(err))
+		})
+	}
+}
+
+// clientContext returns a context carrying the certificate of the client with
+// the given CommonName, as that of a call made by the client.
+func clientContext(clientID string) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: clientID}}},
+		}},
+	})
+}
+
+// skipCI skips the current test if running in a CI environment, since jobs
+// cannot be started in a non-privileged container.
+func skipCI(t *testing.T) {
+	if os.Getenv("CI") != "" {
+		t.Skip("Skipping testing in CI environment")
+	}
+}
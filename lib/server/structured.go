@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// levelKeys and messageKeys are the keys commonly used by logging libraries
+// for the level and message of a structured log entry, in order of
+// preference.
+var (
+	levelKeys   = []string{"level", "lvl", "severity"}
+	messageKeys = []string{"msg", "message"}
+)
+
+// entry is a log line which has been parsed as a JSON object.
+type entry struct {
+	level   string
+	message string
+
+	// fields contains the remaining keys of the object, sorted by key.
+	fields []field
+
+	// values contains the value of every key of the object, including
+	// those used for the level and message.
+	values map[string]string
+}
+
+// field is a single key and value of a structured log entry. Values which
+// are not strings are represented by their JSON encoding.
+type field struct {
+	key   string
+	value string
+}
+
+// parseEntry parses the given line as a JSON object. It returns false if the
+// line is not a JSON object.
+func parseEntry(text string) (entry, bool) {
+	trimmed := strings.TrimSpace(text)
+	if !strings.HasPrefix(trimmed, "{") {
+		return entry{}, false
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(trimmed))
+	decoder.UseNumber()
+	var object map[string]json.RawMessage
+	err := decoder.Decode(&object)
+	if err != nil || decoder.More() {
+		return entry{}, false
+	}
+
+	e := entry{values: make(map[string]string, len(object))}
+	for k, raw := range object {
+		e.values[k] = fieldValue(raw)
+	}
+
+	used := make(map[string]bool)
+	e.level = firstValue(e.values, levelKeys, used)
+	e.message = firstValue(e.values, messageKeys, used)
+
+	for k, v := range e.values {
+		if !used[k] {
+			e.fields = append(e.fields, field{key: k, value: v})
+		}
+	}
+	sort.Slice(e.fields, func(i, j int) bool {
+		return e.fields[i].key < e.fields[j].key
+	})
+	return e, true
+}
+
+// fieldValue returns the string represented by the given JSON value if it is
+// a string, otherwise the compacted JSON itself.
+func fieldValue(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var b bytes.Buffer
+	if json.Compact(&b, raw) != nil {
+		return string(raw)
+	}
+	return b.String()
+}
+
+// firstValue returns the value of the first of the given keys present in
+// values and records that key as used.
+func firstValue(values map[string]string, keys []string, used map[string]bool) string {
+	for _, k := range keys {
+		if v, ok := values[k]; ok {
+			used[k] = true
+			return v
+		}
+	}
+	return ""
+}
+
+// matchFields returns true if the entry has every one of the given keys with
+// the corresponding value. The keys "level" and "msg" match the level and
+// message of the entry regardless of the key under which they were written.
+func (e entry) matchFields(fields []field) bool {
+	for _, f := range fields {
+		var v string
+		var ok bool
+		switch f.key {
+		case "level":
+			v, ok = e.level, e.level != ""
+		case "msg":
+			v, ok = e.message, e.message != ""
+		default:
+			v, ok = e.values[f.key]
+		}
+		if !ok || v != f.value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseEntry verifies that JSON log lines are parsed into their level,
+// message and remaining fields.
+func TestParseEntry(t *testing.T) {
+	e, ok := parseEntry(`{"level":"error","msg":"failed to connect","port":5432,"host":"db","retry":{"n":1}}`)
+	require.True(t, ok)
+	require.Equal(t, "error", e.level)
+	require.Equal(t, "failed to connect", e.message)
+	require.Equal(t, []field{
+		{key: "host", value: "db"},
+		{key: "port", value: "5432"},
+		{key: "retry", value: `{"n":1}`},
+	}, e.fields)
+
+	e, ok = parseEntry(`{"severity":"INFO","message":"started"}`)
+	require.True(t, ok)
+	require.Equal(t, "INFO", e.level)
+	require.Equal(t, "started", e.message)
+	require.Empty(t, e.fields)
+
+	for _, text := range []string{"plain text", `{"unterminated":`, `{"a":1} {"b":2}`, `["array"]`} {
+		_, ok = parseEntry(text)
+		require.False(t, ok, text)
+	}
+}
+
+// TestMatchFields verifies that entries are filtered by field equality.
+func TestMatchFields(t *testing.T) {
+	e, ok := parseEntry(`{"lvl":"error","msg":"failed","code":500}`)
+	require.True(t, ok)
+
+	tests := []struct {
+		fields   []field
+		expected bool
+	}{
+		{nil, true},
+		{[]field{{key: "level", value: "error"}}, true},
+		{[]field{{key: "lvl", value: "error"}}, true},
+		{[]field{{key: "level", value: "info"}}, false},
+		{[]field{{key: "level", value: "error"}, {key: "code", value: "500"}}, true},
+		{[]field{{key: "level", value: "error"}, {key: "code", value: "404"}}, false},
+		{[]field{{key: "missing", value: ""}}, false},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expected, e.matchFields(test.fields), test.fields)
+	}
+}
@@ -1,12 +1,216 @@
 package lib
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var (
 	// ErrNotFound is the standard error which will be returned if we are unable to authorize the client for any reason.
 	ErrNotFound = errors.New("job not found")
+
+	// ErrExpired is returned for a job which has been deleted, either
+	// explicitly or because it exceeded the server's retention policy.
+	ErrExpired = errors.New("job expired")
+
+	// ErrQuotaExceeded is returned when a job is submitted which would
+	// exceed the client's quota.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// RetryAfterKey is the gRPC metadata key with which the server returns the
+// time, formatted as a duration such as "1.5s", after which a call which was
+// rejected because the client exceeded its rate limit may be retried.
+const RetryAfterKey = "retry-after"
+
+// Command describes a client submitted job along with the configuration of
+// the isolated environment in which it will be run.
+type Command struct {
+	// Command is the command, including any arguments, to run.
+	Command string
+
+	// Hostname is the hostname of the job. If empty the first segment of
+	// the job ID is used.
+	Hostname string
+
+	// Hosts are additional entries to be appended to the job's /etc/hosts.
+	Hosts []HostEntry
+
+	// DNS is written to the job's /etc/resolv.conf. If empty the
+	// resolv.conf from the root filesystem is left untouched.
+	DNS DNSConfig
+
+	// Limits are the POSIX resource limits and scheduling settings
+	// applied to the job.
+	Limits Limits
+
+	// OutputLimit is the number of bytes of output retained for the job.
+	// Once exceeded the start of the output and a rolling tail of the
+	// most recent output are retained. If zero the server's maximum is
+	// used.
+	OutputLimit int64
+
+	// KillOnOutputLimit stops the job once its output exceeds the
+	// output limit rather than keeping a rolling tail.
+	KillOnOutputLimit bool
+
+	// Labels are arbitrary key value pairs by which jobs may be listed.
+	Labels map[string]string
+
+	// Owner identifies the client which submitted the job. It is set by
+	// the server rather than the client.
+	Owner string
+
+	// Priority is the scheduling priority class of the job.
+	Priority Priority
+}
+
+// Priority is the scheduling priority class of a job. Queued jobs of a higher
+// class are started before those of a lower class and, if the server is so
+// configured, may preempt running jobs of a lower class.
+type Priority int
+
+const (
+	PriorityDefault Priority = iota
+	PriorityInteractive
+	PriorityBatch
 )
 
+// Rank orders priority classes from the lowest, batch, to the highest,
+// interactive.
+func (p Priority) Rank() int {
+	switch p {
+	case PriorityInteractive:
+		return 2
+	case PriorityBatch:
+		return 0
+	}
+	return 1
+}
+
+// HostEntry is a single line of an /etc/hosts file.
+type HostEntry struct {
+	IP        string
+	Hostnames []string
+}
+
+// DNSConfig contains the resolver configuration of a job.
+type DNSConfig struct {
+	Nameservers []string
+	Search      []string
+	Options     []string
+}
+
+// Limits contains the rlimits and scheduling settings of a job. A nil Rlimit
+// indicates that the server default should be used.
+type Limits struct {
+	NoFile   *Rlimit
+	Core     *Rlimit
+	FileSize *Rlimit
+	Stack    *Rlimit
+
+	// Nice is the nice value of the job, between -20 and 19.
+	Nice int
+
+	// IOClass and IOPriority are the I/O scheduling class and priority
+	// of the job, as set by ionice(1).
+	IOClass    IOClass
+	IOPriority int
+
+	// CPUs is the list of CPUs the job may run on. If empty the job may
+	// run on any CPU.
+	CPUs []int
+
+	// CPU is the CPU time the job may use, in thousandths of a CPU, and
+	// Memory the memory it may use in bytes. They are enforced by the
+	// job's cgroup and reserved from the client's quota. Zero means no
+	// limit.
+	CPU    int64
+	Memory int64
+}
+
+// Rlimit is a soft and hard resource limit.
+type Rlimit struct {
+	Soft uint64
+	Hard uint64
+}
+
+// IOClass is the I/O scheduling class of a job. The values match those
+// used by ioprio_set(2).
+type IOClass int
+
+const (
+	IOClassNone IOClass = iota
+	IOClassRealtime
+	IOClassBestEffort
+	IOClassIdle
+)
+
+// OutputStream identifies the stream to which a job wrote its output.
+type OutputStream int
+
+const (
+	// BOTH selects the output written to both stdout and stderr.
+	BOTH OutputStream = iota
+	STDOUT
+	STDERR
+)
+
+// OutputChunk is a single write of output by a job.
+type OutputChunk struct {
+	Stream OutputStream
+	Data   []byte
+
+	// Seq is the sequence number of the chunk. Sequence numbers start
+	// at zero and increase by one with each write.
+	Seq uint64
+
+	// Time is the time at which the chunk was written.
+	Time time.Time
+
+	// Offset is the position of the first byte of Data within the whole
+	// output of the job, counting both streams.
+	Offset int64
+
+	// Dropped is non-zero if the chunk is a marker standing in for that
+	// many bytes of output which were dropped from Offset onwards, in
+	// which case Data contains the text of the marker.
+	Dropped int64
+}
+
+// End returns the position in the whole output immediately after the chunk,
+// which for a marker is where the output resumes after the dropped bytes.
+func (c OutputChunk) End() int64 {
+	if c.Dropped > 0 {
+		return c.Offset + c.Dropped
+	}
+	return c.Offset + int64(len(c.Data))
+}
+
+// LogOptions selects the output returned when reading the logs of a job.
+type LogOptions struct {
+	// Stream selects whether stdout, stderr or both are returned.
+	Stream OutputStream
+
+	// Since and Until restrict the output to that written within the
+	// given time range. A zero value leaves the range unbounded.
+	Since time.Time
+	Until time.Time
+
+	// Offset is the position within the whole output of the job from
+	// which to start reading. This allows a reader to resume from where a
+	// previous reader stopped.
+	Offset int64
+
+	// Tail, if positive, restricts the output to the last Tail lines
+	// written to the selected streams.
+	Tail int
+
+	// NoFollow ends the output once the output written so far has been
+	// read rather than waiting for the job to write more.
+	NoFollow bool
+}
+
 // Status provides status information about a client submitted job.
 type Status struct {
 	Status StatusCode
@@ -14,14 +218,175 @@ type Status struct {
 	// ExitCode is the exit code returned by the command. It's value is
 	// only meaningful if the Status is COMPLETED or STOPPED.
 	ExitCode int
+
+	// Usage is the total resources used by the job. It's value is only
+	// meaningful if the Status is COMPLETED or STOPPED.
+	Usage ResourceUsage
+
+	// OutputTruncated is true if some of the job's output was not
+	// retained because it exceeded the job's output limit.
+	OutputTruncated bool
+
+	// QueuePosition is the position of the job in the queue, starting
+	// from one, if the Status is QUEUED or PAUSED.
+	QueuePosition int
+}
+
+// JobSummary describes a job when listing jobs.
+type JobSummary struct {
+	ID      string
+	Command string
+	Owner   string
+	Labels  map[string]string
+	Status  StatusCode
+
+	// Created is the time at which the job was submitted and Finished
+	// the time at which it exited. Finished is zero until the job has
+	// finished.
+	Created  time.Time
+	Finished time.Time
+}
+
+// JobFilter selects the jobs returned when listing jobs. A zero value field
+// matches every job.
+type JobFilter struct {
+	// Statuses selects jobs with any of the given statuses.
+	Statuses []StatusCode
+
+	// Labels selects jobs with all of the given labels.
+	Labels map[string]string
+
+	// CreatedAfter and CreatedBefore select jobs created within the given
+	// time range.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// ResourceUsage contains the resources used by a job.
+type ResourceUsage struct {
+	// UserTime and SystemTime are the CPU time spent by the job in user
+	// and kernel mode respectively.
+	UserTime   time.Duration
+	SystemTime time.Duration
+
+	// MemoryCurrent and MemoryPeak are the current and peak memory usage
+	// of the job in bytes.
+	MemoryCurrent uint64
+	MemoryPeak    uint64
+
+	// IOReadBytes and IOWriteBytes are the number of bytes read from and
+	// written to block devices by the job.
+	IOReadBytes  uint64
+	IOWriteBytes uint64
+
+	// PIDs is the number of processes currently running in the job.
+	PIDs uint64
+
+	// WallTime is the time elapsed since the job started or, if the job
+	// has finished, the total run time of the job.
+	WallTime time.Duration
+}
+
+// Quota limits the jobs and resources of a single client. A zero value field
+// means no limit.
+type Quota struct {
+	// MaxRunningJobs is the number of the client's jobs which may run at
+	// once, including paused jobs. Further jobs are rejected, and jobs
+	// already queued are held back until one of them finishes.
+	MaxRunningJobs int
+
+	// MaxQueuedJobs is the number of the client's jobs which may be
+	// queued. A job which can start immediately is not counted.
+	MaxQueuedJobs int
+
+	// MaxCPU and MaxMemory are the total CPU, in thousandths of a CPU,
+	// and memory, in bytes, which may be reserved by the client's
+	// unfinished jobs.
+	MaxCPU    int64
+	MaxMemory int64
+
+	// MaxRetainedBytes is the number of bytes of output which may be
+	// retained for the client's jobs.
+	MaxRetainedBytes int64
+}
+
+// QuotaUsage contains the jobs and resources counted against a client's
+// quota.
+type QuotaUsage struct {
+	RunningJobs   int
+	QueuedJobs    int
+	CPU           int64
+	Memory        int64
+	RetainedBytes int64
+}
+
+// NodeInfo describes the capacity of the host on which jobs run, the
+// resources reserved by the limits of its jobs and its current usage.
+type NodeInfo struct {
+	// CPU is the number of CPUs of the host, in thousandths of a CPU, and
+	// Memory its total memory in bytes.
+	CPU    int64
+	Memory int64
+
+	// CPUOvercommit and MemoryOvercommit are the ratios of the capacity
+	// of the host which may be reserved by jobs. Zero means that jobs
+	// are admitted regardless of the resources they reserve.
+	CPUOvercommit    float64
+	MemoryOvercommit float64
+
+	// ReservedCPU and ReservedMemory are the sums of the limits of the
+	// running jobs, with paused jobs continuing to reserve their memory.
+	ReservedCPU    int64
+	ReservedMemory int64
+
+	// MemoryUsed is the memory of the host which is in use and
+	// LoadAverage its one minute load average.
+	MemoryUsed  int64
+	LoadAverage float64
+
+	RunningJobs int
+	QueuedJobs  int
+}
+
+// Process describes a single process running within a job.
+type Process struct {
+	// PID is the process ID within the job's PID namespace.
+	PID int
+
+	// HostPID is the process ID on the host.
+	HostPID int
+
+	// Command is the command line of the process.
+	Command string
+
+	// State is the state of the process as reported by /proc e.g. "S
+	// (sleeping)".
+	State string
+
+	// CPUTime is the CPU time spent by the process in user and kernel
+	// mode.
+	CPUTime time.Duration
+
+	// RSS is the resident set size of the process in bytes.
+	RSS uint64
+}
+
+// CPUTime returns the total CPU time spent by the job.
+func (u ResourceUsage) CPUTime() time.Duration {
+	return u.UserTime + u.SystemTime
 }
 
 // StatusCode is an int type that represents whether a job is running,
-// completed or has been stopped.
+// completed, has been stopped, was lost because the server restarted while
+// it was running, is queued waiting to run or has been paused to let a job of
+// a higher priority run.
 type StatusCode int
 
 const (
 	RUNNING StatusCode = iota
 	COMPLETED
 	STOPPED
+	LOST
+	QUEUED
+	PAUSED
 )